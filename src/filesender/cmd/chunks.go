@@ -0,0 +1,326 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	crypto "filesender/crypto"
+	relay "filesender/relay"
+	helper "filesender/utils"
+
+	pb "gopkg.in/cheggaaa/pb.v1"
+)
+
+// ##### Constants ###########################################################
+
+// CHUNK_WORKERS is the default number of chunks uploaded or downloaded in parallel
+const CHUNK_WORKERS int = 4
+
+// ##### Structs #############################################################
+
+// chunkJob is a chunk of the file contents read by the sender, waiting to be uploaded
+type chunkJob struct {
+	index int
+	data  []byte
+}
+
+// chunkResult is a chunk downloaded by the receiver, waiting to be reassembled
+type chunkResult struct {
+	data []byte
+	err  error
+}
+
+// chunkReader reads the chunks of the file contents in order, while the following chunks
+// are downloaded in parallel. The slots limit the number of chunks downloaded ahead
+type chunkReader struct {
+	results []chan chunkResult
+	slots   chan struct{}
+	index   int
+	current *bytes.Reader
+}
+
+// ##### Functions ###########################################################
+
+// uploadChunks uploads the file contents as chunk objects of the chunk size, which are
+// uploaded in parallel by the workers, followed by the object holding the meta data and
+// the manifest listing the chunks in order. The file contents are a single stream, so the
+// chunks are read into memory in turn, and at most one chunk per worker is held in memory.
+// If a chunk fails, no more chunks are uploaded, and the chunks already uploaded are removed
+func uploadChunks(r relay.Relay, name string, md map[string]string, length int64, fileReader io.Reader, fileHash hash.Hash, chunkSize int64, workers int) {
+
+	count := int((length + chunkSize - 1) / chunkSize)
+	if count == 0 {
+		count = 1
+	}
+
+	m := &relay.ChunkManifest{Code: md[relay.KEY_CODE], Size: length, Chunks: make([]relay.Chunk, count)}
+
+	// The progress bar is shared by the workers, and is updated as each chunk is uploaded
+	progressBar := getProgressBar(length)
+
+	// The first error is kept, the workers skip the remaining jobs once a chunk has failed
+	var mu sync.Mutex
+	var failed error
+	fail := func(err error) {
+
+		mu.Lock()
+		defer mu.Unlock()
+		if failed == nil {
+			failed = err
+		}
+	}
+	hasFailed := func() bool {
+
+		mu.Lock()
+		defer mu.Unlock()
+		return failed != nil
+	}
+
+	jobs := make(chan chunkJob)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+
+			defer wg.Done()
+			for job := range jobs {
+				if hasFailed() == true {
+					continue
+				}
+
+				chunk, err := putChunk(r, md[relay.KEY_CODE], relay.KIND_CHUNK, relay.ChunkName(name, job.index), job.data, progressBar)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				m.Chunks[job.index] = chunk
+			}
+		}()
+	}
+
+	for i := 0; i < count && hasFailed() == false; i++ {
+		size := length - int64(i)*chunkSize
+		if size > chunkSize {
+			size = chunkSize
+		}
+
+		data := make([]byte, size)
+		_, err := io.ReadFull(fileReader, data)
+		if err != nil {
+			fail(fmt.Errorf("Error reading file contents: %v", err))
+			break
+		}
+
+		jobs <- chunkJob{index: i, data: data}
+	}
+	close(jobs)
+	wg.Wait()
+
+	// The workers have finished, so every chunk that was uploaded is found
+	if failed != nil {
+		fmt.Println("")
+		for _, c := range findChunks(r, &relay.Object{Name: name, Metadata: md}) {
+			err := r.Delete(c)
+			if err != nil {
+				fmt.Printf("Failed to delete uploaded chunk %s: %v\n", c.Name, err)
+			}
+		}
+		helper.OutputAndExit(failed.Error())
+	}
+
+	progressBar.Finish()
+
+	// The chunk count marks the object as holding the manifest rather than the file contents
+	data := m.Bytes()
+	md[relay.KEY_CHUNKS] = strconv.Itoa(count)
+
+	obj, err := r.Put(name, md, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to upload chunk manifest: %v", err))
+	}
+
+	sum := md5.Sum(data)
+	verifyUpload(r, obj, hex.EncodeToString(sum[:]))
+
+	storeChecksum(r, md, obj, fileHash)
+}
+
+// putChunk uploads the chunk or segment object, tagged with the mnemonicode and
+// kind, and verifies the upload
+func putChunk(r relay.Relay, mnemonicode string, kind string, name string, data []byte, progressBar *pb.ProgressBar) (relay.Chunk, error) {
+
+	md := make(map[string]string, 0)
+	md[relay.KEY_CODE] = mnemonicode
+	md[relay.KEY_KIND] = kind
+
+	md5Hash := md5.New()
+	reader := io.TeeReader(bytes.NewReader(data), io.MultiWriter(progressBar, md5Hash))
+
+	obj, err := r.Put(name, md, int64(len(data)), reader)
+	if err != nil {
+		return relay.Chunk{}, fmt.Errorf("Failed to upload %s: %v", kind, err)
+	}
+
+	err = checkUpload(r, obj, hex.EncodeToString(md5Hash.Sum(nil)))
+	if err != nil {
+		return relay.Chunk{}, err
+	}
+
+	sum := sha256.Sum256(data)
+	return relay.Chunk{Name: name, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}, nil
+}
+
+// receiveChunks downloads the chunks of the file in parallel, and reassembles them in
+// order, so that they are received as a single file. The chunks are verified against
+// the manifest as they are downloaded, and the whole file against the file checksum
+func receiveChunks(r relay.Relay, obj *relay.Object, p *crypto.Pake, opts *receiveOptions) (string, string) {
+
+	reader, err := r.Open(obj)
+	if err != nil {
+		helper.OutputAndExit(err.Error())
+	}
+
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to download chunk manifest: %v", err))
+	}
+
+	m, err := relay.ParseChunkManifest(data)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Invalid chunk manifest: %v", err))
+	}
+
+	if m.Code != obj.Code() || strconv.Itoa(len(m.Chunks)) != obj.Metadata[relay.KEY_CHUNKS] {
+		helper.OutputAndExit("Chunk manifest does not match the uploaded file")
+	}
+
+	objs := findChunks(r, obj)
+
+	chunks := make([]*relay.Object, len(m.Chunks))
+	for i, c := range m.Chunks {
+		chunks[i] = objs[c.Name]
+		if chunks[i] == nil || chunks[i].Size != c.Size || c.Name != relay.ChunkName(obj.Name, i) {
+			helper.OutputAndExit(fmt.Sprintf("Chunk %d of the file is missing or does not match the manifest", i))
+		}
+	}
+
+	return receiveFile(obj.Metadata, m.Size, newChunkReader(r, chunks, m.Chunks, opts.parallel), p, opts)
+}
+
+// findChunks returns the chunk objects of the file, keyed by name
+func findChunks(r relay.Relay, obj *relay.Object) map[string]*relay.Object {
+
+	objs, err := r.Find(obj.Code())
+	if err != nil {
+		helper.OutputAndExit(err.Error())
+	}
+
+	chunks := make(map[string]*relay.Object, 0)
+	for _, o := range objs {
+		if o.Kind() == relay.KIND_CHUNK && strings.HasPrefix(o.Name, obj.Name+".") == true {
+			chunks[o.Name] = o
+		}
+	}
+
+	return chunks
+}
+
+// deleteChunks removes the chunk objects of the file, if it was uploaded as chunks
+func deleteChunks(r relay.Relay, obj *relay.Object) error {
+
+	if len(obj.Metadata[relay.KEY_CHUNKS]) == 0 {
+		return nil
+	}
+
+	for _, c := range findChunks(r, obj) {
+		err := r.Delete(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newChunkReader returns a chunkReader, and starts downloading the chunks in order
+// using the number of workers, each waits for a slot before downloading a chunk
+func newChunkReader(r relay.Relay, objs []*relay.Object, chunks []relay.Chunk, workers int) *chunkReader {
+
+	c := &chunkReader{
+		results: make([]chan chunkResult, len(objs)),
+		slots:   make(chan struct{}, workers),
+	}
+	for i := range c.results {
+		c.results[i] = make(chan chunkResult, 1)
+	}
+
+	go func() {
+
+		for i := range objs {
+			c.slots <- struct{}{}
+			go func(i int) {
+
+				data, err := downloadChunk(r, objs[i], chunks[i])
+				c.results[i] <- chunkResult{data: data, err: err}
+			}(i)
+		}
+	}()
+
+	return c
+}
+
+// downloadChunk downloads the chunk into memory, and checks it against the manifest
+func downloadChunk(r relay.Relay, obj *relay.Object, chunk relay.Chunk) ([]byte, error) {
+
+	reader, err := r.Open(obj)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(reader, chunk.Size+1))
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	if int64(len(data)) != chunk.Size || hex.EncodeToString(sum[:]) != chunk.SHA256 {
+		return nil, fmt.Errorf("Chunk %s does not match the manifest", chunk.Name)
+	}
+
+	return data, nil
+}
+
+// ##### Methods #############################################################
+
+// Read reads the current chunk, and then waits for the next chunk to be downloaded
+func (c *chunkReader) Read(p []byte) (int, error) {
+
+	for c.current == nil || c.current.Len() == 0 {
+		if c.index == len(c.results) {
+			return 0, io.EOF
+		}
+
+		// The slot is freed once the chunk is held by the reader
+		result := <-c.results[c.index]
+		<-c.slots
+		c.index++
+
+		if result.err != nil {
+			return 0, result.err
+		}
+		c.current = bytes.NewReader(result.data)
+	}
+
+	return c.current.Read(p)
+}
@@ -0,0 +1,485 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	config "filesender/config"
+	crypto "filesender/crypto"
+	relay "filesender/relay"
+	helper "filesender/utils"
+)
+
+// ##### Constants ###########################################################
+
+// PARTIAL_EXT is appended to the file name while the file is being received
+const PARTIAL_EXT string = ".partial"
+
+// DOWNLOAD_CHECKPOINT is the interval of the decrypted stream at which the download
+// state is saved, a multiple of the stream chunk size and of the AES block size
+const DOWNLOAD_CHECKPOINT int64 = 16 * int64(crypto.STREAM_CHUNK_SIZE)
+
+// ##### Structs #############################################################
+
+// checkpointWriter writes the file contents to the partial file, and calls checkpoint
+// at each checkpoint, the writes are split so the checkpoint is at the exact offset.
+// The checkpoint is only called once more bytes follow it, as there is nothing left
+// to decrypt from a checkpoint at the end of the stream
+type checkpointWriter struct {
+	writer     io.Writer
+	offset     int64
+	next       int64
+	pending    bool
+	checkpoint func(int64)
+}
+
+// hashReader calculates the SHA-256 of the bytes received, keeping the state of the hash at
+// each checkpoint of the decrypted stream, so that it can be saved once the checkpoint is written
+type hashReader struct {
+	reader     io.Reader
+	md         map[string]string
+	hash       hash.Hash
+	offset     int64
+	checkpoint int64
+	states     map[int64][]byte
+}
+
+// ##### Functions ###########################################################
+
+// receiveObject downloads the file from the relay and writes it to the local disk. Streamed
+// uploads are followed as they are uploaded, and files uploaded as chunks are downloaded
+// in parallel. Otherwise if the relay supports range requests, the file is written to a
+// partial file, so that an interrupted download can continue from the last checkpoint
+// when receive is run again
+func receiveObject(r relay.Relay, obj *relay.Object, p *crypto.Pake, opts *receiveOptions) (string, string) {
+
+	if isStream(obj) == true {
+		return receiveStream(r, obj, p, opts)
+	}
+
+	// The file cannot be verified until the checksum is stored
+	if len(obj.Metadata[relay.KEY_SHA256]) == 0 {
+		helper.OutputAndExit("File has no checksum, the upload has not completed")
+	}
+
+	if len(obj.Metadata[relay.KEY_CHUNKS]) > 0 {
+		return receiveChunks(r, obj, p, opts)
+	}
+
+	ranger, ok := r.(relay.Ranger)
+	if ok == false || isResumable(obj.Metadata) == false {
+		reader, err := r.Open(obj)
+		if err != nil {
+			helper.OutputAndExit(err.Error())
+		}
+		defer reader.Close()
+
+		return receiveFile(obj.Metadata, obj.Size, reader, p, opts)
+	}
+
+	downloads := new(config.Downloads)
+	downloads.Load()
+
+	// The download starts again if the partial file is missing or incomplete
+	d := downloads.Find(obj.Name)
+	if d != nil {
+		stat, err := os.Stat(d.FileName + PARTIAL_EXT)
+		if err != nil || stat.Size() < d.Offset {
+			d = nil
+		}
+	}
+
+	if obj.Metadata[relay.KEY_FORMAT] == crypto.FORMAT_ENVELOPE {
+		return receiveEnvelopeRange(ranger, obj, d, opts)
+	}
+
+	return receiveFileRange(ranger, obj, d)
+}
+
+// isResumable returns true if the download of the file format can continue from a
+// checkpoint. The keys of PAKE transfers are not kept, and the age and PGP formats
+// cannot be decrypted from an offset
+func isResumable(md map[string]string) bool {
+
+	if len(md[relay.KEY_PAKE]) > 0 {
+		return false
+	}
+
+	switch md[relay.KEY_FORMAT] {
+	case "", crypto.FORMAT_CFB, crypto.FORMAT_STREAM, crypto.FORMAT_ENVELOPE:
+		return true
+	}
+
+	return false
+}
+
+// remoteOffset returns the offset in the relay file of the checkpoint, which is the
+// offset in the decrypted stream. The stream formats add a tag to each chunk, and
+// every encrypted format is preceded by the IV or salt
+func remoteOffset(md map[string]string, checkpoint int64) int64 {
+
+	switch {
+	case md[relay.KEY_FORMAT] == crypto.FORMAT_STREAM || md[relay.KEY_FORMAT] == crypto.FORMAT_ENVELOPE:
+		return int64(crypto.STREAM_SALT_SIZE) + crypto.StreamSize(checkpoint)
+	case len(md[relay.KEY_IV]) > 0:
+		return int64(aes.BlockSize) + checkpoint
+	default:
+		return checkpoint
+	}
+}
+
+// receiveFileRange downloads the file from the relay, continuing the interrupted download.
+// The CFB format is decrypted using the preceding block as the IV, and the stream format
+// from the chunk at the checkpoint, the unencrypted format needs neither
+func receiveFileRange(ranger relay.Ranger, obj *relay.Object, d *config.Download) (string, string) {
+
+	md := obj.Metadata
+
+	fileName := localFileName(md[relay.KEY_FILE_NAME])
+
+	encrypted, ivp, err := checkIfEncrypted(md)
+	if err != nil {
+		helper.OutputAndExit(err.Error())
+	}
+
+	var key []byte
+	if encrypted == true {
+		key = getDecryptionKey(md[relay.KEY_KEY_ID])
+	}
+
+	if d == nil {
+		checkLocalFile(fileName)
+		d = &config.Download{Name: obj.Name, FileName: fileName, Started: time.Now().Format(time.RFC3339)}
+	}
+
+	offset := remoteOffset(md, d.Offset)
+
+	var body io.ReadCloser
+	var reader io.Reader
+	switch {
+	case d.Offset == 0:
+		body = openRange(ranger, obj, 0)
+		reader = body
+		if encrypted == true {
+			reader = validateIv(body, key, ivp, md[relay.KEY_FORMAT])
+		}
+	case md[relay.KEY_FORMAT] == crypto.FORMAT_STREAM:
+		body = openRange(ranger, obj, offset)
+		reader, err = crypto.NewStreamDecrypterAt(key, ivp, body, uint64(d.Offset/int64(crypto.STREAM_CHUNK_SIZE)))
+		if err != nil {
+			helper.OutputAndExit(fmt.Sprintf("Unable to decrypt file: %v", err))
+		}
+	case encrypted == true:
+		body = openRange(ranger, obj, offset-int64(aes.BlockSize))
+		iv := make([]byte, aes.BlockSize)
+		_, err = io.ReadFull(body, iv)
+		if err != nil {
+			helper.OutputAndExit(fmt.Sprintf("Error reading file contents: %v", err))
+		}
+		reader = crypto.MakeDecryptionReader(key, iv, body)
+	default:
+		body = openRange(ranger, obj, offset)
+		reader = body
+	}
+	defer body.Close()
+
+	sum := writePartialFile(d, obj.Size, reader, func(offset int64) {
+
+		d.Offset = offset
+		saveDownload(d)
+	})
+
+	verifyLocalFile(fileName, md[relay.KEY_SHA256], sum)
+
+	return fileName, sum
+}
+
+// receiveEnvelopeRange downloads the envelope format file from the relay, continuing the
+// interrupted download. The envelope fields and the salt are kept in the download state, as
+// the envelope precedes the checkpoint, along with the state of the checksum of the bytes received
+func receiveEnvelopeRange(ranger relay.Ranger, obj *relay.Object, d *config.Download, opts *receiveOptions) (string, string) {
+
+	md := obj.Metadata
+
+	key := getEnvelopeKey(md, nil, opts)
+
+	hr := &hashReader{md: md, hash: sha256.New(), states: make(map[int64][]byte)}
+
+	var e *crypto.Envelope
+	var contents io.Reader
+	var err error
+	if d == nil {
+		hr.reader = openRange(ranger, obj, 0)
+		hr.checkpoint = DOWNLOAD_CHECKPOINT
+
+		e, contents, err = crypto.OpenEnvelope(key, hr)
+		if err != nil {
+			helper.OutputAndExit(fmt.Sprintf("Unable to decrypt file: %v", err))
+		}
+
+		e.FileName = localFileName(e.FileName)
+
+		checkLocalFile(e.FileName)
+
+		d = &config.Download{
+			Name:       obj.Name,
+			FileName:   e.FileName,
+			Size:       e.Size,
+			Mode:       e.Mode,
+			HeaderSize: e.HeaderSize,
+			Salt:       hex.EncodeToString(e.Salt),
+			Started:    time.Now().Format(time.RFC3339),
+		}
+	} else {
+		e = &crypto.Envelope{FileName: d.FileName, Size: d.Size, Mode: d.Mode, HeaderSize: d.HeaderSize}
+		e.Salt, err = hex.DecodeString(d.Salt)
+		if err != nil {
+			helper.OutputAndExit(fmt.Sprintf("Invalid download salt: %v", err))
+		}
+
+		state, err := base64.StdEncoding.DecodeString(d.Hash)
+		if err == nil {
+			err = hr.hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+		}
+		if err != nil {
+			helper.OutputAndExit(fmt.Sprintf("Invalid download checksum state: %v", err))
+		}
+
+		checkpoint := d.Offset + d.HeaderSize
+		hr.offset = remoteOffset(md, checkpoint)
+		hr.checkpoint = checkpoint + DOWNLOAD_CHECKPOINT
+		hr.reader = openRange(ranger, obj, hr.offset)
+
+		contents, err = crypto.ResumeEnvelope(key, e, checkpoint, hr)
+		if err != nil {
+			helper.OutputAndExit(fmt.Sprintf("Unable to decrypt file: %v", err))
+		}
+	}
+	defer hr.reader.(io.Closer).Close()
+
+	writePartialFile(d, e.Size, contents, func(offset int64) {
+
+		checkpoint := offset + d.HeaderSize
+		state, ok := hr.states[checkpoint]
+		if ok == false {
+			return
+		}
+		for c := range hr.states {
+			if c <= checkpoint {
+				delete(hr.states, c)
+			}
+		}
+
+		d.Offset = offset
+		d.Hash = base64.StdEncoding.EncodeToString(state)
+		saveDownload(d)
+	})
+
+	setFileMode(e.FileName, e.Mode)
+
+	sum := hex.EncodeToString(hr.hash.Sum(nil))
+	verifyLocalFile(e.FileName, md[relay.KEY_SHA256], sum)
+
+	return e.FileName, sum
+}
+
+// openRange returns a ReadCloser that consumes the relay file from the offset
+func openRange(ranger relay.Ranger, obj *relay.Object, offset int64) io.ReadCloser {
+
+	// Nothing is left to read if the last checkpoint was at the end of the file
+	if offset >= obj.Size {
+		return ioutil.NopCloser(bytes.NewReader(nil))
+	}
+
+	reader, err := ranger.OpenRange(obj, offset)
+	if err != nil {
+		helper.OutputAndExit(err.Error())
+	}
+
+	return reader
+}
+
+// writePartialFile writes the file contents to the partial file from the offset of the
+// download, saving the download state at each checkpoint, and renames the partial file
+// once complete. The SHA-256 of the whole file contents is returned, the partial file
+// is kept if the download is interrupted, unless the file fails authentication
+func writePartialFile(d *config.Download, fileSize int64, r io.Reader, checkpoint func(int64)) string {
+
+	fmt.Println("")
+
+	start := d.Offset
+	partialName := d.FileName + PARTIAL_EXT
+
+	f, err := os.OpenFile(partialName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error creating file: %v", err))
+	}
+
+	// Any contents written after the last checkpoint are written again
+	err = f.Truncate(d.Offset)
+	if err != nil {
+		f.Close()
+		helper.OutputAndExit(fmt.Sprintf("Error truncating file: %v", err))
+	}
+
+	fileHash := sha256.New()
+	_, err = io.Copy(fileHash, f)
+	if err != nil {
+		f.Close()
+		helper.OutputAndExit(fmt.Sprintf("Error reading file: %v", err))
+	}
+
+	if d.Offset > 0 {
+		fmt.Printf("Resuming %s file: %s from %s\n", byteCountIEC(fileSize), d.FileName, byteCountIEC(d.Offset))
+	}
+
+	progressBar := getProgressBar(fileSize)
+	progressBar.Set64(d.Offset)
+
+	// Checkpoints are at multiples of the checkpoint interval of the decrypted
+	// stream, which includes the envelope that precedes the file contents
+	next := (d.Offset+d.HeaderSize)/DOWNLOAD_CHECKPOINT*DOWNLOAD_CHECKPOINT + DOWNLOAD_CHECKPOINT - d.HeaderSize
+	cw := &checkpointWriter{writer: f, offset: d.Offset, next: next, checkpoint: func(offset int64) {
+
+		err := f.Sync()
+		if err != nil {
+			fmt.Printf("Failed to sync file: %v\n", err)
+			return
+		}
+		checkpoint(offset)
+	}}
+	mW := io.MultiWriter(cw, progressBar, fileHash)
+
+	cr := &CountingReader{R: r}
+	_, err = io.Copy(mW, cr)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		fmt.Println("")
+		if err == crypto.ErrStreamAuthentication || d.Offset == 0 {
+			removeLocalFile(partialName)
+			removeDownload(d)
+			helper.OutputAndExit(fmt.Sprintf("Error copying file contents: %v", err))
+		}
+		helper.OutputAndExit(fmt.Sprintf("Download interrupted after %s: %v\nTo continue the download run the same receive command again", byteCountIEC(d.Offset), err))
+	}
+
+	progressBar.Finish()
+
+	err = os.Rename(partialName, d.FileName)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error renaming file: %v", err))
+	}
+	removeDownload(d)
+
+	fmt.Printf("Received %s file: %s\n", d.FileName, byteCountIEC(start+cr.bytesRead))
+
+	return hex.EncodeToString(fileHash.Sum(nil))
+}
+
+// setFileMode sets the permissions of the received file to those of the file sent
+func setFileMode(fileName string, mode uint32) {
+
+	if mode == 0 {
+		return
+	}
+
+	err := os.Chmod(fileName, os.FileMode(mode).Perm())
+	if err != nil {
+		fmt.Printf("Failed to set file mode: %v\n", err)
+	}
+}
+
+// saveDownload saves the resumable download state
+func saveDownload(d *config.Download) {
+
+	downloads := new(config.Downloads)
+	downloads.Load()
+	downloads.Set(*d)
+	downloads.Save()
+}
+
+// removeDownload removes the resumable download state once the download has completed
+func removeDownload(d *config.Download) {
+
+	downloads := new(config.Downloads)
+	downloads.Load()
+	if downloads.Find(d.Name) == nil {
+		return
+	}
+	downloads.Remove(d.Name)
+	downloads.Save()
+}
+
+// ##### Methods #############################################################
+
+// Write writes the bytes, calling checkpoint each time the offset passes a checkpoint
+func (c *checkpointWriter) Write(p []byte) (int, error) {
+
+	written := 0
+	for len(p) > 0 {
+		if c.pending == true {
+			c.checkpoint(c.offset)
+			c.pending = false
+		}
+
+		n := len(p)
+		if int64(n) > c.next-c.offset {
+			n = int(c.next - c.offset)
+		}
+
+		m, err := c.writer.Write(p[:n])
+		written += m
+		c.offset += int64(m)
+		if err != nil {
+			return written, err
+		}
+
+		if c.offset == c.next {
+			c.pending = true
+			c.next += DOWNLOAD_CHECKPOINT
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Read reads from the relay file, stopping at the relay offset of the next checkpoint
+// so that the state of the hash is kept at the exact offset
+func (h *hashReader) Read(p []byte) (int, error) {
+
+	next := remoteOffset(h.md, h.checkpoint)
+	if int64(len(p)) > next-h.offset {
+		p = p[:next-h.offset]
+	}
+
+	n, err := h.reader.Read(p)
+	h.hash.Write(p[:n])
+	h.offset += int64(n)
+
+	if h.offset == next {
+		state, merr := h.hash.(encoding.BinaryMarshaler).MarshalBinary()
+		if merr != nil {
+			return n, merr
+		}
+		h.states[h.checkpoint] = state
+		h.checkpoint += DOWNLOAD_CHECKPOINT
+	}
+
+	return n, err
+}
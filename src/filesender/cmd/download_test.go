@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	config "filesender/config"
+	crypto "filesender/crypto"
+	relay "filesender/relay"
+)
+
+// ##### Functions ###########################################################
+
+// envelopeHeaderSize returns the size of the envelope of data.bin as sent by the tests
+func envelopeHeaderSize(t *testing.T, size int64) int64 {
+
+	t.Helper()
+
+	header, err := json.Marshal(&crypto.Envelope{FileName: "data.bin", Size: size, Mode: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return 4 + int64(len(header))
+}
+
+// TestCheckpointWriter checks that the checkpoints are at the exact offsets, and that
+// there is no checkpoint at the end of a file which is a multiple of the interval
+func TestCheckpointWriter(t *testing.T) {
+
+	checkpoints := make([]int64, 0)
+	buf := new(bytes.Buffer)
+	cw := &checkpointWriter{writer: buf, next: DOWNLOAD_CHECKPOINT, checkpoint: func(offset int64) {
+
+		if int64(buf.Len()) != offset {
+			t.Fatalf("Checkpoint at %d after %d bytes were written", offset, buf.Len())
+		}
+		checkpoints = append(checkpoints, offset)
+	}}
+
+	data := make([]byte, 3*DOWNLOAD_CHECKPOINT)
+	for len(data) > 0 {
+		n := 100000
+		if n > len(data) {
+			n = len(data)
+		}
+		cw.Write(data[:n])
+		data = data[n:]
+	}
+
+	if len(checkpoints) != 2 || checkpoints[0] != DOWNLOAD_CHECKPOINT || checkpoints[1] != 2*DOWNLOAD_CHECKPOINT {
+		t.Fatalf("Unexpected checkpoints %v", checkpoints)
+	}
+}
+
+// TestReceiveResumeEnvelope continues an interrupted download of an envelope format file
+// from the last checkpoint, where the decrypted stream ends at the following checkpoint
+func TestReceiveResumeEnvelope(t *testing.T) {
+
+	// The size of the file plus the envelope is a multiple of the checkpoint interval
+	size := 2 * DOWNLOAD_CHECKPOINT
+	for i := 0; i < 3; i++ {
+		size = 2*DOWNLOAD_CHECKPOINT - envelopeHeaderSize(t, size)
+	}
+	headerSize := envelopeHeaderSize(t, size)
+
+	sender, receiver, data := newTransfer(t, int(size))
+	defer os.RemoveAll(filepath.Dir(sender))
+
+	generateCrypto(t, sender, receiver, "pw")
+	code := sendCode(t, runCommand(t, sender, "pw\n", "send", "data.bin", "-e"))
+
+	objs, err := memoryRelay.Find(code)
+	if err != nil || len(objs) != 1 {
+		t.Fatalf("Expected the uploaded file: %v", err)
+	}
+	obj := objs[0]
+
+	reader, err := memoryRelay.Open(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The state saved at the first checkpoint, before the download was interrupted
+	offset := DOWNLOAD_CHECKPOINT - headerSize
+	h := sha256.New()
+	h.Write(uploaded[:remoteOffset(obj.Metadata, DOWNLOAD_CHECKPOINT)])
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(receiver, "data.bin"+PARTIAL_EXT), data[:offset], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saveDownload(&config.Download{
+		Name:       obj.Name,
+		FileName:   "data.bin",
+		Offset:     offset,
+		Size:       size,
+		Mode:       0600,
+		HeaderSize: headerSize,
+		Salt:       hex.EncodeToString(uploaded[:crypto.STREAM_SALT_SIZE]),
+		Hash:       base64.StdEncoding.EncodeToString(state),
+		Started:    time.Now().Format(time.RFC3339),
+	})
+	os.Chdir(cwd)
+
+	out := runCommand(t, receiver, "pw\n", "receive", code)
+	if strings.Contains(out, "Resuming") == false || strings.Contains(out, "Verified SHA-256 checksum: "+obj.Metadata[relay.KEY_SHA256]) == false {
+		t.Fatalf("Download was not resumed and verified:\n%s", out)
+	}
+
+	checkReceived(t, receiver, data)
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	relay "filesender/relay"
+
+	"github.com/spf13/cobra"
+)
+
+// ##### Variables ###########################################################
+
+var cmdFileKey = &cobra.Command{
+	Use:   "file-key [mnemonicode]",
+	Short: "Outputs the data key of an encrypted file",
+	Long:  `Outputs the data key of an encrypted file on the relay, which allows someone to decrypt that one file without the crypto data or revealing the encryption key`,
+	Run:   fileKey,
+	Args: func(cmd *cobra.Command, args []string) error {
+
+		if len(args) != 1 {
+			return errors.New("Requires the mnemonicode")
+		}
+
+		return nil
+	},
+}
+
+// ##### Functions ###########################################################
+
+// Add the command to the cobra setup
+func init() {
+
+	cmdRoot.AddCommand(cmdFileKey)
+}
+
+// fileKey performs the output of the data key
+func fileKey(cmd *cobra.Command, args []string) {
+
+	r := getRelay(cmd)
+
+	objs, _ := findFiles(r, splitCode(args[0]))
+	if len(objs) == 0 {
+		fmt.Printf("Unable to locate file\n")
+		return
+	}
+
+	for _, obj := range objs {
+		if len(obj.Metadata[relay.KEY_WRAPPED_KEY]) == 0 && len(obj.Metadata[relay.KEY_PASSPHRASE_KEY]) == 0 {
+			fmt.Printf("File %s does not have a data key\n", obj.Name)
+			continue
+		}
+
+		dataKey := getEnvelopeKey(obj.Metadata, nil, &receiveOptions{})
+
+		fmt.Printf("\nData key: %s\n", hex.EncodeToString(dataKey))
+		fmt.Printf("On the other computer run: filesender r --file-key %s, and enter the data key\n", args[0])
+	}
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	config "filesender/config"
+)
+
+// ##### Functions ###########################################################
+
+// TestReceiveFileKey checks that a file can be received using the data key output by the
+// file-key command, which is entered at the prompt rather than on the command line
+func TestReceiveFileKey(t *testing.T) {
+
+	sender, receiver, data := newTransfer(t, 64*1024)
+	defer os.RemoveAll(filepath.Dir(sender))
+
+	generateCrypto(t, sender, receiver, "pw")
+
+	// The receiver only has the data key
+	os.Remove(filepath.Join(receiver, config.CRYPTO_FILE))
+
+	code := sendCode(t, runCommand(t, sender, "pw\n", "send", "data.bin", "-e"))
+
+	out := runCommand(t, sender, "pw\n", "file-key", code)
+	m := regexp.MustCompile(`Data key: ([0-9a-f]+)`).FindStringSubmatch(out)
+	if m == nil || strings.Contains(out, "--file-key "+m[1]) == true {
+		t.Fatalf("Unexpected file-key output:\n%s", out)
+	}
+
+	runCommand(t, receiver, m[1]+"\n", "receive", code, "--file-key")
+	checkReceived(t, receiver, data)
+}
@@ -1,18 +1,15 @@
 package cmd
 
 import (
-	"bytes"
 	"crypto/rand"
-	"crypto/sha256"
-	"encoding/hex"
 	helper "filesender/utils"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"time"
 
 	"github.com/howeyc/gopass"
 	"github.com/spf13/cobra"
-	"golang.org/x/crypto/pbkdf2"
+	util "github.com/woanware/goutil"
 
 	config "filesender/config"
 	crypto "filesender/crypto"
@@ -33,47 +30,66 @@ var cmdGenerate = &cobra.Command{
 // Add the command to the cobra setup
 func init() {
 
+	cmdGenerate.Flags().StringP("kdf", "k", crypto.DEFAULT_KDF, "Key derivation function used to protect the key: argon2id, scrypt or pbkdf2")
+	cmdGenerate.Flags().DurationP("time", "t", crypto.DEFAULT_KDF_TIME, "Target time to unlock the key, used to calibrate the key derivation cost")
+	cmdGenerate.Flags().StringP("name", "n", config.DEFAULT_SLOT_NAME, "Name of the key slot for the password e.g. the person's name")
 	cmdRoot.AddCommand(cmdGenerate)
 }
 
 // generate performs the generation of the crypto data
 func generate(cmd *cobra.Command, args []string) {
 
-	generateKey()
-}
+	algorithm, err := cmd.Flags().GetString("kdf")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
 
-// generateKey creates a new encryption key and encrypts it using the user-provided password
-func generateKey() {
+	target, err := cmd.Flags().GetDuration("time")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
 
-	password := getPassword()
+	name, err := cmd.Flags().GetString("name")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
 
-	// Derive a 64-byte hash from the passphrase using PBKDF2 with 65536 rounds of SHA256.
-	salt := getRandomBytes(32)
-	hash := pbkdf2.Key([]byte(password), salt, 65536, 64, sha256.New)
-	if len(hash) != 64 {
-		helper.OutputAndExit(fmt.Sprintf("Incorrect key size returned by pbkdf2: %d", len(hash)))
+	// Overwriting the crypto data makes any encrypted files not yet received undecryptable
+	if util.DoesFileExist(config.CRYPTO_FILE) == true {
+		fmt.Printf("Crypto data already exists, encrypted files not yet received will be lost. Use passwd or rotate-key instead. Do you want to overwrite?:")
+		ret, err := util.GetYesNoPrompt(false)
+		if err != nil {
+			helper.OutputAndExit(fmt.Sprintf("Unable to read user input: %v", err))
+		}
+
+		if ret == false {
+			helper.OutputAndExit("Generate cancelled")
+		}
 	}
 
-	// We'll store the first 32 bytes of the hash to use to confirm the
-	// correct passphrase is given on subsequent runs.
-	passHash := hash[:32]
-	// And we'll use the remaining 32 bytes as a key to encrypt the actual
-	// encryption key. (These bytes are *not* stored).
-	keyEncryptKey := hash[32:]
+	generateKey(name, algorithm, target)
+}
+
+// generateKey creates a new encryption key and encrypts it using the user-provided password
+func generateKey(name string, algorithm string, target time.Duration) {
+
+	// Determine the KDF cost parameters for this computer
+	kdf := calibrateKDF(algorithm, target)
+
+	password := getPassword()
 
 	// Generate a random encryption key and encrypt it using the key
 	// derived from the passphrase.
 	key := getRandomBytes(32)
-	iv := getRandomBytes(16)
-	encryptedKey := encryptBytes(keyEncryptKey, iv, key)
 
 	// Write the crypto config
 	c := new(config.Config)
 	c.Initialise()
-	c.Salt = hex.EncodeToString(salt)
-	c.PasswordHash = hex.EncodeToString(passHash)
-	c.EncryptedKey = hex.EncodeToString(encryptedKey)
-	c.EncryptedKeyIv = hex.EncodeToString(iv)
+	slot, err := crypto.SealSlot(name, password, key, kdf)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Unable to encrypt key: %v", err))
+	}
+	c.SetSlots([]config.Slot{slot})
 	c.Save()
 
 	fmt.Printf("Crypto data generated and written to the configuration\n")
@@ -103,16 +119,6 @@ func getPassword() string {
 	return string(password1)
 }
 
-// Encrypt the given plaintext using the given encryption key 'key' and
-// initialization vector 'iv'. The initialization vector should be 16 bytes
-// (the AES block-size), and should be randomly generated and unique for
-// each file that's encrypted.
-func encryptBytes(key []byte, iv []byte, plaintext []byte) []byte {
-
-	r, _ := ioutil.ReadAll(crypto.MakeEncrypterReader(key, iv, bytes.NewReader(plaintext)))
-	return r
-}
-
 // Return the given number of bytes of random values, using a
 // cryptographically-strong random number source.
 func getRandomBytes(n int) []byte {
@@ -1,10 +1,22 @@
 package cmd
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 
+	config "filesender/config"
+	drive "filesender/drive"
+	local "filesender/local"
+	relay "filesender/relay"
+	s3 "filesender/s3"
+	sftp "filesender/sftp"
+	helper "filesender/utils"
+	webdav "filesender/webdav"
+
+	"github.com/spf13/cobra"
 	pb "gopkg.in/cheggaaa/pb.v1"
 )
 
@@ -24,8 +36,83 @@ func (cr *CountingReader) Read(dst []byte) (int, error) {
 	return read, err
 }
 
+// ##### Variables #########################################################
+
+// relayFactory, when set, returns the relay used instead of the configured backend,
+// so that the tests can run the commands against the memory backend
+var relayFactory func() relay.Relay
+
 // ##### Methods ###########################################################
 
+// getRelay returns the relay backend selected via the command line
+// flag, or if not supplied, the settings file
+func getRelay(cmd *cobra.Command) relay.Relay {
+
+	if relayFactory != nil {
+		return relayFactory()
+	}
+
+	s := new(config.Settings)
+	s.Load()
+
+	backend, err := cmd.Flags().GetString("backend")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+	if len(backend) == 0 {
+		backend = s.Backend
+	}
+
+	switch backend {
+	case "gdrive":
+		return drive.New()
+	case "s3":
+		return s3.New(s.S3)
+	case "webdav":
+		return webdav.New(s.WebDAV)
+	case "sftp":
+		return sftp.New(s.SFTP)
+	case "local":
+		return local.New(s.Local)
+	}
+
+	helper.OutputAndExit(fmt.Sprintf("Unknown relay backend: %s", backend))
+	return nil
+}
+
+// putRecord uploads a small record e.g. rendezvous or PAKE message, tagged with
+// the mnemonicode and kind
+func putRecord(r relay.Relay, mnemonicode string, kind string, data []byte) *relay.Object {
+
+	md := make(map[string]string, 0)
+	md[relay.KEY_CODE] = mnemonicode
+	md[relay.KEY_KIND] = kind
+
+	obj, err := r.Put(generateGUID().String(), md, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to upload %s record: %v", kind, err))
+	}
+
+	return obj
+}
+
+// readRecord downloads the contents of a small record
+func readRecord(r relay.Relay, obj *relay.Object) []byte {
+
+	reader, err := r.Open(obj)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to download %s record: %v", obj.Kind(), err))
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to download %s record: %v", obj.Kind(), err))
+	}
+
+	return data
+}
+
 // getProgressBar creates and initialises a progress bar
 func getProgressBar(nBytes int64) *pb.ProgressBar {
 
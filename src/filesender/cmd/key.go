@@ -0,0 +1,336 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	config "filesender/config"
+	crypto "filesender/crypto"
+	relay "filesender/relay"
+	helper "filesender/utils"
+
+	qrcode "github.com/skip2/go-qrcode"
+	"github.com/spf13/cobra"
+	util "github.com/woanware/goutil"
+)
+
+// ##### Constants ###########################################################
+
+// BACKUP_LINE_LENGTH is the number of characters per line of the printed backup
+const BACKUP_LINE_LENGTH int = 64
+
+// QR_CODE_SIZE is the width and height in pixels of the backup QR code image
+const QR_CODE_SIZE int = 512
+
+// QR_CODE_LENGTH is the maximum number of characters of the backup in each QR code,
+// longer backups are split across several QR codes, as the capacity of a QR code is
+// limited and large QR codes are hard to scan
+const QR_CODE_LENGTH int = 1024
+
+// ##### Structs #############################################################
+
+// keyExportRecord is the body of the record holding the exported crypto data
+type keyExportRecord struct {
+	Confirmation []byte `json:"confirmation"`
+	Data         []byte `json:"data"`
+}
+
+// ##### Variables ###########################################################
+
+var cmdKey = &cobra.Command{
+	Use:   "key",
+	Short: "Transfers or backs up the crypto data",
+	Long:  `Transfers the crypto data to another computer via the relay, or backs up the crypto data on paper. The keys in the crypto data remain wrapped by the passwords, so the same password is required on the other computer or to restore the backup`,
+}
+
+var cmdKeyExport = &cobra.Command{
+	Use:   "export",
+	Short: "Sends the crypto data to another computer",
+	Long:  `Sends the crypto data to another computer via the relay, encrypted using a key exchanged with the other computer via a one-time code`,
+	Run:   keyExport,
+}
+
+var cmdKeyImport = &cobra.Command{
+	Use:   "import [code]",
+	Short: "Receives the crypto data from another computer",
+	Long:  `Receives the crypto data sent by key export on another computer, using the one-time code it output`,
+	Run:   keyImport,
+	Args: func(cmd *cobra.Command, args []string) error {
+
+		if len(args) != 1 {
+			return errors.New("Requires the code")
+		}
+
+		return nil
+	},
+}
+
+var cmdKeyBackup = &cobra.Command{
+	Use:   "backup",
+	Short: "Outputs a printable backup of the crypto data",
+	Long:  `Outputs the crypto data as text and a QR code that can be printed and stored safely, so that the crypto data can be restored if the config is lost`,
+	Run:   keyBackup,
+}
+
+var cmdKeyRestore = &cobra.Command{
+	Use:   "restore [backup file]",
+	Short: "Restores the crypto data from a backup",
+	Long:  `Restores the crypto data from the backup text output by key backup e.g. typed in or scanned from the QR code, read from the file or otherwise from stdin`,
+	Run:   keyRestore,
+	Args: func(cmd *cobra.Command, args []string) error {
+
+		if len(args) > 1 {
+			return errors.New("Requires at most the backup file")
+		}
+
+		return nil
+	},
+}
+
+// ##### Functions ###########################################################
+
+// Add the command to the cobra setup
+func init() {
+
+	cmdKeyBackup.Flags().StringP("output", "o", "", "Also write the QR code to the PNG image file e.g. for printing")
+
+	cmdKey.AddCommand(cmdKeyExport)
+	cmdKey.AddCommand(cmdKeyImport)
+	cmdKey.AddCommand(cmdKeyBackup)
+	cmdKey.AddCommand(cmdKeyRestore)
+	cmdRoot.AddCommand(cmdKey)
+}
+
+// keyExport performs the sending of the crypto data to another computer
+func keyExport(cmd *cobra.Command, args []string) {
+
+	data := readCryptoFile()
+
+	// As with PAKE transfers, only the first part of the code is stored on the relay
+	code := generateMnemonic() + "-" + generateMnemonic()
+
+	r := getRelay(cmd)
+	p := sendPake(r, code, "filesender key import")
+
+	sealed, err := crypto.SealExport(p.SessionKey(), data)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to encrypt crypto data: %v", err))
+	}
+
+	record, err := json.Marshal(keyExportRecord{Confirmation: p.Confirmation(), Data: sealed})
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to create key export record: %v", err))
+	}
+
+	putRecord(r, splitCode(code), relay.KIND_KEY_EXPORT, record)
+
+	fmt.Printf("\nSent crypto data, use the same password on the other computer\n")
+}
+
+// keyImport performs the receiving of the crypto data from another computer
+func keyImport(cmd *cobra.Command, args []string) {
+
+	code := args[0]
+	lookup := splitCode(code)
+
+	r := getRelay(cmd)
+
+	_, records := findFiles(r, lookup)
+	if records[relay.KIND_PAKE_SENDER] == nil {
+		helper.OutputAndExit("Unable to locate key export")
+	}
+
+	checkCryptoFile("Import cancelled")
+
+	p := receivePake(r, code, records[relay.KIND_PAKE_SENDER])
+
+	fmt.Printf("Waiting for the other computer to send the crypto data\n")
+
+	// Nothing is sent if the other computer detects a wrong code, it publishes an abort record instead
+	var obj *relay.Object
+	deadline := time.Now().Add(DISCOVERY_TIMEOUT)
+	for obj == nil {
+		_, records = findFiles(r, lookup)
+		checkPakeAbort(r, records)
+		obj = records[relay.KIND_KEY_EXPORT]
+		if obj == nil {
+			if time.Now().After(deadline) == true {
+				helper.OutputAndExit("Timed out waiting for the crypto data, check the code")
+			}
+			time.Sleep(POLL_INTERVAL)
+		}
+	}
+
+	ker := &keyExportRecord{}
+	err := json.Unmarshal(readRecord(r, obj), ker)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Invalid key export record: %v", err))
+	}
+
+	derr := r.Delete(obj)
+	if derr != nil {
+		fmt.Printf("Failed to delete key export record: %v\n", derr)
+	}
+
+	err = p.Verify(ker.Confirmation)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Key exchange failed: %v", err))
+	}
+
+	data, err := crypto.OpenExport(p.SessionKey(), ker.Data)
+	if err != nil {
+		helper.OutputAndExit(err.Error())
+	}
+
+	writeCryptoFile(data)
+
+	fmt.Printf("Imported crypto data, use the same password as on the other computer\n")
+}
+
+// keyBackup performs the output of the crypto data backup
+func keyBackup(cmd *cobra.Command, args []string) {
+
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	text := crypto.EncodeBackup(readCryptoFile())
+
+	fmt.Printf("Crypto data backup, the password is also required to restore it:\n\n")
+	for _, line := range splitText(text, BACKUP_LINE_LENGTH) {
+		fmt.Printf("%s\n", line)
+	}
+	fmt.Printf("\nOn the restoring computer run: filesender key restore [backup file]\n\n")
+
+	parts := splitText(text, QR_CODE_LENGTH)
+	if len(parts) > 1 {
+		fmt.Printf("The backup is split across %d QR codes, scan them in order into the backup file, one per line\n\n", len(parts))
+	}
+
+	for i, part := range parts {
+		q, err := qrcode.New(part, qrcode.Medium)
+		if err != nil {
+			helper.OutputAndExit(fmt.Sprintf("Unable to create QR code: %v", err))
+		}
+
+		if len(parts) > 1 {
+			fmt.Printf("QR code %d of %d:\n", i+1, len(parts))
+		}
+		fmt.Printf("%s\n", q.ToSmallString(false))
+
+		if len(output) > 0 {
+			path := qrCodeFile(output, i, len(parts))
+			err = q.WriteFile(QR_CODE_SIZE, path)
+			if err != nil {
+				helper.OutputAndExit(fmt.Sprintf("Unable to write QR code: %v", err))
+			}
+
+			fmt.Printf("QR code written to %s\n", path)
+		}
+	}
+}
+
+// splitText splits the text into parts of at most length characters
+func splitText(text string, length int) []string {
+
+	parts := make([]string, 0, len(text)/length+1)
+	for i := 0; i < len(text); i += length {
+		end := i + length
+		if end > len(text) {
+			end = len(text)
+		}
+		parts = append(parts, text[i:end])
+	}
+
+	return parts
+}
+
+// qrCodeFile returns the image file for the QR code, which is numbered
+// before the extension if the backup is split across several QR codes
+func qrCodeFile(output string, index int, count int) string {
+
+	if count == 1 {
+		return output
+	}
+
+	ext := filepath.Ext(output)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(output, ext), index+1, ext)
+}
+
+// keyRestore performs the restoring of the crypto data from the backup
+func keyRestore(cmd *cobra.Command, args []string) {
+
+	// Checked first, as the backup text may be read from stdin
+	checkCryptoFile("Restore cancelled")
+
+	var text []byte
+	var err error
+	if len(args) == 1 {
+		text, err = ioutil.ReadFile(args[0])
+	} else {
+		fmt.Printf("Enter the backup text, followed by end of file (Ctrl-D):\n")
+		text, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading backup: %v", err))
+	}
+
+	data, err := crypto.DecodeBackup(string(text))
+	if err != nil {
+		helper.OutputAndExit(err.Error())
+	}
+
+	writeCryptoFile(data)
+
+	fmt.Printf("Restored crypto data, use the same password as when the backup was made\n")
+}
+
+// readCryptoFile returns the contents of the crypto config file
+func readCryptoFile() []byte {
+
+	data, err := ioutil.ReadFile(config.CRYPTO_FILE)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading crypto config file: %v", err))
+	}
+
+	return data
+}
+
+// checkCryptoFile prompts the user to check if they want to overwrite the existing crypto data
+func checkCryptoFile(cancelled string) {
+
+	if util.DoesFileExist(config.CRYPTO_FILE) == false {
+		return
+	}
+
+	fmt.Printf("Crypto data already exists, encrypted files not yet received will be lost. Do you want to overwrite?:")
+	ret, err := util.GetYesNoPrompt(false)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Unable to read user input: %v", err))
+	}
+
+	if ret == false {
+		helper.OutputAndExit(cancelled)
+	}
+}
+
+// writeCryptoFile checks and writes the imported or restored crypto data to the crypto config file
+func writeCryptoFile(data []byte) {
+
+	err := config.CheckCryptoData(data)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Invalid crypto data: %v", err))
+	}
+
+	err = ioutil.WriteFile(config.CRYPTO_FILE, data, 0600)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error writing crypto config file: %v", err))
+	}
+}
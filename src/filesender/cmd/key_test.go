@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	crypto "filesender/crypto"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// ##### Functions ###########################################################
+
+// TestBackupQRCodes checks that a backup too large for one QR code is split across
+// several, and that the parts scanned one per line restore the crypto data
+func TestBackupQRCodes(t *testing.T) {
+
+	data := make([]byte, 3000)
+	rand.Read(data)
+	text := crypto.EncodeBackup(data)
+
+	parts := splitText(text, QR_CODE_LENGTH)
+	if len(parts) != 4 {
+		t.Fatalf("Expected 4 QR codes, got %d", len(parts))
+	}
+
+	for _, part := range parts {
+		if len(part) > QR_CODE_LENGTH {
+			t.Fatalf("QR code holds %d characters", len(part))
+		}
+
+		_, err := qrcode.New(part, qrcode.Medium)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restored, err := crypto.DecodeBackup(strings.Join(parts, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(restored, data) == false {
+		t.Fatalf("Restored crypto data does not match")
+	}
+
+	if qrCodeFile("backup.png", 0, 1) != "backup.png" || qrCodeFile("backup.png", 1, 4) != "backup-2.png" {
+		t.Fatalf("Unexpected QR code file names")
+	}
+}
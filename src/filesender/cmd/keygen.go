@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"fmt"
+
+	crypto "filesender/crypto"
+	helper "filesender/utils"
+
+	"github.com/spf13/cobra"
+	util "github.com/woanware/goutil"
+)
+
+// ##### Variables ###########################################################
+
+var cmdKeygen = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generates an identity keypair or signing key",
+	Long:  `Generates an X25519 identity keypair, the public key is given to senders so they can encrypt files to you without sharing a password. Alternatively generates an Ed25519 signing key, which is used to sign the files you send`,
+	Run:   keygen,
+}
+
+// ##### Functions ###########################################################
+
+// Add the command to the cobra setup
+func init() {
+
+	cmdKeygen.Flags().BoolP("signing", "s", false, "Generate the Ed25519 signing key used to sign the files sent")
+	cmdRoot.AddCommand(cmdKeygen)
+}
+
+// keygen performs the generation of the identity keypair
+func keygen(cmd *cobra.Command, args []string) {
+
+	signing, err := cmd.Flags().GetBool("signing")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	if signing == true {
+		generateSigningKey()
+		return
+	}
+
+	// Overwriting the identity makes any files encrypted to it not yet received undecryptable
+	if util.DoesFileExist(crypto.IDENTITY_FILE) == true {
+		fmt.Printf("Identity already exists, files encrypted to it not yet received will be lost. Do you want to overwrite?:")
+		ret, err := util.GetYesNoPrompt(false)
+		if err != nil {
+			helper.OutputAndExit(fmt.Sprintf("Unable to read user input: %v", err))
+		}
+
+		if ret == false {
+			helper.OutputAndExit("Keygen cancelled")
+		}
+	}
+
+	identity, err := crypto.GenerateIdentity(crypto.IDENTITY_FILE)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Unable to generate identity: %v", err))
+	}
+
+	fmt.Printf("Identity written to %s\n", crypto.IDENTITY_FILE)
+	fmt.Printf("Public key: %s\n", identity.Recipient())
+	fmt.Printf("On the sending computer run: filesender recipient add [name] %s\n", identity.Recipient())
+}
+
+// generateSigningKey generates the sender's signing key
+func generateSigningKey() {
+
+	// Receivers that trust the existing key will be asked to trust the new key
+	if util.DoesFileExist(crypto.SIGNING_KEY_FILE) == true {
+		fmt.Printf("Signing key already exists, receivers will need to trust the new key. Do you want to overwrite?:")
+		ret, err := util.GetYesNoPrompt(false)
+		if err != nil {
+			helper.OutputAndExit(fmt.Sprintf("Unable to read user input: %v", err))
+		}
+
+		if ret == false {
+			helper.OutputAndExit("Keygen cancelled")
+		}
+	}
+
+	privateKey, err := crypto.GenerateSigningKey(crypto.SIGNING_KEY_FILE)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Unable to generate signing key: %v", err))
+	}
+
+	fmt.Printf("Signing key written to %s, files sent will now be signed\n", crypto.SIGNING_KEY_FILE)
+	fmt.Printf("Fingerprint: %s\n", crypto.Fingerprint(privateKey.Public().(ed25519.PublicKey)))
+}
@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	config "filesender/config"
+	crypto "filesender/crypto"
+	relay "filesender/relay"
+	helper "filesender/utils"
+
+	util "github.com/woanware/goutil"
+)
+
+// ##### Functions ###########################################################
+
+// signUpload stores a manifest of the upload signed using the sender's signing key
+// alongside the upload, if the sender has a signing key. The manifest holds the same
+// file name, size and checksum as the upload meta data, so it reveals no more about
+// the file than the upload itself. Returns nil if not signed
+func signUpload(r relay.Relay, mnemonicode string, obj *relay.Object, sum string) *relay.Object {
+
+	data := signManifest(obj.Name, mnemonicode, obj.Metadata[relay.KEY_FILE_NAME], obj.Size, sum)
+	if data == nil {
+		return nil
+	}
+
+	return putRecord(r, mnemonicode, relay.KIND_MANIFEST, data)
+}
+
+// signManifest returns the manifest of the transfer signed using the sender's
+// signing key, or nil if the sender does not have a signing key
+func signManifest(transferID string, mnemonicode string, fileName string, size int64, sum string) []byte {
+
+	if util.DoesFileExist(crypto.SIGNING_KEY_FILE) == false {
+		return nil
+	}
+
+	privateKey, err := crypto.LoadSigningKey(crypto.SIGNING_KEY_FILE)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading signing key: %v", err))
+	}
+
+	data, err := crypto.SignManifest(privateKey, &crypto.Manifest{
+		TransferID: transferID,
+		Code:       mnemonicode,
+		FileName:   fileName,
+		Size:       size,
+		SHA256:     sum,
+		Created:    time.Now().UTC(),
+	})
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to sign manifest: %v", err))
+	}
+
+	fmt.Printf("Signed by: %s\n", crypto.Fingerprint(privateKey.Public().(ed25519.PublicKey)))
+	return data
+}
+
+// checkManifest verifies the signed manifest stored alongside the upload before the
+// file is downloaded. Returns nil if the file is not signed and signatures are not
+// required. Streamed uploads are checked once received, the received file is removed
+// if the sender is not verified
+func checkManifest(r relay.Relay, obj *relay.Object, record *relay.Object, requireSigned bool, senders *config.KnownSenders, fileName string) *crypto.Manifest {
+
+	var data []byte
+	if record != nil {
+		data = readRecord(r, record)
+	}
+
+	expected := &crypto.Manifest{
+		TransferID: obj.Name,
+		Code:       obj.Code(),
+		FileName:   obj.Metadata[relay.KEY_FILE_NAME],
+		Size:       obj.Size,
+	}
+
+	return checkSignedManifest(data, expected, requireSigned, senders, fileName)
+}
+
+// checkSignedManifest verifies the signed manifest against the expected transfer. The
+// sender must be in the known senders, or be trusted by the user when first seen, and
+// the transfer must not have been received before. The transfer ID of a direct transfer
+// is chosen by the sender, so it is only checked if expected. Returns nil if the file
+// is not signed and signatures are not required
+func checkSignedManifest(data []byte, expected *crypto.Manifest, requireSigned bool, senders *config.KnownSenders, fileName string) *crypto.Manifest {
+
+	if len(data) == 0 {
+		if requireSigned == true {
+			rejectFile(fileName, "File is not signed by the sender, receive cancelled")
+		}
+
+		fmt.Printf("Warning: file is not signed, the sender cannot be verified\n")
+		return nil
+	}
+
+	m, publicKey, err := crypto.VerifyManifest(data)
+	if err != nil {
+		rejectFile(fileName, fmt.Sprintf("%v, receive cancelled", err))
+	}
+
+	// The manifest must be for this transfer, rather than copied from another transfer
+	if (len(expected.TransferID) > 0 && m.TransferID != expected.TransferID) || m.Code != expected.Code || m.FileName != expected.FileName || m.Size != expected.Size {
+		rejectFile(fileName, "Manifest does not match the uploaded file, receive cancelled")
+	}
+
+	if senders.IsReceived(m.TransferID) == true {
+		rejectFile(fileName, fmt.Sprintf("Transfer %s has already been received, the file may have been replayed, receive cancelled", m.TransferID))
+	}
+
+	fingerprint := crypto.Fingerprint(publicKey)
+	encoded := base64.StdEncoding.EncodeToString(publicKey)
+	if senders.IsTrusted(encoded) == false {
+		fmt.Printf("File is signed by an unknown sender: %s\n", fingerprint)
+		fmt.Printf("Check the fingerprint with the sender. Do you want to trust this sender?:")
+		ret, err := util.GetYesNoPrompt(false)
+		if err != nil {
+			rejectFile(fileName, fmt.Sprintf("Unable to read user input: %v", err))
+		}
+
+		if ret == false {
+			rejectFile(fileName, "Sender not trusted, receive cancelled")
+		}
+
+		senders.Senders = append(senders.Senders, config.KnownSender{
+			Fingerprint: fingerprint,
+			PublicKey:   encoded,
+			Added:       time.Now().Format(time.RFC3339),
+		})
+	}
+
+	fmt.Printf("Verified signature from sender: %s\n", fingerprint)
+	return m
+}
+
+// rejectFile removes the received file, if the file has already been received, and exits
+func rejectFile(fileName string, message string) {
+
+	if len(fileName) > 0 {
+		removeLocalFile(fileName)
+	}
+
+	helper.OutputAndExit(message)
+}
+
+// verifyManifest compares the checksum of the received file with the signed manifest, the
+// local file is removed if they do not match. The transfer is then recorded as received
+func verifyManifest(m *crypto.Manifest, fileName string, sum string, senders *config.KnownSenders) {
+
+	if m.SHA256 != sum {
+		removeLocalFile(fileName)
+		helper.OutputAndExit("Received file does not match the signed manifest, the file has been removed")
+	}
+
+	senders.Received = append(senders.Received, m.TransferID)
+	senders.Save()
+}
@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	crypto "filesender/crypto"
+	relay "filesender/relay"
+	helper "filesender/utils"
+)
+
+// ##### Constants ###########################################################
+
+// CODE_WORDS is the number of words in a standard mnemonicode, a PAKE code has
+// additional words which are never stored on the relay
+const CODE_WORDS int = 3
+
+// PAKE_TIMEOUT is the time the sender waits for the receiver to exchange keys
+const PAKE_TIMEOUT time.Duration = 10 * time.Minute
+
+// ##### Structs #############################################################
+
+// pakeRecord is the body of the PAKE records exchanged via the relay
+type pakeRecord struct {
+	Message      []byte `json:"message"`
+	Confirmation []byte `json:"confirmation,omitempty"`
+}
+
+// ##### Functions ###########################################################
+
+// splitCode returns the part of the code that is used to locate the files on
+// the relay. For PAKE codes this is the first words, so that the remainder of
+// the code, which is the secret part of the PAKE password, is never stored on the relay
+func splitCode(mnemonicode string) string {
+
+	words := strings.Split(mnemonicode, "-")
+	if len(words) <= CODE_WORDS {
+		return mnemonicode
+	}
+
+	return strings.Join(words[:CODE_WORDS], "-")
+}
+
+// parsePakeRecord downloads and parses the PAKE record
+func parsePakeRecord(r relay.Relay, obj *relay.Object) *pakeRecord {
+
+	pr := &pakeRecord{}
+	err := json.Unmarshal(readRecord(r, obj), pr)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Invalid PAKE record: %v", err))
+	}
+
+	return pr
+}
+
+// sendPake publishes the sender's PAKE message via the relay, and waits for the receiver
+// to respond using the command. If the receiver used a different code, the exchange is
+// aborted and an abort record is published, so that the receiver stops waiting for the file
+func sendPake(r relay.Relay, mnemonicode string, command string) *crypto.Pake {
+
+	p, err := crypto.NewPake(mnemonicode, crypto.PAKE_SENDER)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to start key exchange: %v", err))
+	}
+
+	data, err := json.Marshal(pakeRecord{Message: p.Message()})
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to create PAKE record: %v", err))
+	}
+
+	lookup := splitCode(mnemonicode)
+	obj := putRecord(r, lookup, relay.KIND_PAKE_SENDER, data)
+
+	fmt.Printf("\nCode is: %s\n", mnemonicode)
+	fmt.Printf("On the other computer run: %s %s\n", command, mnemonicode)
+	fmt.Printf("Waiting for the receiver to exchange keys\n")
+
+	var peer *relay.Object
+	deadline := time.Now().Add(PAKE_TIMEOUT)
+	for peer == nil {
+		_, records := findFiles(r, lookup)
+		peer = records[relay.KIND_PAKE_RECEIVER]
+		if peer == nil {
+			if time.Now().After(deadline) == true {
+				derr := r.Delete(obj)
+				if derr != nil {
+					fmt.Printf("Failed to delete PAKE record: %v\n", derr)
+				}
+				helper.OutputAndExit(fmt.Sprintf("Timed out after %s waiting for the receiver to exchange keys", PAKE_TIMEOUT))
+			}
+			time.Sleep(POLL_INTERVAL)
+		}
+	}
+
+	pr := parsePakeRecord(r, peer)
+
+	// The records are no longer required, whether or not the exchange succeeded
+	for _, o := range []*relay.Object{obj, peer} {
+		derr := r.Delete(o)
+		if derr != nil {
+			fmt.Printf("Failed to delete PAKE record: %v\n", derr)
+		}
+	}
+
+	err = p.Finish(pr.Message)
+	if err == nil {
+		err = p.Verify(pr.Confirmation)
+	}
+	if err != nil {
+		putRecord(r, lookup, relay.KIND_PAKE_ABORT, nil)
+		helper.OutputAndExit(fmt.Sprintf("Key exchange failed: %v", err))
+	}
+
+	return p
+}
+
+// checkPakeAbort exits if the sender has published an abort record, as the
+// sender detected that the receiver used a different code
+func checkPakeAbort(r relay.Relay, records map[string]*relay.Object) {
+
+	obj := records[relay.KIND_PAKE_ABORT]
+	if obj == nil {
+		return
+	}
+
+	derr := r.Delete(obj)
+	if derr != nil {
+		fmt.Printf("Failed to delete PAKE abort record: %v\n", derr)
+	}
+
+	helper.OutputAndExit("Key exchange failed, the sender reports that the wrong code was used")
+}
+
+// receivePake responds to the sender's PAKE record via the relay, including the
+// receiver's key confirmation so that the sender can detect a wrong code
+func receivePake(r relay.Relay, mnemonicode string, obj *relay.Object) *crypto.Pake {
+
+	pr := parsePakeRecord(r, obj)
+
+	p, err := crypto.NewPake(mnemonicode, crypto.PAKE_RECEIVER)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to start key exchange: %v", err))
+	}
+
+	err = p.Finish(pr.Message)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Key exchange failed: %v", err))
+	}
+
+	data, err := json.Marshal(pakeRecord{Message: p.Message(), Confirmation: p.Confirmation()})
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to create PAKE record: %v", err))
+	}
+
+	putRecord(r, splitCode(mnemonicode), relay.KIND_PAKE_RECEIVER, data)
+
+	return p
+}
+
+// getPakeKey verifies the sender's key confirmation stored in the file
+// meta data, and returns the session key used to encrypt the file
+func getPakeKey(p *crypto.Pake, md map[string]string) []byte {
+
+	if p == nil {
+		helper.OutputAndExit("File was encrypted using a key exchange, but no key exchange took place")
+	}
+
+	confirmation, err := hex.DecodeString(md[relay.KEY_PAKE])
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Invalid PAKE meta data: %v", err))
+	}
+
+	err = p.Verify(confirmation)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Key exchange failed: %v", err))
+	}
+
+	return p.SessionKey()
+}
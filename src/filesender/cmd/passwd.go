@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+
+	crypto "filesender/crypto"
+	helper "filesender/utils"
+
+	"github.com/howeyc/gopass"
+	"github.com/spf13/cobra"
+)
+
+// ##### Variables ###########################################################
+
+var cmdPasswd = &cobra.Command{
+	Use:   "passwd",
+	Short: "Changes the crypto data password",
+	Long:  `Changes the password protecting the crypto data, the encryption key is unchanged so existing encrypted files can still be received`,
+	Run:   passwd,
+}
+
+// ##### Functions ###########################################################
+
+// Add the command to the cobra setup
+func init() {
+
+	cmdPasswd.Flags().StringP("kdf", "k", crypto.DEFAULT_KDF, "Key derivation function used to protect the key: argon2id, scrypt or pbkdf2")
+	cmdPasswd.Flags().DurationP("time", "t", crypto.DEFAULT_KDF_TIME, "Target time to unlock the key, used to calibrate the key derivation cost")
+	cmdRoot.AddCommand(cmdPasswd)
+}
+
+// passwd performs the changing of the crypto data password
+func passwd(cmd *cobra.Command, args []string) {
+
+	algorithm, err := cmd.Flags().GetString("kdf")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	target, err := cmd.Flags().GetDuration("time")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	keyring := unlockKeyring()
+
+	kdf := calibrateKDF(algorithm, target)
+
+	fmt.Printf("Enter the new password\n")
+	password := getPassword()
+
+	err = keyring.ChangePassword(password, kdf)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Unable to encrypt key: %v", err))
+	}
+	keyring.Save()
+
+	fmt.Printf("Password changed\n")
+}
+
+// unlockKeyring prompts for the current password and unlocks the crypto data
+func unlockKeyring() *crypto.Keyring {
+
+	fmt.Printf("Enter current password: ")
+	password, err := gopass.GetPasswd()
+	if err != nil {
+		helper.OutputAndExit("Error reading password")
+	}
+	if len(password) == 0 {
+		helper.OutputAndExit("Password not supplied")
+	}
+
+	return crypto.UnlockKeyring(string(password))
+}
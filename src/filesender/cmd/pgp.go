@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	crypto "filesender/crypto"
+	helper "filesender/utils"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/howeyc/gopass"
+)
+
+// ##### Structs #############################################################
+
+// tempFile is an encrypted temporary file, which is removed once it has been sent
+type tempFile struct {
+	*os.File
+}
+
+// ##### Functions ###########################################################
+
+// readKeyRing reads the OpenPGP keyring file
+func readKeyRing(path string) openpgp.EntityList {
+
+	el, err := crypto.ReadKeyRing(path)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading OpenPGP keyring: %v", err))
+	}
+
+	if len(el) == 0 {
+		helper.OutputAndExit(fmt.Sprintf("OpenPGP keyring does not contain any keys: %s", path))
+	}
+
+	return el
+}
+
+// getPGPPassphrase prompts for the passphrase of the OpenPGP secret key
+func getPGPPassphrase() ([]byte, error) {
+
+	fmt.Printf("Enter OpenPGP passphrase: ")
+	passphrase, err := gopass.GetPasswd()
+	fmt.Println("")
+
+	return passphrase, err
+}
+
+// getPGPSigner reads the secret key used to sign the file, prompting for
+// the passphrase if the secret key is encrypted
+func getPGPSigner(path string) *openpgp.Entity {
+
+	signer := readKeyRing(path)[0]
+	if signer.PrivateKey == nil {
+		helper.OutputAndExit(fmt.Sprintf("OpenPGP keyring does not contain a secret key: %s", path))
+	}
+
+	var passphrase []byte
+	if signer.PrivateKey.Encrypted == true {
+		var err error
+		passphrase, err = getPGPPassphrase()
+		if err != nil {
+			helper.OutputAndExit("Error reading passphrase")
+		}
+	}
+
+	err := crypto.UnlockEntity(signer, passphrase)
+	if err != nil {
+		helper.OutputAndExit(err.Error())
+	}
+
+	return signer
+}
+
+// getPGPReaderForUpload encrypts the file to the recipients' OpenPGP public keys. The
+// size of an OpenPGP message cannot be determined in advance, and every upload method
+// needs the size before sending, so the message is written to a temporary file in the
+// system temporary directory, which is removed when closed. This needs free space for
+// a copy of the file, set TMPDIR to use another location. The file contents are
+// written to fileHash as they are read
+func getPGPReaderForUpload(recipients openpgp.EntityList, signer *openpgp.Entity, path string, fileHash io.Writer) (io.ReadCloser, int64, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	tf, err := ioutil.TempFile("", "filesender")
+	if err != nil {
+		return nil, 0, err
+	}
+	t := &tempFile{tf}
+
+	err = crypto.EncryptPGP(t, recipients, signer, io.TeeReader(f, fileHash), path)
+	if err != nil {
+		t.Close()
+		return nil, 0, err
+	}
+
+	// The message has been written, so the offset is the size of the message
+	length, err := t.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = t.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		t.Close()
+		return nil, 0, err
+	}
+
+	return t, length, nil
+}
+
+// getPGPReader returns a reader that decrypts the OpenPGP file contents using
+// the secret keyrings, prompting for the passphrase if the secret key is encrypted
+func getPGPReader(r io.Reader, keyrings []string) (io.Reader, *openpgp.MessageDetails) {
+
+	keyring := make(openpgp.EntityList, 0)
+	for _, path := range keyrings {
+		keyring = append(keyring, readKeyRing(path)...)
+	}
+
+	dr, md, err := crypto.NewPGPDecrypter(keyring, r, getPGPPassphrase)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Unable to decrypt file: %v", err))
+	}
+
+	return dr, md
+}
+
+// outputPGPSigner outputs who signed the file, the signature itself has
+// been verified by the time the file contents have been read
+func outputPGPSigner(md *openpgp.MessageDetails) {
+
+	if md.IsSigned == false {
+		fmt.Printf("File is not signed\n")
+		return
+	}
+
+	if md.SignedBy == nil {
+		fmt.Printf("File is signed by an unknown key [%X], the signature has not been verified\n", md.SignedByKeyId)
+		return
+	}
+
+	for name := range md.SignedBy.Entity.Identities {
+		fmt.Printf("Verified OpenPGP signature from: %s [%X]\n", name, md.SignedByKeyId)
+		return
+	}
+
+	fmt.Printf("Verified OpenPGP signature from key [%X]\n", md.SignedByKeyId)
+}
+
+// ##### Methods #############################################################
+
+// Close closes and removes the temporary file
+func (t *tempFile) Close() error {
+
+	err := t.File.Close()
+	os.Remove(t.Name())
+
+	return err
+}
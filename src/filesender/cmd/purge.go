@@ -1,11 +1,10 @@
 package cmd
 
 import (
-	drive "filesender/drive"
+	relay "filesender/relay"
 	helper "filesender/utils"
 
 	"github.com/spf13/cobra"
-	"github.com/woanware/gdriver"
 )
 
 // ##### Variables ###########################################################
@@ -14,7 +13,7 @@ var cmdPurge = &cobra.Command{
 	Use:     "purge",
 	Aliases: []string{"p"},
 	Short:   "Purges all files",
-	Long:    `Purges all files from google drive e.g. related to filesender!`,
+	Long:    `Purges all files from the relay e.g. related to filesender!`,
 	Run:     purge,
 }
 
@@ -29,17 +28,17 @@ func init() {
 // send performs the sending of the file
 func purge(cmd *cobra.Command, args []string) {
 
-	_, gdrive := drive.InitialiseGoogleDrive()
+	r := getRelay(cmd)
 
-	err := gdrive.ListDirectory("/filesender", func(fi *gdriver.FileInfo) error {
+	err := r.List(func(obj *relay.Object) error {
 
-		// If there is no mnemonicode app property or it is zero length, then leave the file
-		if len(fi.DriveFile().AppProperties["mnemonicode"]) == 0 {
+		// If there is no mnemonicode meta data or it is zero length, then leave the file
+		if len(obj.Code()) == 0 {
 			return nil
 		}
 
-		// Now delete the file from google drive
-		err := gdrive.Delete(fi.Path())
+		// Now delete the file from the relay
+		err := r.Delete(obj)
 		if err != nil {
 			return err
 		}
@@ -3,30 +3,59 @@ package cmd
 import (
 	"bytes"
 	"crypto/aes"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
+	config "filesender/config"
 	crypto "filesender/crypto"
-	drive "filesender/drive"
+	direct "filesender/direct"
+	relay "filesender/relay"
 	helper "filesender/utils"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/howeyc/gopass"
 	"github.com/spf13/cobra"
-	"github.com/woanware/gdriver"
 	util "github.com/woanware/goutil"
 )
 
+// ##### Constants ###########################################################
+
+const DISCOVERY_TIMEOUT time.Duration = 2 * time.Minute
+const DIAL_TIMEOUT time.Duration = 5 * time.Second
+const POLL_INTERVAL time.Duration = 5 * time.Second
+
+// UPLOAD_TIMEOUT is the default time the receiver waits for the sender to upload the
+// file, after a key exchange or when the sender falls back to uploading via the relay
+const UPLOAD_TIMEOUT time.Duration = 10 * time.Minute
+
+// ##### Structs #############################################################
+
+// receiveOptions holds the command line parameters used to download and decrypt the files
+type receiveOptions struct {
+	keyrings      []string
+	fileKey       []byte
+	passphrase    bool
+	parallel      int
+	leave         bool
+	wait          time.Duration
+	requireSigned bool
+}
+
 // ##### Variables ###########################################################
 
 var cmdReceive = &cobra.Command{
 	Use:     "receive [mnemonicode]",
 	Aliases: []string{"r"},
 	Short:   "Receives a file",
-	Long:    `Receives a file from google drive`,
+	Long:    `Receives a file from the relay`,
 	Run:     receive,
 	Args: func(cmd *cobra.Command, args []string) error {
 
@@ -43,11 +72,18 @@ var cmdReceive = &cobra.Command{
 // Add the command to the cobra setup
 func init() {
 
-	cmdReceive.Flags().BoolP("leave", "l", false, "Leave the file on google drive e.g. no delete")
+	cmdReceive.Flags().BoolP("leave", "l", false, "Leave the file on the relay e.g. no delete")
+	cmdReceive.Flags().BoolP("direct", "d", false, "Receive the file directly from the sender on the local network")
+	cmdReceive.Flags().BoolP("require-signed", "s", false, "Refuse files that are not signed by the sender")
+	cmdReceive.Flags().Bool("file-key", false, "Decrypt using the data key of the file, output by the file-key command, rather than the crypto data")
+	cmdReceive.Flags().Bool("passphrase", false, "Decrypt using the one-off passphrase of the file, rather than the crypto data")
+	cmdReceive.Flags().Int("parallel", CHUNK_WORKERS, "The number of chunks downloaded in parallel, for files uploaded as chunks")
+	cmdReceive.Flags().Duration("wait", UPLOAD_TIMEOUT, "How long to wait for the sender to upload the file after a key exchange or failed direct connection")
+	cmdReceive.Flags().StringSlice("pgp-key", []string{crypto.PGP_SECRET_KEYRING}, "OpenPGP keyring files holding the secret key, and the sender's public key to verify signatures")
 	cmdRoot.AddCommand(cmdReceive)
 }
 
-// send performs the sending of the file
+// receive performs the receiving of the file
 func receive(cmd *cobra.Command, args []string) {
 
 	leave, err := cmd.Flags().GetBool("leave")
@@ -55,74 +91,463 @@ func receive(cmd *cobra.Command, args []string) {
 		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
 	}
 
-	mnemonicode := args[0]
-
-	_, gdrive := drive.InitialiseGoogleDrive()
+	direct, err := cmd.Flags().GetBool("direct")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
 
-	foundFile := false
+	opts := &receiveOptions{leave: leave}
+	opts.keyrings, err = cmd.Flags().GetStringSlice("pgp-key")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
 
-	err = gdrive.ListDirectory("/filesender", func(fi *gdriver.FileInfo) error {
+	fileKey, err := cmd.Flags().GetBool("file-key")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
 
-		if fi.DriveFile().AppProperties["mnemonicode"] != mnemonicode {
-			return nil
+	// The data key is asked for, so that it is not kept in the shell history or process list
+	if fileKey == true {
+		fmt.Printf("Enter data key: ")
+		dataKey, err := gopass.GetPasswd()
+		if err != nil {
+			helper.OutputAndExit("Error reading data key")
 		}
 
-		fileName := fi.DriveFile().AppProperties["file_name"]
-		if len(fileName) == 0 {
-			return fmt.Errorf("File does not contain original file name meta data")
+		opts.fileKey, err = hex.DecodeString(strings.TrimSpace(string(dataKey)))
+		if err != nil || len(opts.fileKey) != crypto.KEY_SIZE {
+			helper.OutputAndExit("Invalid data key")
 		}
+	}
 
-		encrypted, ivp, err := checkIfEncrypted(fi)
+	opts.passphrase, err = cmd.Flags().GetBool("passphrase")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
 
-		var key []byte
-		if encrypted == true {
-			key = getDecryptionKey()
-		}
+	opts.parallel, err = cmd.Flags().GetInt("parallel")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
 
-		// Get the file contents from google drive
-		_, reader, err := gdrive.GetFile(fi.Path())
-		if err != nil {
-			return err
+	if opts.parallel < 1 {
+		helper.OutputAndExit("The parallel parameter must be at least one")
+	}
+
+	opts.wait, err = cmd.Flags().GetDuration("wait")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	opts.requireSigned, err = cmd.Flags().GetBool("require-signed")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	mnemonicode := args[0]
+
+	if direct == true {
+		receiveDirect(mnemonicode, opts)
+		return
+	}
+
+	r := getRelay(cmd)
+
+	lookup := splitCode(mnemonicode)
+	objs, records := findFiles(r, lookup)
+
+	// If the sender is waiting for a key exchange, then respond to it and wait
+	// for the sender to upload the file encrypted using the exchanged key
+	var p *crypto.Pake
+	if len(objs) == 0 && records[relay.KIND_PAKE_SENDER] != nil {
+		p = receivePake(r, mnemonicode, records[relay.KIND_PAKE_SENDER])
+
+		fmt.Printf("Waiting for the sender to upload the file\n")
+		objs, records = waitForFiles(r, lookup, opts.wait)
+	}
+
+	// If the sender is waiting for a direct connection, then try to connect to
+	// it, otherwise wait for the sender to fall back to uploading via the relay
+	if len(objs) == 0 && records[relay.KIND_RENDEZVOUS] != nil {
+		if receiveRendezvous(r, mnemonicode, records[relay.KIND_RENDEZVOUS], opts) == true {
+			return
 		}
 
-		var r io.Reader
-		r = reader
+		fmt.Printf("Unable to connect directly, waiting for the sender to upload via the relay\n")
+		objs, records = waitForFiles(r, lookup, opts.wait)
+	}
+
+	// Files without the checksum are still uploading, or have been uploaded but the
+	// checksum has not yet been stored, so wait rather than receive them unverified
+	if len(objs) > 0 && isUploaded(objs) == false {
+		fmt.Printf("Waiting for the sender to finish uploading the file\n")
+		objs, records = waitForFiles(r, lookup, opts.wait)
+	}
+
+	senders := new(config.KnownSenders)
+	senders.Load()
 
-		if encrypted == true {
-			r = validateIv(r, key, ivp)
+	foundFile := false
+
+	for _, obj := range objs {
+
+		// The sender is verified before the file is downloaded, apart from streamed
+		// uploads, as the manifest is only signed once the upload completes
+		var manifest *crypto.Manifest
+		if isStream(obj) == false {
+			manifest = checkManifest(r, obj, records[relay.KIND_MANIFEST], opts.requireSigned, senders, "")
 		}
 
 		foundFile = true
 
-		checkLocalFile(fileName)
-		writeLocalFile(fileName, fi.Size(), r)
+		// Get the file contents from the relay
+		fileName, sum := receiveObject(r, obj, p, opts)
+
+		if isStream(obj) == true {
+			_, records = findFiles(r, lookup)
+			manifest = checkManifest(r, obj, records[relay.KIND_MANIFEST], opts.requireSigned, senders, fileName)
+		}
+
+		if manifest != nil {
+			verifyManifest(manifest, fileName, sum, senders)
+		}
 
 		if leave == false {
-			// Now delete the file from google drive
-			err = gdrive.Delete(fi.Path())
+			// Now delete the file from the relay
+			err = r.Delete(obj)
 			if err != nil {
-				return err
+				helper.OutputAndExit(err.Error())
+			}
+
+			err = deleteChunks(r, obj)
+			if err != nil {
+				helper.OutputAndExit(err.Error())
+			}
+
+			if records[relay.KIND_MANIFEST] != nil {
+				err = r.Delete(records[relay.KIND_MANIFEST])
+				if err != nil {
+					helper.OutputAndExit(err.Error())
+				}
 			}
 		}
+	}
 
-		return nil
-	})
+	if foundFile == false {
+		fmt.Printf("Unable to locate file\n")
+	}
+}
+
+// findFiles returns the file objects tagged with the mnemonicode, along with the
+// records e.g. rendezvous or PAKE, keyed by kind, that the sender is waiting on
+func findFiles(r relay.Relay, mnemonicode string) ([]*relay.Object, map[string]*relay.Object) {
+
+	objs, err := r.Find(mnemonicode)
 	if err != nil {
 		helper.OutputAndExit(err.Error())
 	}
 
-	if foundFile == false {
-		fmt.Printf("Unable to locate file\n")
+	files := make([]*relay.Object, 0)
+	records := make(map[string]*relay.Object, 0)
+	for _, obj := range objs {
+		if obj.Kind() == "" {
+			files = append(files, obj)
+		} else {
+			records[obj.Kind()] = obj
+		}
+	}
+
+	return files, records
+}
+
+// waitForFiles polls the relay until the sender has uploaded the files, and returns
+// them along with the records e.g. the signed manifest. The checksum is stored once
+// the upload completes, so files without it are still uploading, apart from streamed
+// uploads which are received while they are uploading. If the sender has not uploaded
+// the files within the wait period e.g. the sender has stopped, then the receive fails
+func waitForFiles(r relay.Relay, mnemonicode string, wait time.Duration) ([]*relay.Object, map[string]*relay.Object) {
+
+	deadline := time.Now().Add(wait)
+	for {
+		objs, records := findFiles(r, mnemonicode)
+		checkPakeAbort(r, records)
+		if len(objs) > 0 && isUploaded(objs) == true {
+			return objs, records
+		}
+
+		if time.Now().After(deadline) == true {
+			helper.OutputAndExit(fmt.Sprintf("Timed out after %s waiting for the sender to upload the file, the sender may have stopped", wait))
+		}
+
+		time.Sleep(POLL_INTERVAL)
+	}
+}
+
+// isUploaded returns true if the upload of every file has completed, which is when
+// the checksum is stored, apart from streamed uploads which are received while uploading
+func isUploaded(objs []*relay.Object) bool {
+
+	for _, obj := range objs {
+		if len(obj.Metadata[relay.KEY_SHA256]) == 0 && isStream(obj) == false {
+			return false
+		}
+	}
+
+	return true
+}
+
+// receiveRendezvous reads the rendezvous record published by the sender and tries
+// to connect directly to the sender, returning false if no connection could be made
+func receiveRendezvous(r relay.Relay, mnemonicode string, obj *relay.Object, opts *receiveOptions) bool {
+
+	rv, err := direct.ParseRendezvous(readRecord(r, obj))
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Invalid rendezvous record: %v", err))
+	}
+
+	fmt.Printf("Connecting directly to sender\n")
+
+	conn, err := rv.Dial(mnemonicode, DIAL_TIMEOUT)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	receiveFromConn(conn, splitCode(mnemonicode), opts)
+	return true
+}
+
+// receiveDirect locates the sender on the local network, and
+// receives the file contents directly from the sender
+func receiveDirect(mnemonicode string, opts *receiveOptions) {
+
+	fmt.Printf("Locating sender on the local network\n")
+
+	conn, err := direct.Discover(mnemonicode, DISCOVERY_TIMEOUT, DIAL_TIMEOUT)
+	if err != nil {
+		helper.OutputAndExit(err.Error())
+	}
+	defer conn.Close()
+
+	receiveFromConn(conn, mnemonicode, opts)
+}
+
+// receiveFromConn reads the file meta data and contents from the direct connection,
+// verifies the sender if the file is signed, and confirms to the sender that the file
+// has been received. The signed manifest follows the file contents, so as with streamed
+// uploads the received file is removed if the sender is not verified
+func receiveFromConn(conn *direct.Conn, mnemonicode string, opts *receiveOptions) {
+
+	sc, err := conn.ReadHeader()
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to read file meta data: %v", err))
+	}
+
+	fileName, sum := receiveFile(sc.Metadata, sc.Size, io.LimitReader(conn, sc.Size), nil, opts)
+
+	expected, err := conn.ReadChecksum()
+	if err != nil {
+		removeLocalFile(fileName)
+		helper.OutputAndExit(fmt.Sprintf("Failed to read file checksum: %v", err))
+	}
+	verifyLocalFile(fileName, expected, sum)
+
+	data, err := conn.ReadManifest()
+	if err != nil {
+		removeLocalFile(fileName)
+		helper.OutputAndExit(fmt.Sprintf("Failed to read file manifest: %v", err))
+	}
+
+	senders := new(config.KnownSenders)
+	senders.Load()
+
+	m := checkSignedManifest(data, &crypto.Manifest{
+		Code:     mnemonicode,
+		FileName: sc.Metadata[relay.KEY_FILE_NAME],
+		Size:     sc.Size,
+	}, opts.requireSigned, senders, fileName)
+	if m != nil {
+		verifyManifest(m, fileName, sum, senders)
+	}
+
+	err = conn.WriteAck()
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to confirm the file was received: %v", err))
+	}
+}
+
+// receiveFile decrypts the file contents if required, using the key exchanged via
+// PAKE if the sender used one, or the keys set by the options, and writes the file
+// to the local disk. The file is verified against the checksum meta data if present,
+// the file name and the SHA-256 of the file contents are returned
+func receiveFile(md map[string]string, size int64, reader io.Reader, p *crypto.Pake, opts *receiveOptions) (string, string) {
+
+	if md[relay.KEY_FORMAT] == crypto.FORMAT_ENVELOPE {
+		return receiveEnvelope(md, reader, p, opts)
+	}
+
+	fileName := localFileName(md[relay.KEY_FILE_NAME])
+
+	encrypted, ivp, err := checkIfEncrypted(md)
+	if err != nil {
+		helper.OutputAndExit(err.Error())
+	}
+
+	var key []byte
+	if encrypted == true {
+		if len(md[relay.KEY_PAKE]) > 0 {
+			key = getPakeKey(p, md)
+		} else {
+			key = getDecryptionKey(md[relay.KEY_KEY_ID])
+		}
+	}
+
+	if encrypted == true {
+		reader = validateIv(reader, key, ivp, md[relay.KEY_FORMAT])
+	}
+
+	// Files encrypted to public keys have no IV, the file key is in the age header
+	if md[relay.KEY_FORMAT] == crypto.FORMAT_AGE {
+		reader = getAgeReader(reader)
+	}
+
+	var pgpDetails *openpgp.MessageDetails
+	if md[relay.KEY_FORMAT] == crypto.FORMAT_PGP {
+		reader, pgpDetails = getPGPReader(reader, opts.keyrings)
+	}
+
+	checkLocalFile(fileName)
+
+	sum, err := writeLocalFile(fileName, size, reader)
+	if err != nil {
+		helper.OutputAndExit(err.Error())
+	}
+
+	if pgpDetails != nil {
+		outputPGPSigner(pgpDetails)
+	}
+
+	if len(md[relay.KEY_SHA256]) > 0 {
+		verifyLocalFile(fileName, md[relay.KEY_SHA256], sum)
+	}
+
+	return fileName, sum
+}
+
+// receiveEnvelope decrypts the envelope holding the file meta data, and writes the file
+// to the local disk. The checksum of the envelope format is of the encrypted bytes, so the
+// file is verified against the checksum of the bytes received, which is also returned
+func receiveEnvelope(md map[string]string, reader io.Reader, p *crypto.Pake, opts *receiveOptions) (string, string) {
+
+	key := getEnvelopeKey(md, p, opts)
+
+	payloadHash := sha256.New()
+	e, contents, err := crypto.OpenEnvelope(key, io.TeeReader(reader, payloadHash))
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Unable to decrypt file: %v", err))
+	}
+
+	e.FileName = localFileName(e.FileName)
+
+	checkLocalFile(e.FileName)
+
+	_, err = writeLocalFile(e.FileName, e.Size, contents)
+	if err != nil {
+		helper.OutputAndExit(err.Error())
+	}
+
+	setFileMode(e.FileName, e.Mode)
+
+	sum := hex.EncodeToString(payloadHash.Sum(nil))
+	if len(md[relay.KEY_SHA256]) > 0 {
+		verifyLocalFile(e.FileName, md[relay.KEY_SHA256], sum)
+	}
+
+	return e.FileName, sum
+}
+
+// getEnvelopeKey returns the key used to encrypt the envelope, which is either the PAKE
+// session key, or the data key of the file. The data key is unwrapped using the one-off
+// passphrase or the crypto data, unless it has been supplied via the options. Files
+// sent using only a one-off passphrase always use the passphrase
+func getEnvelopeKey(md map[string]string, p *crypto.Pake, opts *receiveOptions) []byte {
+
+	if len(md[relay.KEY_PAKE]) > 0 {
+		return getPakeKey(p, md)
+	}
+
+	if opts.fileKey != nil {
+		return opts.fileKey
+	}
+
+	if opts.passphrase == true || (len(md[relay.KEY_WRAPPED_KEY]) == 0 && len(md[relay.KEY_PASSPHRASE_KEY]) > 0) {
+		if len(md[relay.KEY_PASSPHRASE_KEY]) == 0 {
+			helper.OutputAndExit("File was not encrypted with a one-off passphrase")
+		}
+
+		fmt.Printf("Enter passphrase: ")
+		passphrase, err := gopass.GetPasswd()
+		if err != nil {
+			helper.OutputAndExit("Error reading passphrase")
+		}
+
+		dataKey, err := crypto.UnwrapDataKeyWithPassphrase(string(passphrase), md[relay.KEY_PASSPHRASE_KEY])
+		if err != nil {
+			helper.OutputAndExit(err.Error())
+		}
+		return dataKey
+	}
+
+	key := getDecryptionKey(md[relay.KEY_KEY_ID])
+
+	// Files encrypted before data keys were introduced use the encryption key directly
+	if len(md[relay.KEY_WRAPPED_KEY]) == 0 {
+		return key
+	}
+
+	return unwrapDataKey(key, md)
+}
+
+// unwrapDataKey decrypts the data key of the file using the encryption key
+func unwrapDataKey(key []byte, md map[string]string) []byte {
+
+	dataKey, err := crypto.UnwrapDataKey(key, md[relay.KEY_WRAPPED_KEY])
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Unable to decrypt the data key: %v", err))
+	}
+
+	return dataKey
+}
+
+// verifyLocalFile compares the SHA-256 of the received file contents with the
+// checksum sent by the sender, the local file is removed if they do not match
+func verifyLocalFile(fileName string, expected string, sum string) {
+
+	if expected != sum {
+		removeLocalFile(fileName)
+		helper.OutputAndExit(fmt.Sprintf("Received file checksum [%s] does not match the file sent [%s], the file has been removed", sum, expected))
+	}
+
+	fmt.Printf("Verified SHA-256 checksum: %s\n", sum)
+}
+
+// removeLocalFile removes a partial or corrupt received file
+func removeLocalFile(fileName string) {
+
+	err := os.Remove(fileName)
+	if err != nil && os.IsNotExist(err) == false {
+		fmt.Printf("Failed to remove local file: %v\n", err)
 	}
 }
 
 //
-func validateIv(r io.Reader, key []byte, ivp []byte) io.Reader {
+func validateIv(r io.Reader, key []byte, ivp []byte, format string) io.Reader {
 
 	// Read the initialization vector from the start of the file.
 	iv := make([]byte, 16)
-	n, err := r.Read(iv)
-	if err != nil && err != io.EOF {
+	n, err := io.ReadFull(r, iv)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		helper.OutputAndExit(fmt.Sprintf("Error reading file contents: %v", err))
 	}
 
@@ -135,14 +560,27 @@ func validateIv(r io.Reader, key []byte, ivp []byte) io.Reader {
 		helper.OutputAndExit(fmt.Sprintf("File header IV [%s] doesn't match meta data IV [%s]", hex.EncodeToString(iv), hex.EncodeToString(ivp)))
 	}
 
-	return crypto.MakeDecryptionReader(key, iv, r)
+	switch format {
+	case "", crypto.FORMAT_CFB:
+		return crypto.MakeDecryptionReader(key, iv, r)
+	case crypto.FORMAT_STREAM:
+		dr, err := crypto.NewStreamDecrypter(key, iv, r)
+		if err != nil {
+			helper.OutputAndExit(fmt.Sprintf("Unable to decrypt file: %v", err))
+		}
+		return dr
+	default:
+		helper.OutputAndExit(fmt.Sprintf("Unsupported encryption format: %s", format))
+	}
+
+	return nil
 }
 
 //
-func checkIfEncrypted(fi *gdriver.FileInfo) (bool, []byte, error) {
+func checkIfEncrypted(md map[string]string) (bool, []byte, error) {
 
 	encrypted := false
-	ivHex := fi.DriveFile().AppProperties["iv"]
+	ivHex := md[relay.KEY_IV]
 	if len(ivHex) > 0 {
 		encrypted = true
 	} else {
@@ -161,8 +599,9 @@ func checkIfEncrypted(fi *gdriver.FileInfo) (bool, []byte, error) {
 	return encrypted, ivp, nil
 }
 
-//
-func getDecryptionKey() []byte {
+// getDecryptionKey prompts for the password, and returns the encryption key
+// with the key identifier, which may be a retired key
+func getDecryptionKey(keyID string) []byte {
 
 	fmt.Printf("Enter password: ")
 	password, err := gopass.GetPasswd()
@@ -173,7 +612,49 @@ func getDecryptionKey() []byte {
 		helper.OutputAndExit("Password not supplied")
 	}
 
-	return crypto.DecryptEncryptionKey(string(password))
+	key, err := crypto.UnlockKeyring(string(password)).Find(keyID)
+	if err != nil {
+		helper.OutputAndExit(err.Error())
+	}
+
+	return key
+}
+
+// getAgeReader returns a reader that decrypts the age file contents using the local identity
+func getAgeReader(r io.Reader) io.Reader {
+
+	if util.DoesFileExist(crypto.IDENTITY_FILE) == false {
+		helper.OutputAndExit(fmt.Sprintf("File was encrypted to a public key, but there is no identity file: %s", crypto.IDENTITY_FILE))
+	}
+
+	identities, err := crypto.LoadIdentities(crypto.IDENTITY_FILE)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading identity file: %v", err))
+	}
+
+	dr, err := crypto.NewAgeDecrypter(identities, r)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Unable to decrypt file: %v", err))
+	}
+
+	return dr
+}
+
+// localFileName returns the name that the file is written to, which is only the base
+// name of the file name meta data, so that a sender cannot write outside of the CWD
+func localFileName(name string) string {
+
+	if len(name) == 0 {
+		helper.OutputAndExit("File does not contain original file name meta data")
+	}
+
+	// Files sent from Windows have backslash separators
+	base := filepath.Base(strings.Replace(name, "\\", "/", -1))
+	if base == "." || base == ".." || base == "/" {
+		helper.OutputAndExit(fmt.Sprintf("Invalid file name meta data: %s", name))
+	}
+
+	return base
 }
 
 // checkLocalFile determines if the file exists in the CWD and
@@ -200,9 +681,10 @@ func checkLocalFile(fileName string) {
 	}
 }
 
-// writeLocalFile writes the google drive file to the
-// local disk, and updates progress using a progress bar
-func writeLocalFile(fileName string, fileSize int64, r io.Reader) {
+// writeLocalFile writes the relay file to the local disk, and updates progress
+// using a progress bar. The SHA-256 of the file contents is returned, the partial
+// file is removed if the contents cannot be read e.g. the decryption fails
+func writeLocalFile(fileName string, fileSize int64, r io.Reader) (string, error) {
 
 	fmt.Println("")
 
@@ -211,22 +693,30 @@ func writeLocalFile(fileName string, fileSize int64, r io.Reader) {
 	// Create the local file
 	writer, err := os.Create(fileName)
 	if err != nil {
-		helper.OutputAndExit(fmt.Sprintf("Error creating file: %v", err))
+		return "", fmt.Errorf("Error creating file: %v", err)
 	}
-	defer writer.Close()
 
 	// Tee writes to the progress bar, which provides the Writer interface
 	// and updates itself according to the number of bytes that it sees.
-	mW := io.MultiWriter(writer, progressBar)
+	fileHash := sha256.New()
+	mW := io.MultiWriter(writer, progressBar, fileHash)
 
 	// And here's where the magic happens
 	cr := &CountingReader{R: r}
 	_, err = io.Copy(mW, cr)
+	if err == nil {
+		err = writer.Close()
+	} else {
+		writer.Close()
+	}
 	if err != nil {
-		helper.OutputAndExit(fmt.Sprintf("Error copying file contents: %v", err))
+		removeLocalFile(fileName)
+		return "", fmt.Errorf("Error copying file contents: %v", err)
 	}
 
 	progressBar.Finish()
 
 	fmt.Printf("Received %s file: %s\n", fileName, byteCountIEC(cr.bytesRead))
+
+	return hex.EncodeToString(fileHash.Sum(nil)), nil
 }
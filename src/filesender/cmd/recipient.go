@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	config "filesender/config"
+	crypto "filesender/crypto"
+	helper "filesender/utils"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+)
+
+// ##### Variables ###########################################################
+
+var cmdRecipient = &cobra.Command{
+	Use:   "recipient",
+	Short: "Manages the recipients list",
+	Long:  `Manages the recipients list, which holds the public keys of the people that files can be sent to using send --to`,
+}
+
+var cmdRecipientAdd = &cobra.Command{
+	Use:   "add [name] [public key]",
+	Short: "Adds a recipient",
+	Long:  `Adds a recipient, the public key is output by keygen on the receiving computer`,
+	Run:   recipientAdd,
+	Args: func(cmd *cobra.Command, args []string) error {
+
+		if len(args) != 2 {
+			return errors.New("Requires the recipient name and public key")
+		}
+
+		return nil
+	},
+}
+
+var cmdRecipientList = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the recipients",
+	Long:  `Lists the recipients and their public keys`,
+	Run:   recipientList,
+}
+
+var cmdRecipientRemove = &cobra.Command{
+	Use:   "remove [name]",
+	Short: "Removes a recipient",
+	Long:  `Removes a recipient from the recipients list`,
+	Run:   recipientRemove,
+	Args: func(cmd *cobra.Command, args []string) error {
+
+		if len(args) != 1 {
+			return errors.New("Requires the recipient name")
+		}
+
+		return nil
+	},
+}
+
+// ##### Functions ###########################################################
+
+// Add the command to the cobra setup
+func init() {
+
+	cmdRecipient.AddCommand(cmdRecipientAdd)
+	cmdRecipient.AddCommand(cmdRecipientList)
+	cmdRecipient.AddCommand(cmdRecipientRemove)
+	cmdRoot.AddCommand(cmdRecipient)
+}
+
+// recipientAdd performs the adding of a recipient
+func recipientAdd(cmd *cobra.Command, args []string) {
+
+	_, err := crypto.ParseRecipient(args[1])
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Invalid public key: %v", err))
+	}
+
+	recipients := new(config.Recipients)
+	recipients.Load()
+
+	if recipients.Find(args[0]) != nil {
+		helper.OutputAndExit(fmt.Sprintf("Recipient already exists: %s", args[0]))
+	}
+
+	recipients.Recipients = append(recipients.Recipients, config.Recipient{Name: args[0], PublicKey: args[1]})
+	recipients.Save()
+
+	fmt.Printf("Recipient %s added\n", args[0])
+}
+
+// recipientList performs the listing of the recipients
+func recipientList(cmd *cobra.Command, args []string) {
+
+	recipients := new(config.Recipients)
+	recipients.Load()
+
+	for _, recipient := range recipients.Recipients {
+		fmt.Printf("%s\t%s\n", recipient.Name, recipient.PublicKey)
+	}
+}
+
+// recipientRemove performs the removal of a recipient
+func recipientRemove(cmd *cobra.Command, args []string) {
+
+	recipients := new(config.Recipients)
+	recipients.Load()
+
+	for i, recipient := range recipients.Recipients {
+		if recipient.Name != args[0] {
+			continue
+		}
+
+		recipients.Recipients = append(recipients.Recipients[:i], recipients.Recipients[i+1:]...)
+		recipients.Save()
+
+		fmt.Printf("Recipient %s removed\n", args[0])
+		return
+	}
+
+	helper.OutputAndExit(fmt.Sprintf("Recipient does not exist: %s", args[0]))
+}
+
+// getRecipients returns the public keys for the recipients, which are either
+// names from the recipients list or age public keys
+func getRecipients(names []string) []age.Recipient {
+
+	recipients := new(config.Recipients)
+	recipients.Load()
+
+	keys := make([]age.Recipient, 0)
+	for _, name := range names {
+		publicKey := name
+		recipient := recipients.Find(name)
+		if recipient != nil {
+			publicKey = recipient.PublicKey
+		}
+
+		key, err := crypto.ParseRecipient(publicKey)
+		if err != nil {
+			helper.OutputAndExit(fmt.Sprintf("Unknown recipient: %s", name))
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys
+}
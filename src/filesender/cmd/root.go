@@ -23,6 +23,12 @@ var cmdRoot = &cobra.Command{
 
 // ##### Functions ###########################################################
 
+// Add the global flags to the cobra setup
+func init() {
+
+	cmdRoot.PersistentFlags().StringP("backend", "b", "", "Relay backend used to store the files (default from filesender.toml, otherwise gdrive)")
+}
+
 // Root/base/default command e.g. just display the app info
 func Execute() {
 
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	crypto "filesender/crypto"
+	relay "filesender/relay"
+	helper "filesender/utils"
+
+	"github.com/spf13/cobra"
+)
+
+// ##### Variables ###########################################################
+
+var cmdRotateKey = &cobra.Command{
+	Use:   "rotate-key",
+	Short: "Rotates the encryption key",
+	Long: `Creates a new encryption key for sending files. The previous key is retired but kept in the crypto data,
+so that encrypted files already sent can still be received, until it is pruned`,
+	Run: rotateKey,
+}
+
+// ##### Functions ###########################################################
+
+// Add the command to the cobra setup
+func init() {
+
+	cmdRotateKey.Flags().BoolP("prune", "p", false, "Remove the retired keys that are not used by any encrypted files on the relay, rather than rotating the key")
+	cmdRoot.AddCommand(cmdRotateKey)
+}
+
+// rotateKey performs the rotation or pruning of the encryption keys
+func rotateKey(cmd *cobra.Command, args []string) {
+
+	prune, err := cmd.Flags().GetBool("prune")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	keyring := unlockKeyring()
+
+	if prune == true {
+		pruneKeys(cmd, keyring)
+		return
+	}
+
+	previous := keyring.ID()
+
+	err = keyring.Rotate()
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Unable to rotate key: %v", err))
+	}
+	keyring.Save()
+
+	fmt.Printf("Encryption key rotated from %s to %s\n", previous, keyring.ID())
+	fmt.Printf("Retired keys: %s\n", strings.Join(keyring.RetiredIDs(), ", "))
+}
+
+// pruneKeys removes the retired keys that are not used by any of the encrypted files on the relay
+func pruneKeys(cmd *cobra.Command, keyring *crypto.Keyring) {
+
+	inUse := make(map[string]bool, 0)
+	legacyInUse := false
+
+	r := getRelay(cmd)
+	err := r.List(func(obj *relay.Object) error {
+
+		// Only files encrypted using the crypto data are relevant
+		encrypted := len(obj.Metadata[relay.KEY_IV]) > 0 || obj.Metadata[relay.KEY_FORMAT] == crypto.FORMAT_ENVELOPE
+		if len(obj.Code()) == 0 || encrypted == false || len(obj.Metadata[relay.KEY_PAKE]) > 0 {
+			return nil
+		}
+
+		// Files without a key ID use the legacy key if it encrypted the file or wraps its data
+		// key, files sent using only a one-off passphrase have neither
+		keyID := obj.Metadata[relay.KEY_KEY_ID]
+		if len(keyID) > 0 {
+			inUse[keyID] = true
+		} else if len(obj.Metadata[relay.KEY_WRAPPED_KEY]) > 0 || len(obj.Metadata[relay.KEY_IV]) > 0 {
+			legacyInUse = true
+		}
+
+		return nil
+	})
+	if err != nil {
+		helper.OutputAndExit(err.Error())
+	}
+
+	removed := keyring.Prune(inUse, legacyInUse)
+	if len(removed) == 0 {
+		fmt.Printf("No retired keys to prune\n")
+		return
+	}
+	keyring.Save()
+
+	fmt.Printf("Pruned retired keys: %s\n", strings.Join(removed, ", "))
+}
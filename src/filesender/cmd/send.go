@@ -1,20 +1,27 @@
 package cmd
 
 import (
-	"bytes"
-	"crypto/aes"
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
+	config "filesender/config"
 	crypto "filesender/crypto"
-	drive "filesender/drive"
+	direct "filesender/direct"
+	relay "filesender/relay"
 	helper "filesender/utils"
 
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
 	uuid "github.com/gofrs/uuid"
 	"github.com/howeyc/gopass"
 	"github.com/schollz/mnemonicode"
@@ -22,13 +29,17 @@ import (
 	util "github.com/woanware/goutil"
 )
 
+// ##### Constants ###########################################################
+
+const RENDEZVOUS_WAIT time.Duration = 1 * time.Minute
+
 // ##### Variables ###########################################################
 
 var cmdSend = &cobra.Command{
 	Use:     "send [file path]",
 	Aliases: []string{"s"},
 	Short:   "Sends a file",
-	Long:    `Sends a file to google drive`,
+	Long:    `Sends a file to the relay`,
 	Run:     send,
 	Args: func(cmd *cobra.Command, args []string) error {
 
@@ -50,6 +61,20 @@ var cmdSend = &cobra.Command{
 func init() {
 
 	cmdSend.Flags().BoolP("encrypt", "e", false, "Encrypt the file using the pre-defined crypto data")
+	cmdSend.Flags().BoolP("direct", "d", false, "Send the file directly to the receiver on the local network")
+	cmdSend.Flags().BoolP("rendezvous", "r", false, "Publish a rendezvous record via the relay so the receiver can connect directly, uploading via the relay if it does not")
+	cmdSend.Flags().BoolP("pake", "p", false, "Encrypt the file using a key exchanged with the receiver via the code, no crypto data required")
+	cmdSend.Flags().StringSliceP("to", "t", []string{}, "Encrypt the file to the recipients' public keys, either names from the recipients list or age public keys")
+	cmdSend.Flags().Bool("passphrase", false, "Encrypt the file using a one-off passphrase, no crypto data required")
+	cmdSend.Flags().Bool("add-passphrase", false, "Also allow the file to be decrypted using a one-off passphrase, requires the encrypt parameter")
+	cmdSend.Flags().Bool("pad", false, "Pad the encrypted file to hide its exact size, requires the encrypt, pake or passphrase parameter")
+	cmdSend.Flags().String("pgp", "", "Encrypt the file to the OpenPGP public keys in the keyring file e.g. for GnuPG users")
+	cmdSend.Flags().String("pgp-sign", "", "Sign the file using the OpenPGP secret key in the keyring file, requires the pgp parameter")
+	cmdSend.Flags().Int64("chunk-size", 0, "Upload the file as chunks of the size in MiB, which are uploaded in parallel")
+	cmdSend.Flags().Int("parallel", CHUNK_WORKERS, "The number of chunks uploaded in parallel, requires the chunk-size parameter")
+	cmdSend.Flags().Bool("stream", false, "Upload the file as segments, so the receiver can start receiving the file before the upload completes")
+	cmdSend.Flags().Bool("resume", false, "Continue an interrupted upload of the file, from the last byte stored by the relay")
+	cmdSend.Flags().DurationP("wait", "w", RENDEZVOUS_WAIT, "How long to wait for a direct connection before uploading via the relay")
 	cmdRoot.AddCommand(cmdSend)
 }
 
@@ -58,19 +83,148 @@ func send(cmd *cobra.Command, args []string) {
 
 	sendFile := args[0]
 
-	_, gdrive := drive.InitialiseGoogleDrive()
+	resume, err := cmd.Flags().GetBool("resume")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	if resume == true {
+		resumeSend(cmd, sendFile)
+		return
+	}
 
 	encrypt, err := cmd.Flags().GetBool("encrypt")
 	if err != nil {
 		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
 	}
 
-	var password []byte
-	var iv []byte
-	var ivHex string
+	direct, err := cmd.Flags().GetBool("direct")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	rendezvous, err := cmd.Flags().GetBool("rendezvous")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	wait, err := cmd.Flags().GetDuration("wait")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	pake, err := cmd.Flags().GetBool("pake")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	to, err := cmd.Flags().GetStringSlice("to")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	if pake == true && (encrypt == true || direct == true || rendezvous == true) {
+		helper.OutputAndExit("The pake parameter cannot be combined with the encrypt, direct or rendezvous parameters")
+	}
+
+	pgp, err := cmd.Flags().GetString("pgp")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	pgpSign, err := cmd.Flags().GetString("pgp-sign")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	if len(to) > 0 && (encrypt == true || pake == true) {
+		helper.OutputAndExit("The to parameter cannot be combined with the encrypt or pake parameters")
+	}
+
+	if len(pgp) > 0 && (encrypt == true || pake == true || len(to) > 0) {
+		helper.OutputAndExit("The pgp parameter cannot be combined with the encrypt, pake or to parameters")
+	}
+
+	if len(pgpSign) > 0 && len(pgp) == 0 {
+		helper.OutputAndExit("The pgp-sign parameter requires the pgp parameter")
+	}
+
+	passphrase, err := cmd.Flags().GetBool("passphrase")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	if passphrase == true && (encrypt == true || pake == true || len(to) > 0 || len(pgp) > 0) {
+		helper.OutputAndExit("The passphrase parameter cannot be combined with the encrypt, pake, to or pgp parameters")
+	}
+
+	pad, err := cmd.Flags().GetBool("pad")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	if pad == true && encrypt == false && pake == false && passphrase == false {
+		helper.OutputAndExit("The pad parameter requires the encrypt, pake or passphrase parameter")
+	}
+
+	addPassphrase, err := cmd.Flags().GetBool("add-passphrase")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	if addPassphrase == true && encrypt == false {
+		helper.OutputAndExit("The add-passphrase parameter requires the encrypt parameter")
+	}
+
+	chunkSize, err := cmd.Flags().GetInt64("chunk-size")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	parallel, err := cmd.Flags().GetInt("parallel")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	if chunkSize < 0 || parallel < 1 {
+		helper.OutputAndExit("The chunk-size parameter cannot be negative, and the parallel parameter must be at least one")
+	}
+
+	if cmd.Flags().Changed("parallel") == true && chunkSize == 0 {
+		helper.OutputAndExit("The parallel parameter requires the chunk-size parameter")
+	}
+
+	if chunkSize > 0 && direct == true {
+		helper.OutputAndExit("The chunk-size parameter cannot be combined with the direct parameter")
+	}
+
+	stream, err := cmd.Flags().GetBool("stream")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	if stream == true && (chunkSize > 0 || direct == true) {
+		helper.OutputAndExit("The stream parameter cannot be combined with the chunk-size or direct parameters")
+	}
+
+	var recipients []age.Recipient
+	if len(to) > 0 {
+		recipients = getRecipients(to)
+	}
+
+	var pgpKeys openpgp.EntityList
+	var pgpSigner *openpgp.Entity
+	if len(pgp) > 0 {
+		pgpKeys = readKeyRing(pgp)
+		if len(pgpSign) > 0 {
+			pgpSigner = getPGPSigner(pgpSign)
+		}
+	}
+
+	var key []byte
 	if encrypt == true {
 		fmt.Printf("Enter password: ")
-		password, err = gopass.GetPasswd()
+		password, err := gopass.GetPasswd()
 		fmt.Println("")
 		if err != nil {
 			helper.OutputAndExit("Error reading password")
@@ -79,12 +233,66 @@ func send(cmd *cobra.Command, args []string) {
 			helper.OutputAndExit("Password not supplied")
 		}
 
-		// Compute a unique IV for the file.
-		iv = getRandomBytes(aes.BlockSize)
-		ivHex = hex.EncodeToString(iv)
+		key = crypto.DecryptEncryptionKey(string(password))
 	}
 
-	fileReader, length, err := getFileContentsReaderForUpload(string(password), sendFile, encrypt, iv)
+	mnemonicode := generateMnemonic()
+
+	// Define the meta data
+	md := make(map[string]string, 0)
+	md[relay.KEY_CODE] = mnemonicode
+	md[relay.KEY_FILE_NAME] = filepath.Base(sendFile)
+	if encrypt == true {
+		md[relay.KEY_KEY_ID] = crypto.KeyID(key)
+		key = wrapDataKey(md, key, addPassphrase)
+	}
+
+	// The data key is only wrapped by the passphrase, so the receiver
+	// only needs the passphrase to decrypt the file
+	if passphrase == true {
+		key = newDataKey()
+		wrapDataKeyWithPassphrase(md, key)
+	}
+
+	var r relay.Relay
+	if pake == true {
+		// The PAKE code is longer, only the first part is stored on the relay to
+		// locate the transfer, the full code is the password for the key exchange
+		mnemonicode = mnemonicode + "-" + generateMnemonic()
+
+		r = getRelay(cmd)
+		p := sendPake(r, mnemonicode, "filesender r")
+		key = p.SessionKey()
+		md[relay.KEY_PAKE] = hex.EncodeToString(p.Confirmation())
+	}
+
+	var iv []byte
+	if key != nil {
+		// Compute a unique IV for the file. The file name is encrypted in the
+		// envelope along with the file contents, rather than stored in the meta data
+		iv = getRandomBytes(crypto.STREAM_SALT_SIZE)
+		md[relay.KEY_FORMAT] = crypto.FORMAT_ENVELOPE
+		delete(md, relay.KEY_FILE_NAME)
+	}
+
+	if recipients != nil {
+		md[relay.KEY_FORMAT] = crypto.FORMAT_AGE
+	}
+
+	if pgpKeys != nil {
+		md[relay.KEY_FORMAT] = crypto.FORMAT_PGP
+	}
+
+	// The SHA-256 of the file contents is calculated as the file is read, and
+	// stored in the meta data once sent so that the receiver can verify the file
+	fileHash := sha256.New()
+	var fileReader io.ReadCloser
+	var length int64
+	if pgpKeys != nil {
+		fileReader, length, err = getPGPReaderForUpload(pgpKeys, pgpSigner, sendFile, fileHash)
+	} else {
+		fileReader, length, err = getFileContentsReaderForUpload(key, recipients, sendFile, iv, pad, fileHash)
+	}
 	if err != nil {
 		helper.OutputAndExit(fmt.Sprintf("Error reading file contents: %v", err))
 	}
@@ -92,20 +300,73 @@ func send(cmd *cobra.Command, args []string) {
 
 	fmt.Printf("Sending %s file: %s\n", byteCountIEC(length), sendFile)
 
-	// Generate a GUID/UUID, which is used as a file name in google drive,
-	// this is designed to overcome file name clashes
-	guid, err := uuid.NewV4()
-	if err != nil {
-		helper.OutputAndExit(fmt.Sprintf("Failed to generate UUID: %v", err))
+	if direct == true {
+		sendDirect(mnemonicode, md, length, fileReader, fileHash)
+		return
 	}
 
-	mnemonicode := generateMnemonic()
+	if r == nil {
+		r = getRelay(cmd)
+	}
+
+	if rendezvous == true {
+		if sendRendezvous(r, mnemonicode, md, length, fileReader, fileHash, wait) == true {
+			return
+		}
+
+		fmt.Printf("Receiver did not connect directly, uploading via the relay\n")
+	}
+
+	guid := generateGUID()
+
+	if stream == true {
+		uploadStream(r, guid.String(), md, length, fileReader, fileHash)
+		return
+	}
+
+	if chunkSize > 0 {
+		uploadChunks(r, guid.String(), md, length, fileReader, fileHash, chunkSize*1024*1024, parallel)
+		printSendCode(mnemonicode, pake)
+		return
+	}
+
+	// The upload is resumable if the backend supports it, and the upload contents can be
+	// generated again, so not if encrypted using the PAKE session key or random age or
+	// OpenPGP file keys, which are not kept
+	var u *config.Upload
+	if _, ok := r.(relay.Resumer); ok == true && pake == false && recipients == nil && pgpKeys == nil {
+		u = &config.Upload{
+			Path:     sendFile,
+			Hash:     getUploadHash(sendFile),
+			Name:     guid.String(),
+			Size:     length,
+			IV:       hex.EncodeToString(iv),
+			Pad:      pad,
+			Metadata: md,
+			Started:  time.Now().Format(time.RFC3339),
+		}
+	}
+
+	uploadFile(r, guid.String(), md, length, fileReader, fileHash, u)
+	printSendCode(mnemonicode, pake)
+}
+
+// printSendCode outputs the code the receiver uses to receive the file, the
+// receiver of a PAKE transfer already has the code
+func printSendCode(mnemonicode string, pake bool) {
+
+	if pake == true {
+		fmt.Printf("\nUploaded file for the receiver\n")
+		return
+	}
+
+	fmt.Printf("\nCode is: %s\n", mnemonicode)
+	fmt.Printf("On the other computer run: filesender r %s\n", mnemonicode)
+}
 
-	// Define the AppProperties meta data
-	ap := make(map[string]string, 0)
-	ap["mnemonicode"] = mnemonicode
-	ap["file_name"] = sendFile
-	ap["iv"] = ivHex
+// uploadFile uploads the file contents to the relay, using the resumable upload state if
+// supplied, and then verifies the upload, signs it and stores the checksum
+func uploadFile(r relay.Relay, name string, md map[string]string, length int64, fileReader io.Reader, fileHash hash.Hash, u *config.Upload) {
 
 	// Also tee reads to the progress bar as they are done so that it
 	// stays in sync with how much data has been transmitted.
@@ -113,15 +374,200 @@ func send(cmd *cobra.Command, args []string) {
 	progressBar := getProgressBar(length)
 	reader := io.TeeReader(cr, progressBar)
 
-	_, err = gdrive.PutFile("filesender/"+guid.String(), ap, reader)
-	if err != nil {
-		helper.OutputAndExit(fmt.Sprintf("Failed to upload file: %v", err))
+	// Backends that calculate an MD5 checksum of the stored contents
+	// are verified against the MD5 checksum of the bytes sent
+	md5Hash := md5.New()
+	reader = io.TeeReader(reader, md5Hash)
+
+	var obj *relay.Object
+	var err error
+	if u != nil {
+		obj = putResumable(r.(relay.Resumer), u, reader)
+
+		// The upload cannot be resumed once it has completed
+		removeUpload(u)
+	} else {
+		obj, err = r.Put(name, md, length, reader)
+		if err != nil {
+			helper.OutputAndExit(fmt.Sprintf("Failed to upload file: %v", err))
+		}
 	}
 
 	progressBar.Finish()
 
+	verifyUpload(r, obj, hex.EncodeToString(md5Hash.Sum(nil)))
+
+	storeChecksum(r, md, obj, fileHash)
+}
+
+// storeChecksum signs the upload, and stores the checksum of the file contents in the meta
+// data. The manifest is stored before the checksum, as the receiver waits for the checksum
+// before downloading the file
+func storeChecksum(r relay.Relay, md map[string]string, obj *relay.Object, fileHash hash.Hash) {
+
+	sum := hex.EncodeToString(fileHash.Sum(nil))
+	signUpload(r, md[relay.KEY_CODE], obj, sum)
+
+	err := r.SetMetadata(obj, map[string]string{relay.KEY_SHA256: sum})
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to store file checksum: %v", err))
+	}
+}
+
+// verifyUpload compares the MD5 checksum calculated by the backend (if supported) with
+// the MD5 checksum of the bytes sent, and removes the uploaded file if they do not match
+func verifyUpload(r relay.Relay, obj *relay.Object, sum string) {
+
+	err := checkUpload(r, obj, sum)
+	if err != nil {
+		helper.OutputAndExit(err.Error())
+	}
+}
+
+// checkUpload is verifyUpload returning the error, for uploads that clean up on failure
+func checkUpload(r relay.Relay, obj *relay.Object, sum string) error {
+
+	cs, ok := r.(relay.Checksummer)
+	if ok == false {
+		return nil
+	}
+
+	remoteSum, err := cs.MD5(obj)
+	if err != nil {
+		return fmt.Errorf("Failed to retrieve uploaded file checksum: %v", err)
+	}
+
+	if remoteSum != sum {
+		derr := r.Delete(obj)
+		if derr != nil {
+			fmt.Printf("Failed to delete uploaded file: %v\n", derr)
+		}
+		return fmt.Errorf("Uploaded file checksum [%s] does not match the file sent [%s]", remoteSum, sum)
+	}
+
+	return nil
+}
+
+// sendDirect waits for the receiver to connect via the local network
+// and then streams the file contents directly to the receiver
+func sendDirect(mnemonicode string, md map[string]string, length int64, fileReader io.Reader, fileHash hash.Hash) {
+
+	l, port, err := direct.Listen()
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to listen for direct connections: %v", err))
+	}
+	defer l.Close()
+
+	stop := make(chan struct{})
+	err = direct.Announce(port, stop)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to announce on the local network: %v", err))
+	}
+
+	fmt.Printf("\nCode is: %s\n", mnemonicode)
+	fmt.Printf("On the other computer run: filesender r -d %s\n", mnemonicode)
+
+	conn, err := direct.Accept(l, mnemonicode, 0)
+	close(stop)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to accept direct connection: %v", err))
+	}
+	defer conn.Close()
+
+	streamDirect(conn, md, length, fileReader, fileHash)
+}
+
+// sendRendezvous publishes a rendezvous record via the relay and waits for the
+// receiver to connect directly, streaming the file contents to the receiver if it
+// does. Returns false if the receiver did not connect within the wait period
+func sendRendezvous(r relay.Relay, mnemonicode string, md map[string]string, length int64, fileReader io.Reader, fileHash hash.Hash, wait time.Duration) bool {
+
+	l, port, err := direct.Listen()
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to listen for direct connections: %v", err))
+	}
+	defer l.Close()
+
+	rv, err := direct.NewRendezvous(port)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to create rendezvous record: %v", err))
+	}
+
+	obj := putRecord(r, mnemonicode, relay.KIND_RENDEZVOUS, rv.Bytes())
+
 	fmt.Printf("\nCode is: %s\n", mnemonicode)
 	fmt.Printf("On the other computer run: filesender r %s\n", mnemonicode)
+	fmt.Printf("Waiting %s for the receiver to connect directly\n", wait)
+
+	conn, err := direct.Accept(l, rv.Secret(mnemonicode), wait)
+
+	// The record is no longer required, whether or not the receiver connected
+	derr := r.Delete(obj)
+	if derr != nil {
+		fmt.Printf("Failed to delete rendezvous record: %v\n", derr)
+	}
+
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	streamDirect(conn, md, length, fileReader, fileHash)
+	return true
+}
+
+// streamDirect sends the file meta data, contents, checksum and signed manifest over
+// the direct connection, and waits for the receiver to confirm that the file has been received
+func streamDirect(conn *direct.Conn, md map[string]string, length int64, fileReader io.Reader, fileHash hash.Hash) {
+
+	err := conn.WriteHeader(relay.NewSidecar(md, length))
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to send file meta data: %v", err))
+	}
+
+	cr := &CountingReader{R: fileReader}
+	progressBar := getProgressBar(length)
+	reader := io.TeeReader(cr, progressBar)
+
+	_, err = io.Copy(conn, reader)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to send file: %v", err))
+	}
+
+	sum := hex.EncodeToString(fileHash.Sum(nil))
+	err = conn.WriteChecksum(sum)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to send file checksum: %v", err))
+	}
+
+	// The manifest is signed as for uploads, the transfer ID identifies the transfer
+	// in the receiver's record of the transfers received
+	data := signManifest(generateGUID().String(), md[relay.KEY_CODE], md[relay.KEY_FILE_NAME], length, sum)
+	err = conn.WriteManifest(data)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to send file manifest: %v", err))
+	}
+
+	err = conn.ReadAck()
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Receiver did not confirm the file was received: %v", err))
+	}
+
+	progressBar.Finish()
+
+	fmt.Printf("Sent %s file directly to %s\n", byteCountIEC(cr.bytesRead), conn.RemoteAddr())
+}
+
+// generateGUID generates a GUID/UUID, which is used as a file name on
+// the relay, this is designed to overcome file name clashes
+func generateGUID() uuid.UUID {
+
+	guid, err := uuid.NewV4()
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to generate UUID: %v", err))
+	}
+
+	return guid
 }
 
 //
@@ -135,11 +581,15 @@ func generateMnemonic() string {
 }
 
 // Returns an io.ReadCloser for given file, such that the bytes read are
-// ready for upload: specifically, if encryption is enabled, the contents
-// are encrypted with the given key and the initialization vector is
-// prepended to the returned bytes. Otherwise, the contents of the file are
-// returned directly.
-func getFileContentsReaderForUpload(password string, path string, encrypt bool, iv []byte) (io.ReadCloser, int64, error) {
+// ready for upload: specifically, if a key is supplied, the file meta data
+// and contents are encrypted with the given key using the envelope format, and
+// optionally padded, and the salt/initialization vector is prepended to the
+// returned bytes. If recipients are supplied, the contents are encrypted to the
+// recipients in the age format. Otherwise, the contents of the file are returned
+// directly. The file contents are written to fileHash as they are read, apart
+// from the envelope format, where the encrypted bytes are written so that the
+// checksum does not reveal the file contents.
+func getFileContentsReaderForUpload(key []byte, recipients []age.Recipient, path string, iv []byte, pad bool, fileHash io.Writer) (io.ReadCloser, int64, error) {
 
 	f, err := os.Open(path)
 	if err != nil {
@@ -152,18 +602,78 @@ func getFileContentsReaderForUpload(password string, path string, encrypt bool,
 	}
 	fileSize := stat.Size()
 
-	if encrypt {
-		key := crypto.DecryptEncryptionKey(password)
-		r := crypto.MakeEncrypterReader(key, iv, f)
+	if key != nil {
+		e := &crypto.Envelope{FileName: filepath.Base(path), Size: fileSize, Mode: uint32(stat.Mode().Perm())}
+		r, length, err := crypto.NewEnvelopeEncrypter(key, iv, e, f, pad)
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r, fileHash), f}, length, nil
+	}
 
-		// Prepend the initialization vector to the returned bytes.
-		r = io.MultiReader(bytes.NewReader(iv[:aes.BlockSize]), r)
+	var r io.Reader = io.TeeReader(f, fileHash)
+	if recipients != nil {
+		r, length, err := crypto.NewAgeEncrypter(recipients, r, fileSize)
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
 
-		readCloser := struct {
+		return struct {
 			io.Reader
 			io.Closer
-		}{r, f}
-		return readCloser, fileSize + aes.BlockSize, nil
+		}{r, f}, length, nil
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, fileSize, nil
+}
+
+// wrapDataKey generates the random data key used to encrypt the file, and stores it
+// in the meta data wrapped by the encryption key, and optionally by a one-off passphrase
+func wrapDataKey(md map[string]string, key []byte, addPassphrase bool) []byte {
+
+	dataKey := newDataKey()
+
+	wrapped, err := crypto.WrapDataKey(key, dataKey)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to wrap data key: %v", err))
+	}
+	md[relay.KEY_WRAPPED_KEY] = wrapped
+
+	if addPassphrase == true {
+		wrapDataKeyWithPassphrase(md, dataKey)
+	}
+
+	return dataKey
+}
+
+// newDataKey generates the random data key used to encrypt the file
+func newDataKey() []byte {
+
+	dataKey, err := crypto.NewDataKey()
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to generate data key: %v", err))
+	}
+
+	return dataKey
+}
+
+// wrapDataKeyWithPassphrase prompts for a one-off passphrase, and stores the data key in
+// the meta data wrapped by a key derived from the passphrase and a random salt
+func wrapDataKeyWithPassphrase(md map[string]string, dataKey []byte) {
+
+	fmt.Printf("Enter the one-off passphrase for the file\n")
+	wrapped, err := crypto.WrapDataKeyWithPassphrase(getPassword(), dataKey)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to wrap data key: %v", err))
 	}
-	return f, fileSize, nil
+	md[relay.KEY_PASSPHRASE_KEY] = wrapped
 }
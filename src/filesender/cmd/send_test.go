@@ -0,0 +1,307 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	config "filesender/config"
+	memory "filesender/memory"
+	relay "filesender/relay"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// ##### Variables ###########################################################
+
+// memoryRelay is shared by the commands run within the test process
+var memoryRelay = memory.New()
+
+// ##### Functions ###########################################################
+
+// init runs the commands against the memory relay rather than the configured backend
+func init() {
+
+	relayFactory = func() relay.Relay {
+
+		return memoryRelay
+	}
+}
+
+// runCommand runs the command in the directory against the memory relay, with the
+// input supplied on stdin e.g. passwords, and returns the output written to stdout
+func runCommand(t *testing.T, dir string, input string, args ...string) string {
+
+	t.Helper()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	stdin, stdout := os.Stdin, os.Stdout
+	defer func() {
+
+		os.Stdin, os.Stdout = stdin, stdout
+	}()
+
+	inReader, inWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inReader.Close()
+	go func() {
+
+		inWriter.Write([]byte(input))
+		inWriter.Close()
+	}()
+
+	outReader, outWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := make(chan string)
+	go func() {
+
+		data, _ := ioutil.ReadAll(outReader)
+		output <- string(data)
+	}()
+
+	os.Stdin, os.Stdout = inReader, outWriter
+
+	resetFlags(cmdRoot)
+	cmdRoot.SetArgs(args)
+	err = cmdRoot.Execute()
+
+	outWriter.Close()
+	out := <-output
+	if err != nil {
+		t.Fatalf("%s failed: %v\n%s", strings.Join(args, " "), err, out)
+	}
+
+	return out
+}
+
+// resetFlags sets the flags of the command and its sub commands back to their defaults,
+// as the flag values are kept between runs of the command
+func resetFlags(cmd *cobra.Command) {
+
+	reset := func(f *pflag.Flag) {
+
+		if f.Changed == true && strings.HasSuffix(f.Value.Type(), "Slice") == false {
+			f.Value.Set(f.DefValue)
+			f.Changed = false
+		}
+	}
+
+	cmd.Flags().VisitAll(reset)
+	cmd.PersistentFlags().VisitAll(reset)
+	for _, c := range cmd.Commands() {
+		resetFlags(c)
+	}
+}
+
+// newTransfer creates the sender and receiver directories, and the file to send
+func newTransfer(t *testing.T, size int) (string, string, []byte) {
+
+	t.Helper()
+
+	base, err := ioutil.TempDir("", "filesender")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender := filepath.Join(base, "sender")
+	receiver := filepath.Join(base, "receiver")
+	for _, dir := range []string{sender, receiver} {
+		err = os.Mkdir(dir, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := make([]byte, size)
+	rand.Read(data)
+
+	err = ioutil.WriteFile(filepath.Join(sender, "data.bin"), data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sender, receiver, data
+}
+
+// sendCode returns the code output by the send command
+func sendCode(t *testing.T, output string) string {
+
+	t.Helper()
+
+	m := regexp.MustCompile(`Code is: (\S+)`).FindStringSubmatch(output)
+	if m == nil {
+		t.Fatalf("No code in the send output:\n%s", output)
+	}
+
+	return m[1]
+}
+
+// checkReceived compares the received file with the file sent, and checks
+// that the receiver has removed every object from the relay
+func checkReceived(t *testing.T, receiver string, data []byte) {
+
+	t.Helper()
+
+	received, err := ioutil.ReadFile(filepath.Join(receiver, "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(received, data) == false {
+		t.Fatalf("Received file does not match the file sent")
+	}
+
+	count := 0
+	memoryRelay.List(func(obj *relay.Object) error {
+
+		count++
+		return nil
+	})
+	if count != 0 {
+		t.Fatalf("Receiver left %d objects on the relay", count)
+	}
+
+	_, err = os.Stat(filepath.Join(receiver, "data.bin"+PARTIAL_EXT))
+	if os.IsNotExist(err) == false {
+		t.Fatalf("Receiver left the partial file")
+	}
+}
+
+// generateCrypto generates the crypto data in the sender directory, and copies it to the receiver
+func generateCrypto(t *testing.T, sender string, receiver string, password string) {
+
+	t.Helper()
+
+	runCommand(t, sender, password+"\n"+password+"\n", "generate", "-t", "1ms")
+
+	data, err := ioutil.ReadFile(filepath.Join(sender, config.CRYPTO_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(receiver, config.CRYPTO_FILE), data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSendReceive sends the file without encryption, and receives it
+func TestSendReceive(t *testing.T) {
+
+	sender, receiver, data := newTransfer(t, 300*1024)
+	defer os.RemoveAll(filepath.Dir(sender))
+
+	code := sendCode(t, runCommand(t, sender, "", "send", "data.bin"))
+	out := runCommand(t, receiver, "", "receive", code)
+
+	if strings.Contains(out, "Verified SHA-256 checksum") == false {
+		t.Fatalf("Received file was not verified:\n%s", out)
+	}
+
+	checkReceived(t, receiver, data)
+}
+
+// TestSendReceiveEncrypted sends the file encrypted using the crypto data, with and without padding
+func TestSendReceiveEncrypted(t *testing.T) {
+
+	for _, args := range [][]string{{"-e"}, {"-e", "--pad"}} {
+		sender, receiver, data := newTransfer(t, 2*1024*1024+17)
+		defer os.RemoveAll(filepath.Dir(sender))
+
+		generateCrypto(t, sender, receiver, "pw")
+
+		code := sendCode(t, runCommand(t, sender, "pw\n", append([]string{"send", "data.bin"}, args...)...))
+		runCommand(t, receiver, "pw\n", "receive", code)
+
+		checkReceived(t, receiver, data)
+	}
+}
+
+// TestSendReceivePassphrase sends the file encrypted using a one-off passphrase
+func TestSendReceivePassphrase(t *testing.T) {
+
+	sender, receiver, data := newTransfer(t, 64*1024)
+	defer os.RemoveAll(filepath.Dir(sender))
+
+	code := sendCode(t, runCommand(t, sender, "secret\nsecret\n", "send", "data.bin", "--passphrase"))
+	runCommand(t, receiver, "secret\n", "receive", code)
+
+	checkReceived(t, receiver, data)
+}
+
+// TestSendFileName checks that only the base name of the file is stored in the meta data
+func TestSendFileName(t *testing.T) {
+
+	sender, receiver, data := newTransfer(t, 1024)
+	defer os.RemoveAll(filepath.Dir(sender))
+
+	code := sendCode(t, runCommand(t, filepath.Dir(sender), "", "send", filepath.Join("sender", "data.bin")))
+
+	objs, err := memoryRelay.Find(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, obj := range objs {
+		if obj.Kind() == "" && obj.Metadata[relay.KEY_FILE_NAME] != "data.bin" {
+			t.Fatalf("Unexpected file name in the meta data: %s", obj.Metadata[relay.KEY_FILE_NAME])
+		}
+	}
+
+	runCommand(t, receiver, "", "receive", code)
+	checkReceived(t, receiver, data)
+}
+
+// TestSendReceiveChunks sends the file as chunks uploaded in parallel
+func TestSendReceiveChunks(t *testing.T) {
+
+	sender, receiver, data := newTransfer(t, 5*1024*1024/2)
+	defer os.RemoveAll(filepath.Dir(sender))
+
+	code := sendCode(t, runCommand(t, sender, "", "send", "data.bin", "--chunk-size", "1", "--parallel", "2"))
+	runCommand(t, receiver, "", "receive", code, "--parallel", "3")
+
+	checkReceived(t, receiver, data)
+}
+
+// TestSendReceiveStream sends the file as segments, which are received once the upload completes
+func TestSendReceiveStream(t *testing.T) {
+
+	sender, receiver, data := newTransfer(t, 100*1024)
+	defer os.RemoveAll(filepath.Dir(sender))
+
+	code := sendCode(t, runCommand(t, sender, "", "send", "data.bin", "--stream"))
+	runCommand(t, receiver, "", "receive", code)
+
+	checkReceived(t, receiver, data)
+}
+
+// TestReceiveNoFile checks that receive reports that there is no file for an unknown code
+func TestReceiveNoFile(t *testing.T) {
+
+	_, receiver, _ := newTransfer(t, 0)
+	defer os.RemoveAll(filepath.Dir(receiver))
+
+	out := runCommand(t, receiver, "", "receive", "unknown-code-words")
+	if strings.Contains(out, "Unable to locate file") == false {
+		t.Fatalf("Unexpected output for an unknown code:\n%s", out)
+	}
+}
@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	config "filesender/config"
+	crypto "filesender/crypto"
+	helper "filesender/utils"
+
+	"github.com/spf13/cobra"
+)
+
+// ##### Variables ###########################################################
+
+var cmdSlot = &cobra.Command{
+	Use:   "slot",
+	Short: "Manages the crypto data key slots",
+	Long:  `Manages the key slots, which allow the crypto data to be unlocked by several passwords e.g. one per person sharing the encryption key`,
+}
+
+var cmdSlotAdd = &cobra.Command{
+	Use:   "add [name]",
+	Short: "Adds a key slot",
+	Long:  `Adds a key slot with a new password, an existing password is required to unlock the crypto data`,
+	Run:   slotAdd,
+	Args: func(cmd *cobra.Command, args []string) error {
+
+		if len(args) != 1 {
+			return errors.New("Requires the slot name")
+		}
+
+		return nil
+	},
+}
+
+var cmdSlotList = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the key slots",
+	Long:  `Lists the key slots and their key derivation functions`,
+	Run:   slotList,
+}
+
+var cmdSlotRemove = &cobra.Command{
+	Use:   "remove [name]",
+	Short: "Removes a key slot",
+	Long:  `Removes a key slot, a password is required to unlock the crypto data and the last slot cannot be removed`,
+	Run:   slotRemove,
+	Args: func(cmd *cobra.Command, args []string) error {
+
+		if len(args) != 1 {
+			return errors.New("Requires the slot name")
+		}
+
+		return nil
+	},
+}
+
+// ##### Functions ###########################################################
+
+// Add the command to the cobra setup
+func init() {
+
+	cmdSlotAdd.Flags().StringP("kdf", "k", crypto.DEFAULT_KDF, "Key derivation function used to protect the key: argon2id, scrypt or pbkdf2")
+	cmdSlotAdd.Flags().DurationP("time", "t", crypto.DEFAULT_KDF_TIME, "Target time to unlock the key, used to calibrate the key derivation cost")
+
+	cmdSlot.AddCommand(cmdSlotAdd)
+	cmdSlot.AddCommand(cmdSlotList)
+	cmdSlot.AddCommand(cmdSlotRemove)
+	cmdRoot.AddCommand(cmdSlot)
+}
+
+// slotAdd performs the adding of a key slot
+func slotAdd(cmd *cobra.Command, args []string) {
+
+	algorithm, err := cmd.Flags().GetString("kdf")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	target, err := cmd.Flags().GetDuration("time")
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading command line parameters: %v", err))
+	}
+
+	keyring := unlockKeyring()
+
+	kdf := calibrateKDF(algorithm, target)
+
+	fmt.Printf("Enter the password for slot %s\n", args[0])
+	password := getPassword()
+
+	err = keyring.AddSlot(args[0], password, kdf)
+	if err != nil {
+		helper.OutputAndExit(err.Error())
+	}
+	keyring.Save()
+
+	fmt.Printf("Slot %s added\n", args[0])
+}
+
+// slotList performs the listing of the key slots
+func slotList(cmd *cobra.Command, args []string) {
+
+	c := new(config.Config)
+	c.Initialise()
+	c.Load()
+
+	for _, slot := range c.GetSlots() {
+		algorithm := slot.KDF.Algorithm
+		if len(algorithm) == 0 {
+			algorithm = crypto.KDF_PBKDF2
+		}
+
+		fmt.Printf("%s\t%s\n", slot.Name, algorithm)
+	}
+}
+
+// slotRemove performs the removal of a key slot
+func slotRemove(cmd *cobra.Command, args []string) {
+
+	keyring := unlockKeyring()
+
+	err := keyring.RemoveSlot(args[0])
+	if err != nil {
+		helper.OutputAndExit(err.Error())
+	}
+	keyring.Save()
+
+	fmt.Printf("Slot %s removed\n", args[0])
+}
+
+// calibrateKDF determines the KDF cost parameters for this computer
+func calibrateKDF(algorithm string, target time.Duration) config.KDF {
+
+	fmt.Printf("Calibrating %s to take %s\n", algorithm, target)
+	kdf, err := crypto.CalibrateKDF(algorithm, target)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Unable to calibrate key derivation: %v", err))
+	}
+
+	return kdf
+}
@@ -0,0 +1,218 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"time"
+
+	crypto "filesender/crypto"
+	relay "filesender/relay"
+	helper "filesender/utils"
+)
+
+// ##### Constants ###########################################################
+
+// SEGMENT_SIZE is the size of each segment of a streamed upload
+const SEGMENT_SIZE int64 = 16 * 1024 * 1024
+
+// STREAM_POLL_INTERVAL is how often the receiver checks for the next segment
+const STREAM_POLL_INTERVAL time.Duration = 2 * time.Second
+
+// STREAM_TIMEOUT is how long the receiver waits for the sender to upload the next segment
+const STREAM_TIMEOUT time.Duration = 10 * time.Minute
+
+// ##### Structs #############################################################
+
+// segmentReader reads the segments of a streamed upload in order, waiting for each segment
+// to be uploaded, and deleting each segment once it has been read unless it is left on the relay
+type segmentReader struct {
+	r       relay.Relay
+	obj     *relay.Object
+	leave   bool
+	index   int
+	segment *relay.Object
+	current io.ReadCloser
+}
+
+// ##### Functions ###########################################################
+
+// uploadStream uploads the object holding the meta data, followed by the file contents as
+// numbered segments, so that the receiver can download each segment as it is uploaded. The
+// number of segments uploaded is updated in the meta data as each segment is uploaded, and
+// the checksum is stored once all of the segments have been uploaded
+func uploadStream(r relay.Relay, name string, md map[string]string, length int64, fileReader io.Reader, fileHash hash.Hash) {
+
+	md[relay.KEY_SEGMENTS] = "0"
+	md[relay.KEY_SIZE] = strconv.FormatInt(length, 10)
+
+	obj, err := r.Put(name, md, 0, bytes.NewReader(nil))
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Failed to upload file: %v", err))
+	}
+
+	// The code is output before the upload, so that the receiver can start straight away
+	if len(md[relay.KEY_PAKE]) == 0 {
+		fmt.Printf("\nCode is: %s\n", md[relay.KEY_CODE])
+		fmt.Printf("On the other computer run: filesender r %s\n\n", md[relay.KEY_CODE])
+	}
+
+	progressBar := getProgressBar(length)
+
+	data := make([]byte, SEGMENT_SIZE)
+	for count := 0; ; count++ {
+		n, err := io.ReadFull(fileReader, data)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			helper.OutputAndExit(fmt.Sprintf("Error reading file contents: %v", err))
+		}
+
+		_, err = putChunk(r, md[relay.KEY_CODE], relay.KIND_SEGMENT, relay.ChunkName(name, count), data[:n], progressBar)
+		if err != nil {
+			helper.OutputAndExit(err.Error())
+		}
+
+		err = r.SetMetadata(obj, map[string]string{relay.KEY_SEGMENTS: strconv.Itoa(count + 1)})
+		if err != nil {
+			helper.OutputAndExit(fmt.Sprintf("Failed to store upload progress: %v", err))
+		}
+
+		if int64(n) < SEGMENT_SIZE {
+			break
+		}
+	}
+
+	progressBar.Finish()
+
+	storeChecksum(r, md, obj, fileHash)
+
+	fmt.Printf("\nUploaded file for the receiver\n")
+}
+
+// isStream returns true if the object holds the meta data of a streamed upload
+func isStream(obj *relay.Object) bool {
+
+	return len(obj.Metadata[relay.KEY_SEGMENTS]) > 0
+}
+
+// receiveStream follows the segments of the streamed upload as they are uploaded, and
+// receives them as a single file. The checksum is only stored once the upload completes,
+// the meta data is updated in place so that the file is still verified
+func receiveStream(r relay.Relay, obj *relay.Object, p *crypto.Pake, opts *receiveOptions) (string, string) {
+
+	size, err := strconv.ParseInt(obj.Metadata[relay.KEY_SIZE], 10, 64)
+	if err != nil {
+		helper.OutputAndExit("File does not contain the size of the stream")
+	}
+
+	return receiveFile(obj.Metadata, size, &segmentReader{r: r, obj: obj, leave: opts.leave}, p, opts)
+}
+
+// ##### Methods #############################################################
+
+// Read reads the current segment, and then waits for the next segment to be uploaded
+func (s *segmentReader) Read(p []byte) (int, error) {
+
+	for {
+		if s.current != nil {
+			n, err := s.current.Read(p)
+			if err != io.EOF {
+				return n, err
+			}
+
+			err = s.consume()
+			if err != nil {
+				return n, err
+			}
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+
+		segment, err := s.next()
+		if err != nil {
+			return 0, err
+		}
+		if segment == nil {
+			return 0, io.EOF
+		}
+
+		s.current, err = s.r.Open(segment)
+		if err != nil {
+			return 0, err
+		}
+		s.segment = segment
+	}
+}
+
+// consume closes the segment that has been read, and deletes it from the relay
+func (s *segmentReader) consume() error {
+
+	s.current.Close()
+	s.current = nil
+	s.index++
+
+	if s.leave == true {
+		return nil
+	}
+
+	return s.r.Delete(s.segment)
+}
+
+// next waits for the next segment to be uploaded and returns it, or nil once the upload
+// has completed and all of the segments have been read. The meta data of the object is
+// updated in place, as the number of segments and the checksum are updated by the sender
+func (s *segmentReader) next() (*relay.Object, error) {
+
+	deadline := time.Now().Add(STREAM_TIMEOUT)
+	for {
+		objs, err := s.r.Find(s.obj.Code())
+		if err != nil {
+			return nil, err
+		}
+
+		found := false
+		var segment *relay.Object
+		for _, o := range objs {
+			switch {
+			case o.Name == s.obj.Name:
+				found = true
+				for k, v := range o.Metadata {
+					s.obj.Metadata[k] = v
+				}
+			case o.Kind() == relay.KIND_SEGMENT && o.Name == relay.ChunkName(s.obj.Name, s.index):
+				segment = o
+			}
+		}
+
+		if found == false {
+			return nil, errors.New("File was removed from the relay before it was received")
+		}
+
+		count, err := strconv.Atoi(s.obj.Metadata[relay.KEY_SEGMENTS])
+		if err != nil {
+			return nil, errors.New("Invalid segment count")
+		}
+
+		// The segment may not be listed by the relay straight away
+		if s.index < count && segment != nil {
+			return segment, nil
+		}
+
+		if s.index >= count && len(s.obj.Metadata[relay.KEY_SHA256]) > 0 {
+			return nil, nil
+		}
+
+		if time.Now().After(deadline) == true {
+			return nil, errors.New("Timed out waiting for the sender to upload the next segment")
+		}
+
+		time.Sleep(STREAM_POLL_INTERVAL)
+	}
+}
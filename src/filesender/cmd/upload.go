@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	config "filesender/config"
+	crypto "filesender/crypto"
+	relay "filesender/relay"
+	helper "filesender/utils"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// ##### Constants ###########################################################
+
+// UPLOAD_HASH_SAMPLE is the number of bytes from the start and the end of the
+// file that are included in the hash identifying the file being uploaded
+const UPLOAD_HASH_SAMPLE int64 = 1024 * 1024
+
+// ##### Functions ###########################################################
+
+// resumeSend continues the interrupted upload of the file, from the last byte stored by
+// the relay, using the same code and meta data. The upload contents are generated again
+// from the start, so that the encryption stream and checksums continue from the same position
+func resumeSend(cmd *cobra.Command, sendFile string) {
+
+	// The parameters of the interrupted send are used
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+
+		if f.Name != "resume" && f.Name != "backend" {
+			helper.OutputAndExit("The resume parameter cannot be combined with other parameters, the parameters of the interrupted send are used")
+		}
+	})
+
+	uploads := new(config.Uploads)
+	uploads.Load()
+
+	u := uploads.Find(sendFile, getUploadHash(sendFile))
+	if u == nil {
+		helper.OutputAndExit("No interrupted upload of the file, or the file has changed since the upload was interrupted")
+	}
+
+	r := getRelay(cmd)
+	resumer, ok := r.(relay.Resumer)
+	if ok == false {
+		helper.OutputAndExit("The relay backend does not support resumable uploads")
+	}
+
+	offset, err := resumer.Offset(u.Session, u.Size)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Unable to resume upload, send the file again: %v", err))
+	}
+	u.Offset = offset
+
+	iv, err := hex.DecodeString(u.IV)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Invalid upload IV: %v", err))
+	}
+
+	// The data key is unwrapped using the crypto data, or the one-off passphrase
+	var key []byte
+	if u.Metadata[relay.KEY_FORMAT] == crypto.FORMAT_ENVELOPE {
+		key = getEnvelopeKey(u.Metadata, nil, &receiveOptions{})
+	}
+
+	fileHash := sha256.New()
+	fileReader, length, err := getFileContentsReaderForUpload(key, nil, sendFile, iv, u.Pad, fileHash)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading file contents: %v", err))
+	}
+	defer fileReader.Close()
+
+	if length != u.Size {
+		helper.OutputAndExit("The file has changed since the upload was interrupted, send the file again")
+	}
+
+	fmt.Printf("Resuming %s file: %s from %s\n", byteCountIEC(length), sendFile, byteCountIEC(offset))
+
+	uploadFile(r, u.Name, u.Metadata, length, fileReader, fileHash, u)
+
+	fmt.Printf("\nCode is: %s\n", u.Metadata[relay.KEY_CODE])
+	fmt.Printf("On the other computer run: filesender r %s\n", u.Metadata[relay.KEY_CODE])
+}
+
+// putResumable uploads the file contents using the resumable upload state, which is
+// saved as each part of the upload is stored, so that an interrupted upload can be resumed
+func putResumable(resumer relay.Resumer, u *config.Upload, reader io.Reader) *relay.Object {
+
+	// The contents before the offset have already been stored, but are
+	// read so that the checksums continue from the same position
+	_, err := io.CopyN(ioutil.Discard, reader, u.Offset)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading file contents: %v", err))
+	}
+
+	if len(u.Session) == 0 {
+		u.Session, err = resumer.Begin(u.Name, u.Metadata, u.Size)
+		if err != nil {
+			helper.OutputAndExit(fmt.Sprintf("Failed to upload file: %v", err))
+		}
+		saveUpload(u)
+	}
+
+	obj, err := resumer.Resume(u.Name, u.Session, u.Offset, u.Size, reader, func(offset int64) {
+
+		u.Offset = offset
+		saveUpload(u)
+	})
+	if err != nil {
+		fmt.Println("")
+		helper.OutputAndExit(fmt.Sprintf("Upload interrupted after %s: %v\nTo continue the upload run: filesender send --resume %s", byteCountIEC(u.Offset), err, u.Path))
+	}
+
+	return obj
+}
+
+// saveUpload saves the resumable upload state
+func saveUpload(u *config.Upload) {
+
+	uploads := new(config.Uploads)
+	uploads.Load()
+	uploads.Set(*u)
+	uploads.Save()
+}
+
+// removeUpload removes the resumable upload state once the upload has completed
+func removeUpload(u *config.Upload) {
+
+	uploads := new(config.Uploads)
+	uploads.Load()
+	uploads.Remove(u.Path)
+	uploads.Save()
+}
+
+// getUploadHash returns the SHA-256 of the file size, modification time, and the start and
+// end of the file contents, which identifies the version of the file being uploaded without
+// reading the whole file
+func getUploadHash(path string) string {
+
+	f, err := os.Open(path)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading file: %v", err))
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading file: %v", err))
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%d %d\n", stat.Size(), stat.ModTime().UnixNano())
+
+	_, err = io.Copy(h, io.LimitReader(f, UPLOAD_HASH_SAMPLE))
+	if err == nil && stat.Size() > UPLOAD_HASH_SAMPLE {
+		_, err = f.Seek(-UPLOAD_HASH_SAMPLE, io.SeekEnd)
+		if err == nil {
+			_, err = io.Copy(h, f)
+		}
+	}
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading file: %v", err))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 
 	helper "filesender/utils"
@@ -8,14 +10,60 @@ import (
 	viper "github.com/spf13/viper"
 )
 
+// ##### Constants ############################################################
+
+const DEFAULT_SLOT_NAME string = "default"
+const CRYPTO_FILE string = "crypto.toml"
+
 // ##### Structs ##############################################################
 
-// Config holds configuration data for the application
+// Config holds configuration data for the application. The top level crypto
+// values are the primary key slot, which is the only slot used by earlier versions
 type Config struct {
 	Salt           string
 	PasswordHash   string
 	EncryptedKey   string
 	EncryptedKeyIv string
+	KDF            KDF
+	SlotName       string
+	Slots          []Slot
+	CurrentKey     WrappedKey
+	RetiredKeys    []WrappedKey
+}
+
+// Slot holds the unlock key encrypted using a key derived from one password,
+// so that each person sharing the crypto data can have their own password
+type Slot struct {
+	Name           string `mapstructure:"name"`
+	Salt           string `mapstructure:"salt"`
+	PasswordHash   string `mapstructure:"password_hash"`
+	EncryptedKey   string `mapstructure:"encrypted_key"`
+	EncryptedKeyIv string `mapstructure:"encrypted_key_iv"`
+	KDF            KDF    `mapstructure:"kdf"`
+}
+
+// WrappedKey holds an encryption key encrypted using the unlock key. The current
+// key is only present once the key has been rotated, before which the unlock key
+// is the encryption key. Retired keys are replaced keys, which are kept so that
+// files encrypted before the rotation can still be decrypted
+type WrappedKey struct {
+	KeyID        string `mapstructure:"key_id"`
+	EncryptedKey string `mapstructure:"encrypted_key"`
+	Nonce        string `mapstructure:"nonce"`
+	Legacy       bool   `mapstructure:"legacy"`
+}
+
+// KDF holds the key derivation function used to derive the key encryption key
+// from the password, and its cost parameters. Configs without a KDF were
+// generated using PBKDF2-SHA256 with 65536 iterations
+type KDF struct {
+	Algorithm  string
+	Iterations int
+	Memory     int
+	Threads    int
+	N          int
+	R          int
+	P          int
 }
 
 // ##### Methods ##############################################################
@@ -41,6 +89,36 @@ func (c *Config) Load() {
 	c.PasswordHash = viper.GetString("password_hash")
 	c.EncryptedKey = viper.GetString("encrypted_key")
 	c.EncryptedKeyIv = viper.GetString("encrypted_key_iv")
+
+	c.KDF.Algorithm = viper.GetString("kdf.algorithm")
+	c.KDF.Iterations = viper.GetInt("kdf.iterations")
+	c.KDF.Memory = viper.GetInt("kdf.memory")
+	c.KDF.Threads = viper.GetInt("kdf.threads")
+	c.KDF.N = viper.GetInt("kdf.n")
+	c.KDF.R = viper.GetInt("kdf.r")
+	c.KDF.P = viper.GetInt("kdf.p")
+
+	c.SlotName = viper.GetString("slot_name")
+	if len(c.SlotName) == 0 {
+		c.SlotName = DEFAULT_SLOT_NAME
+	}
+
+	c.Slots = make([]Slot, 0)
+	err = viper.UnmarshalKey("slots", &c.Slots)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading crypto config slots: %v", err))
+	}
+
+	err = viper.UnmarshalKey("current_key", &c.CurrentKey)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading crypto config current key: %v", err))
+	}
+
+	c.RetiredKeys = make([]WrappedKey, 0)
+	err = viper.UnmarshalKey("retired_keys", &c.RetiredKeys)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading crypto config retired keys: %v", err))
+	}
 }
 
 // Save loads the configuration data from the config file
@@ -51,8 +129,123 @@ func (c *Config) Save() {
 	viper.Set("encrypted_key", c.EncryptedKey)
 	viper.Set("encrypted_key_iv", c.EncryptedKeyIv)
 
-	err := viper.WriteConfigAs("crypto.toml")
+	// Only the parameters used by the algorithm are written
+	viper.Set("kdf", c.KDF.values())
+	viper.Set("slot_name", c.SlotName)
+
+	slots := make([]map[string]interface{}, 0)
+	for _, slot := range c.Slots {
+		slots = append(slots, slot.values())
+	}
+	viper.Set("slots", slots)
+
+	if len(c.CurrentKey.KeyID) > 0 {
+		viper.Set("current_key", c.CurrentKey.values())
+	}
+
+	retiredKeys := make([]map[string]interface{}, 0)
+	for _, rk := range c.RetiredKeys {
+		retiredKeys = append(retiredKeys, rk.values())
+	}
+	viper.Set("retired_keys", retiredKeys)
+
+	err := viper.WriteConfigAs(CRYPTO_FILE)
 	if err != nil {
 		helper.OutputAndExit(fmt.Sprintf("Error writing crypto config file: %v", err))
 	}
 }
+
+// CheckCryptoData checks that the data is a crypto config file holding a key slot,
+// before it is written over the crypto config file e.g. when imported
+func CheckCryptoData(data []byte) error {
+
+	v := viper.New()
+	v.SetConfigType("toml")
+	err := v.ReadConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	if len(v.GetString("salt")) == 0 {
+		return errors.New("No key slot")
+	}
+
+	return nil
+}
+
+// values returns the non zero KDF parameters, keyed by the config file names
+func (k KDF) values() map[string]interface{} {
+
+	v := make(map[string]interface{}, 0)
+	v["algorithm"] = k.Algorithm
+	for name, value := range map[string]int{
+		"iterations": k.Iterations,
+		"memory":     k.Memory,
+		"threads":    k.Threads,
+		"n":          k.N,
+		"r":          k.R,
+		"p":          k.P,
+	} {
+		if value != 0 {
+			v[name] = value
+		}
+	}
+
+	return v
+}
+
+// values returns the wrapped key, keyed by the config file names
+func (wk WrappedKey) values() map[string]interface{} {
+
+	return map[string]interface{}{
+		"key_id":        wk.KeyID,
+		"encrypted_key": wk.EncryptedKey,
+		"nonce":         wk.Nonce,
+		"legacy":        wk.Legacy,
+	}
+}
+
+// values returns the slot, keyed by the config file names
+func (s Slot) values() map[string]interface{} {
+
+	return map[string]interface{}{
+		"name":             s.Name,
+		"salt":             s.Salt,
+		"password_hash":    s.PasswordHash,
+		"encrypted_key":    s.EncryptedKey,
+		"encrypted_key_iv": s.EncryptedKeyIv,
+		"kdf":              s.KDF.values(),
+	}
+}
+
+// GetSlots returns all of the key slots, starting with the primary slot
+func (c *Config) GetSlots() []Slot {
+
+	slots := make([]Slot, 0)
+	if len(c.Salt) > 0 {
+		slots = append(slots, Slot{
+			Name:           c.SlotName,
+			Salt:           c.Salt,
+			PasswordHash:   c.PasswordHash,
+			EncryptedKey:   c.EncryptedKey,
+			EncryptedKeyIv: c.EncryptedKeyIv,
+			KDF:            c.KDF,
+		})
+	}
+
+	return append(slots, c.Slots...)
+}
+
+// SetSlots replaces the key slots, the first slot becomes the primary slot
+func (c *Config) SetSlots(slots []Slot) {
+
+	primary := slots[0]
+	c.SlotName = primary.Name
+	c.Salt = primary.Salt
+	c.PasswordHash = primary.PasswordHash
+	c.EncryptedKey = primary.EncryptedKey
+	c.EncryptedKeyIv = primary.EncryptedKeyIv
+	c.KDF = primary.KDF
+
+	c.Slots = append([]Slot{}, slots[1:]...)
+}
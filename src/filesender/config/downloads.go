@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+
+	helper "filesender/utils"
+
+	viper "github.com/spf13/viper"
+)
+
+// ##### Constants ############################################################
+
+const DOWNLOADS_FILE string = "downloads.toml"
+
+// ##### Structs ##############################################################
+
+// Downloads holds the state of the resumable downloads that have not completed,
+// so that an interrupted receive can continue from the last checkpoint
+type Downloads struct {
+	Downloads []Download
+}
+
+// Download holds the state of a resumable download, keyed by the name of the relay
+// file. The offset is the number of bytes of the file contents written to the partial
+// file at the last checkpoint. The envelope format also keeps the envelope fields, the
+// salt, and the state of the SHA-256 of the bytes received at the checkpoint
+type Download struct {
+	Name       string `mapstructure:"name"`
+	FileName   string `mapstructure:"file_name"`
+	Offset     int64  `mapstructure:"offset"`
+	Size       int64  `mapstructure:"size"`
+	Mode       uint32 `mapstructure:"mode"`
+	HeaderSize int64  `mapstructure:"header_size"`
+	Salt       string `mapstructure:"salt"`
+	Hash       string `mapstructure:"hash"`
+	Started    string `mapstructure:"started"`
+}
+
+// ##### Methods ##############################################################
+
+// Load loads the download state from the downloads file, if one exists
+func (d *Downloads) Load() {
+
+	v := viper.New()
+	v.SetConfigType("toml")
+	v.SetConfigName("downloads")
+	v.AddConfigPath("./")
+
+	d.Downloads = make([]Download, 0)
+
+	err := v.ReadInConfig()
+	if err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok == true {
+			return
+		}
+		helper.OutputAndExit(fmt.Sprintf("Error reading downloads file: %v", err))
+	}
+
+	err = v.UnmarshalKey("downloads", &d.Downloads)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading downloads: %v", err))
+	}
+}
+
+// Save writes the download state to the downloads file
+func (d *Downloads) Save() {
+
+	downloads := make([]map[string]interface{}, 0)
+	for _, download := range d.Downloads {
+		downloads = append(downloads, map[string]interface{}{
+			"name":        download.Name,
+			"file_name":   download.FileName,
+			"offset":      download.Offset,
+			"size":        download.Size,
+			"mode":        download.Mode,
+			"header_size": download.HeaderSize,
+			"salt":        download.Salt,
+			"hash":        download.Hash,
+			"started":     download.Started,
+		})
+	}
+
+	v := viper.New()
+	v.SetConfigType("toml")
+	v.Set("downloads", downloads)
+
+	err := v.WriteConfigAs(DOWNLOADS_FILE)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error writing downloads file: %v", err))
+	}
+}
+
+// Find returns the state of the download of the relay file, or nil if there is none
+func (d *Downloads) Find(name string) *Download {
+
+	for i := range d.Downloads {
+		if d.Downloads[i].Name == name {
+			return &d.Downloads[i]
+		}
+	}
+
+	return nil
+}
+
+// Set adds the state of the download, replacing any existing state for the relay file
+func (d *Downloads) Set(download Download) {
+
+	d.Remove(download.Name)
+	d.Downloads = append(d.Downloads, download)
+}
+
+// Remove removes the state of the download of the relay file
+func (d *Downloads) Remove(name string) {
+
+	downloads := make([]Download, 0)
+	for _, download := range d.Downloads {
+		if download.Name != name {
+			downloads = append(downloads, download)
+		}
+	}
+
+	d.Downloads = downloads
+}
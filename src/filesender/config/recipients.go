@@ -0,0 +1,86 @@
+package config
+
+import (
+	"fmt"
+
+	helper "filesender/utils"
+
+	viper "github.com/spf13/viper"
+)
+
+// ##### Constants ############################################################
+
+const RECIPIENTS_FILE string = "recipients.toml"
+
+// ##### Structs ##############################################################
+
+// Recipients holds the public keys of the people that files can be sent to,
+// these are read from the optional recipients.toml file
+type Recipients struct {
+	Recipients []Recipient
+}
+
+// Recipient holds the name and age X25519 public key of a recipient
+type Recipient struct {
+	Name      string `mapstructure:"name"`
+	PublicKey string `mapstructure:"public_key"`
+}
+
+// ##### Methods ##############################################################
+
+// Load loads the recipients from the recipients file, if one exists
+func (r *Recipients) Load() {
+
+	v := viper.New()
+	v.SetConfigType("toml")
+	v.SetConfigName("recipients")
+	v.AddConfigPath("./")
+
+	r.Recipients = make([]Recipient, 0)
+
+	err := v.ReadInConfig()
+	if err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok == true {
+			return
+		}
+		helper.OutputAndExit(fmt.Sprintf("Error reading recipients file: %v", err))
+	}
+
+	err = v.UnmarshalKey("recipients", &r.Recipients)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading recipients: %v", err))
+	}
+}
+
+// Save writes the recipients to the recipients file
+func (r *Recipients) Save() {
+
+	recipients := make([]map[string]interface{}, 0)
+	for _, recipient := range r.Recipients {
+		recipients = append(recipients, map[string]interface{}{
+			"name":       recipient.Name,
+			"public_key": recipient.PublicKey,
+		})
+	}
+
+	v := viper.New()
+	v.SetConfigType("toml")
+	v.Set("recipients", recipients)
+
+	err := v.WriteConfigAs(RECIPIENTS_FILE)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error writing recipients file: %v", err))
+	}
+}
+
+// Find returns the recipient with the name, or nil if there is no such recipient
+func (r *Recipients) Find(name string) *Recipient {
+
+	for i := range r.Recipients {
+		if r.Recipients[i].Name == name {
+			return &r.Recipients[i]
+		}
+	}
+
+	return nil
+}
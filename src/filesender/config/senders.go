@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+
+	helper "filesender/utils"
+
+	viper "github.com/spf13/viper"
+)
+
+// ##### Constants ############################################################
+
+const KNOWN_SENDERS_FILE string = "known_senders.toml"
+
+// ##### Structs ##############################################################
+
+// KnownSenders is the trust store holding the public keys of the trusted senders, and
+// the transfer identifiers already received so that replayed transfers are rejected
+type KnownSenders struct {
+	Senders  []KnownSender
+	Received []string
+}
+
+// KnownSender holds a trusted sender's Ed25519 public key, and when it was first trusted
+type KnownSender struct {
+	Fingerprint string `mapstructure:"fingerprint"`
+	PublicKey   string `mapstructure:"public_key"`
+	Added       string `mapstructure:"added"`
+}
+
+// ##### Methods ##############################################################
+
+// Load loads the trust store from the known senders file, if one exists
+func (k *KnownSenders) Load() {
+
+	v := viper.New()
+	v.SetConfigType("toml")
+	v.SetConfigName("known_senders")
+	v.AddConfigPath("./")
+
+	k.Senders = make([]KnownSender, 0)
+	k.Received = make([]string, 0)
+
+	err := v.ReadInConfig()
+	if err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok == true {
+			return
+		}
+		helper.OutputAndExit(fmt.Sprintf("Error reading known senders file: %v", err))
+	}
+
+	err = v.UnmarshalKey("senders", &k.Senders)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading known senders: %v", err))
+	}
+
+	k.Received = v.GetStringSlice("received")
+}
+
+// Save writes the trust store to the known senders file
+func (k *KnownSenders) Save() {
+
+	senders := make([]map[string]interface{}, 0)
+	for _, sender := range k.Senders {
+		senders = append(senders, map[string]interface{}{
+			"fingerprint": sender.Fingerprint,
+			"public_key":  sender.PublicKey,
+			"added":       sender.Added,
+		})
+	}
+
+	v := viper.New()
+	v.SetConfigType("toml")
+	v.Set("senders", senders)
+	v.Set("received", k.Received)
+
+	err := v.WriteConfigAs(KNOWN_SENDERS_FILE)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error writing known senders file: %v", err))
+	}
+}
+
+// IsTrusted returns true if the public key is a trusted sender
+func (k *KnownSenders) IsTrusted(publicKey string) bool {
+
+	for _, sender := range k.Senders {
+		if sender.PublicKey == publicKey {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsReceived returns true if the transfer has already been received
+func (k *KnownSenders) IsReceived(transferID string) bool {
+
+	for _, id := range k.Received {
+		if id == transferID {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+
+	helper "filesender/utils"
+
+	viper "github.com/spf13/viper"
+)
+
+// ##### Constants ############################################################
+
+const DEFAULT_BACKEND string = "gdrive"
+
+// ##### Structs ##############################################################
+
+// Settings holds the general (non crypto) settings for the application,
+// these are read from the optional filesender.toml file
+type Settings struct {
+	Backend string
+	S3      S3Settings
+	WebDAV  WebDAVSettings
+	SFTP    SFTPSettings
+	Local   LocalSettings
+}
+
+// S3Settings holds the settings for the S3 compatible object storage backend
+type S3Settings struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	PathStyle bool
+	AccessKey string
+	SecretKey string
+}
+
+// WebDAVSettings holds the settings for the WebDAV backend e.g. Nextcloud/ownCloud
+type WebDAVSettings struct {
+	URL      string
+	Username string
+	Password string
+}
+
+// SFTPSettings holds the settings for the SFTP backend e.g. a shared jump host
+type SFTPSettings struct {
+	Host       string
+	Port       int
+	User       string
+	Directory  string
+	KeyFile    string
+	KnownHosts string
+}
+
+// LocalSettings holds the settings for the local/shared directory backend
+type LocalSettings struct {
+	Directory string
+	Mode      string
+}
+
+// ##### Methods ##############################################################
+
+// Load loads the settings from the settings file, if one exists
+func (s *Settings) Load() {
+
+	v := viper.New()
+	v.SetConfigType("toml")
+	v.SetConfigName("filesender")
+	v.AddConfigPath("./")
+	v.SetDefault("backend", DEFAULT_BACKEND)
+	v.SetDefault("s3.region", "us-east-1")
+	v.SetDefault("s3.prefix", "filesender/")
+	v.SetDefault("sftp.port", 22)
+	v.SetDefault("sftp.directory", "filesender")
+	v.SetDefault("sftp.known_hosts", "~/.ssh/known_hosts")
+	v.SetDefault("local.directory", "filesender")
+
+	err := v.ReadInConfig()
+	if err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok == false {
+			helper.OutputAndExit(fmt.Sprintf("Error reading settings file: %v", err))
+		}
+	}
+
+	s.Backend = v.GetString("backend")
+
+	s.S3.Endpoint = v.GetString("s3.endpoint")
+	s.S3.Region = v.GetString("s3.region")
+	s.S3.Bucket = v.GetString("s3.bucket")
+	s.S3.Prefix = v.GetString("s3.prefix")
+	s.S3.PathStyle = v.GetBool("s3.path_style")
+	s.S3.AccessKey = v.GetString("s3.access_key")
+	s.S3.SecretKey = v.GetString("s3.secret_key")
+
+	s.WebDAV.URL = v.GetString("webdav.url")
+	s.WebDAV.Username = v.GetString("webdav.username")
+	s.WebDAV.Password = v.GetString("webdav.password")
+
+	s.SFTP.Host = v.GetString("sftp.host")
+	s.SFTP.Port = v.GetInt("sftp.port")
+	s.SFTP.User = v.GetString("sftp.user")
+	s.SFTP.Directory = v.GetString("sftp.directory")
+	s.SFTP.KeyFile = v.GetString("sftp.key_file")
+	s.SFTP.KnownHosts = v.GetString("sftp.known_hosts")
+
+	s.Local.Directory = v.GetString("local.directory")
+	s.Local.Mode = v.GetString("local.mode")
+}
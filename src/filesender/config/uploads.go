@@ -0,0 +1,124 @@
+package config
+
+import (
+	"fmt"
+
+	helper "filesender/utils"
+
+	viper "github.com/spf13/viper"
+)
+
+// ##### Constants ############################################################
+
+const UPLOADS_FILE string = "uploads.toml"
+
+// ##### Structs ##############################################################
+
+// Uploads holds the state of the resumable uploads that have not completed,
+// so that an interrupted send can continue from the last byte stored
+type Uploads struct {
+	Uploads []Upload
+}
+
+// Upload holds the state of a resumable upload, keyed by the file path and hash. The
+// meta data, IV and padding are kept so the same upload contents can be generated
+// again, the meta data only holds the data key wrapped by the encryption key or passphrase
+type Upload struct {
+	Path     string            `mapstructure:"path"`
+	Hash     string            `mapstructure:"hash"`
+	Name     string            `mapstructure:"name"`
+	Session  string            `mapstructure:"session"`
+	Size     int64             `mapstructure:"size"`
+	Offset   int64             `mapstructure:"offset"`
+	IV       string            `mapstructure:"iv"`
+	Pad      bool              `mapstructure:"pad"`
+	Metadata map[string]string `mapstructure:"metadata"`
+	Started  string            `mapstructure:"started"`
+}
+
+// ##### Methods ##############################################################
+
+// Load loads the upload state from the uploads file, if one exists
+func (u *Uploads) Load() {
+
+	v := viper.New()
+	v.SetConfigType("toml")
+	v.SetConfigName("uploads")
+	v.AddConfigPath("./")
+
+	u.Uploads = make([]Upload, 0)
+
+	err := v.ReadInConfig()
+	if err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok == true {
+			return
+		}
+		helper.OutputAndExit(fmt.Sprintf("Error reading uploads file: %v", err))
+	}
+
+	err = v.UnmarshalKey("uploads", &u.Uploads)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error reading uploads: %v", err))
+	}
+}
+
+// Save writes the upload state to the uploads file
+func (u *Uploads) Save() {
+
+	uploads := make([]map[string]interface{}, 0)
+	for _, upload := range u.Uploads {
+		uploads = append(uploads, map[string]interface{}{
+			"path":     upload.Path,
+			"hash":     upload.Hash,
+			"name":     upload.Name,
+			"session":  upload.Session,
+			"size":     upload.Size,
+			"offset":   upload.Offset,
+			"iv":       upload.IV,
+			"pad":      upload.Pad,
+			"metadata": upload.Metadata,
+			"started":  upload.Started,
+		})
+	}
+
+	v := viper.New()
+	v.SetConfigType("toml")
+	v.Set("uploads", uploads)
+
+	err := v.WriteConfigAs(UPLOADS_FILE)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error writing uploads file: %v", err))
+	}
+}
+
+// Find returns the state of the upload of the file path and hash, or nil if there is none
+func (u *Uploads) Find(path string, hash string) *Upload {
+
+	for i := range u.Uploads {
+		if u.Uploads[i].Path == path && u.Uploads[i].Hash == hash {
+			return &u.Uploads[i]
+		}
+	}
+
+	return nil
+}
+
+// Set adds the state of the upload, replacing any existing state for the file path
+func (u *Uploads) Set(upload Upload) {
+
+	u.Remove(upload.Path)
+	u.Uploads = append(u.Uploads, upload)
+}
+
+// Remove removes the state of the upload of the file path
+func (u *Uploads) Remove(path string) {
+
+	uploads := make([]Upload, 0)
+	for _, upload := range u.Uploads {
+		if upload.Path != path {
+			uploads = append(uploads, upload)
+		}
+	}
+
+	u.Uploads = uploads
+}
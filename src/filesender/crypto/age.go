@@ -0,0 +1,152 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"filippo.io/age"
+)
+
+// ##### Constants ###########################################################
+
+// FORMAT_AGE is the format of files encrypted to the recipients' public keys,
+// which are standard age files so they can also be decrypted using the age tool
+const FORMAT_AGE string = "age"
+
+// IDENTITY_FILE is the file holding the X25519 identity (private key), in the
+// same format as age-keygen, so it can also be used with "age -d -i identity.txt"
+const IDENTITY_FILE string = "identity.txt"
+
+// ##### Structs #############################################################
+
+// ageEncrypter encrypts the plaintext into the age format as it is read. The
+// age writer outputs each chunk once it is full, so plaintext is written to it
+// until ciphertext is available
+type ageEncrypter struct {
+	writer io.WriteCloser
+	output *bytes.Buffer
+	reader io.Reader
+	buf    []byte
+	done   bool
+}
+
+// ##### Functions ###########################################################
+
+// GenerateIdentity creates a new X25519 identity and writes it to the file,
+// which is only readable by the current user
+func GenerateIdentity(path string) (*age.X25519Identity, error) {
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fmt.Fprintf(f, "# created: %s\n# public key: %s\n%s\n", time.Now().Format(time.RFC3339), identity.Recipient(), identity)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return identity, f.Close()
+}
+
+// LoadIdentities reads the identities from the identity file
+func LoadIdentities(path string) ([]age.Identity, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return age.ParseIdentities(f)
+}
+
+// ParseRecipient parses an age X25519 public key e.g. age1...
+func ParseRecipient(publicKey string) (age.Recipient, error) {
+
+	return age.ParseX25519Recipient(publicKey)
+}
+
+// NewAgeEncrypter returns an io.Reader that encrypts the byte stream from the given
+// io.Reader to the recipients in the age format, and the size of the encrypted output
+// for a plaintext of the given size. Each file is encrypted using a random file key,
+// which is encrypted to each of the recipients in the age header
+func NewAgeEncrypter(recipients []age.Recipient, reader io.Reader, size int64) (io.Reader, int64, error) {
+
+	if len(recipients) == 0 {
+		return nil, 0, errors.New("No recipients specified")
+	}
+
+	output := new(bytes.Buffer)
+	writer, err := age.Encrypt(output, recipients...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// The header and nonce are written by Encrypt, and age uses the same
+	// chunk size and tag size as the stream format
+	length := int64(output.Len()) + StreamSize(size)
+
+	return &ageEncrypter{
+		writer: writer,
+		output: output,
+		reader: reader,
+		buf:    make([]byte, STREAM_CHUNK_SIZE),
+	}, length, nil
+}
+
+// NewAgeDecrypter returns an io.Reader that decrypts the age byte stream from the
+// given io.Reader, using whichever of the identities the file was encrypted to
+func NewAgeDecrypter(identities []age.Identity, reader io.Reader) (io.Reader, error) {
+
+	r, err := age.Decrypt(reader, identities...)
+	if err != nil {
+		var nim *age.NoIdentityMatchError
+		if errors.As(err, &nim) == true {
+			return nil, errors.New("File was not encrypted to the local identity")
+		}
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// ##### Methods #############################################################
+
+// Read encrypts more of the plaintext when the previous ciphertext has been consumed
+func (a *ageEncrypter) Read(p []byte) (int, error) {
+
+	for a.output.Len() == 0 {
+		if a.done == true {
+			return 0, io.EOF
+		}
+
+		n, err := a.reader.Read(a.buf)
+		if n > 0 {
+			_, werr := a.writer.Write(a.buf[:n])
+			if werr != nil {
+				return 0, werr
+			}
+		}
+
+		if err == io.EOF {
+			a.done = true
+			err = a.writer.Close()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return a.output.Read(p)
+}
@@ -4,15 +4,13 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/sha256"
+	"crypto/rand"
 	"encoding/hex"
 	config "filesender/config"
 	helper "filesender/utils"
 	"fmt"
 	"io"
 	"io/ioutil"
-
-	"golang.org/x/crypto/pbkdf2"
 )
 
 // Returns an io.Reader that encrypts the byte stream from the given io.Reader
@@ -57,31 +55,133 @@ func MakeDecryptionReader(key []byte, iv []byte, reader io.Reader) io.Reader {
 }
 
 // Decrypts the encrypted encryption key using values from the config file
-// and the user's passphrase.
+// and the user's passphrase. Configs using the legacy PBKDF2 derivation are
+// upgraded to the default KDF once the correct passphrase has been entered.
 func DecryptEncryptionKey(password string) []byte {
 
+	return UnlockKeyring(password).Key
+}
+
+// unlockConfig loads the config file and decrypts the unlock key using the passphrase,
+// trying each of the key slots until one matches. The index of the slot is returned
+func unlockConfig(password string) (*config.Config, int, []byte) {
+
 	// Read the crypto config
 	c := new(config.Config)
 	c.Initialise()
 	c.Load()
 
-	salt := decodeHexString(c.Salt)
-	passphraseHash := decodeHexString(c.PasswordHash)
-	encryptedKey := decodeHexString(c.EncryptedKey)
-	encryptedKeyIv := decodeHexString(c.EncryptedKeyIv)
+	for i, slot := range c.GetSlots() {
+		key, err := unlockSlot(slot, password)
+		if err != nil {
+			helper.OutputAndExit(fmt.Sprintf("Unable to derive key for slot %s: %v", slot.Name, err))
+		}
+		if key == nil {
+			continue
+		}
+
+		if len(slot.KDF.Algorithm) == 0 {
+			upgradeKDF(c, i, password, key)
+		}
+
+		return c, i, key
+	}
+
+	helper.OutputAndExit(fmt.Sprintf("Incorrect password"))
+	return nil, 0, nil
+}
+
+// unlockSlot decrypts the unlock key in the slot, returning nil if the passphrase does not match
+func unlockSlot(slot config.Slot, password string) ([]byte, error) {
+
+	salt := decodeHexString(slot.Salt)
+	passphraseHash := decodeHexString(slot.PasswordHash)
+	encryptedKey := decodeHexString(slot.EncryptedKey)
+	encryptedKeyIv := decodeHexString(slot.EncryptedKeyIv)
+
+	derivedKey, err := DeriveKey([]byte(password), salt, slot.KDF)
+	if err != nil {
+		return nil, err
+	}
 
-	derivedKey := pbkdf2.Key([]byte(password), salt, 65536, 64, sha256.New)
 	// Make sure the first 32 bytes of the derived key match the bytes stored
 	// when we first generated the key; if they don't, the user gave us
 	// the wrong passphrase.
 	if !bytes.Equal(derivedKey[:32], passphraseHash) {
-		helper.OutputAndExit(fmt.Sprintf("Incorrect password"))
+		return nil, nil
 	}
 
 	// Use the last 32 bytes of the derived key to decrypt the actual
 	// encryption key.
 	keyEncryptKey := derivedKey[32:]
-	return decryptBytes(keyEncryptKey, encryptedKeyIv, encryptedKey)
+	return decryptBytes(keyEncryptKey, encryptedKeyIv, encryptedKey), nil
+}
+
+// SealSlot encrypts the key using a key derived from the password with the KDF,
+// and returns the key slot holding the crypto values
+func SealSlot(name string, password string, key []byte, kdf config.KDF) (config.Slot, error) {
+
+	// Derive a 64-byte hash from the passphrase using the KDF.
+	salt, err := randomBytes(32)
+	if err != nil {
+		return config.Slot{}, err
+	}
+
+	hash, err := DeriveKey([]byte(password), salt, kdf)
+	if err != nil {
+		return config.Slot{}, err
+	}
+
+	// We'll store the first 32 bytes of the hash to use to confirm the
+	// correct passphrase is given on subsequent runs.
+	passHash := hash[:32]
+	// And we'll use the remaining 32 bytes as a key to encrypt the actual
+	// encryption key. (These bytes are *not* stored).
+	keyEncryptKey := hash[32:]
+
+	iv, err := randomBytes(aes.BlockSize)
+	if err != nil {
+		return config.Slot{}, err
+	}
+	encryptedKey, _ := ioutil.ReadAll(MakeEncrypterReader(keyEncryptKey, iv, bytes.NewReader(key)))
+
+	return config.Slot{
+		Name:           name,
+		Salt:           hex.EncodeToString(salt),
+		PasswordHash:   hex.EncodeToString(passHash),
+		EncryptedKey:   hex.EncodeToString(encryptedKey),
+		EncryptedKeyIv: hex.EncodeToString(iv),
+		KDF:            kdf,
+	}, nil
+}
+
+// upgradeKDF re-encrypts the unlock key of a legacy slot using the default
+// KDF. Failures are reported but do not prevent the key being used
+func upgradeKDF(c *config.Config, index int, password string, key []byte) {
+
+	slots := c.GetSlots()
+
+	kdf, err := CalibrateKDF(DEFAULT_KDF, DEFAULT_KDF_TIME)
+	if err == nil {
+		slots[index], err = SealSlot(slots[index].Name, password, key, kdf)
+	}
+	if err != nil {
+		fmt.Printf("Unable to upgrade the crypto config key derivation: %v\n", err)
+		return
+	}
+
+	c.SetSlots(slots)
+	c.Save()
+
+	fmt.Printf("Upgraded the crypto config key derivation from PBKDF2 to %s\n", kdf.Algorithm)
+}
+
+// randomBytes returns n bytes from the cryptographically secure random source
+func randomBytes(n int) ([]byte, error) {
+
+	b := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, b)
+	return b, err
 }
 
 // Utility function to decode hex-encoded bytes; treats any encoding errors
@@ -0,0 +1,128 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"errors"
+
+	config "filesender/config"
+)
+
+// ##### Constants ###########################################################
+
+// wrapAAD binds the wrapped data keys to their purpose
+const wrapAAD string = "filesender data key"
+
+// ##### Variables ###########################################################
+
+// PASSPHRASE_KDF is the key derivation function used for one-off passphrases. It is
+// fixed, rather than calibrated, so that any computer can unwrap the data key
+var PASSPHRASE_KDF = config.KDF{Algorithm: KDF_ARGON2ID, Iterations: 3, Memory: 64 * 1024, Threads: 4}
+
+var ErrIncorrectPassphrase = errors.New("Incorrect passphrase")
+
+// ##### Functions ###########################################################
+
+// NewDataKey generates a random key used to encrypt a single transfer, which is
+// stored in the file meta data wrapped (encrypted) by one or more other keys
+func NewDataKey() ([]byte, error) {
+
+	return randomBytes(KEY_SIZE)
+}
+
+// WrapDataKey encrypts the data key using the wrapping key e.g. the encryption key
+// from the crypto data. Returns the base64 encoded nonce and encrypted data key
+func WrapDataKey(wrappingKey []byte, dataKey []byte) (string, error) {
+
+	sealed, err := sealBytes(wrappingKey, dataKey, wrapAAD)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// UnwrapDataKey decrypts the data key wrapped by WrapDataKey
+func UnwrapDataKey(wrappingKey []byte, wrapped string) ([]byte, error) {
+
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, errors.New("Invalid wrapped data key")
+	}
+
+	return openBytes(wrappingKey, sealed, wrapAAD)
+}
+
+// WrapDataKeyWithPassphrase encrypts the data key using a key derived from the passphrase
+// and a random salt. Returns the base64 encoded salt, nonce and encrypted data key
+func WrapDataKeyWithPassphrase(passphrase string, dataKey []byte) (string, error) {
+
+	salt, err := randomBytes(STREAM_SALT_SIZE)
+	if err != nil {
+		return "", err
+	}
+
+	wrappingKey, err := DeriveKey([]byte(passphrase), salt, PASSPHRASE_KDF)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := sealBytes(wrappingKey[:KEY_SIZE], dataKey, wrapAAD)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(append(salt, sealed...)), nil
+}
+
+// UnwrapDataKeyWithPassphrase decrypts the data key wrapped by WrapDataKeyWithPassphrase
+func UnwrapDataKeyWithPassphrase(passphrase string, wrapped string) ([]byte, error) {
+
+	data, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil || len(data) < STREAM_SALT_SIZE {
+		return nil, errors.New("Invalid wrapped data key")
+	}
+
+	wrappingKey, err := DeriveKey([]byte(passphrase), data[:STREAM_SALT_SIZE], PASSPHRASE_KDF)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := openBytes(wrappingKey[:KEY_SIZE], data[STREAM_SALT_SIZE:], wrapAAD)
+	if err != nil {
+		return nil, ErrIncorrectPassphrase
+	}
+
+	return dataKey, nil
+}
+
+// sealBytes encrypts the data using AES-256-GCM, bound to its purpose by the
+// additional data, the nonce is prepended
+func sealBytes(key []byte, data []byte, aad string) ([]byte, error) {
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := randomBytes(aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, data, []byte(aad)), nil
+}
+
+// openBytes decrypts the data encrypted by sealBytes
+func openBytes(key []byte, sealed []byte, aad string) ([]byte, error) {
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("Invalid encrypted data")
+	}
+
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(aad))
+}
@@ -0,0 +1,213 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+)
+
+// ##### Constants ###########################################################
+
+// FORMAT_ENVELOPE is the chunked AEAD format, with the file meta data encrypted
+// in an envelope that precedes the file contents, so the relay only sees the
+// code and format. The contents may be followed by padding to hide the file size
+const FORMAT_ENVELOPE string = "3"
+
+// MAX_ENVELOPE_SIZE is the maximum size of the encoded envelope
+const MAX_ENVELOPE_SIZE int = 64 * 1024
+
+const envelopeLengthSize int = 4
+
+// ##### Structs #############################################################
+
+// Envelope holds the file meta data that is encrypted along with the file
+// contents, any future file meta data should be added here. The salt and the
+// size of the encoded envelope are set when the envelope is opened
+type Envelope struct {
+	FileName   string `json:"file_name"`
+	Size       int64  `json:"size"`
+	Mode       uint32 `json:"mode"`
+	Salt       []byte `json:"-"`
+	HeaderSize int64  `json:"-"`
+}
+
+// zeroReader returns zeros, it is used to generate the padding
+type zeroReader struct{}
+
+// contentReader reads the file contents, and then the padding that follows the
+// file contents, so that the final chunk is authenticated before the end of the
+// file is reported
+type contentReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+// ##### Functions ###########################################################
+
+// PaddedSize returns the size the plaintext is padded to, using the Padmé scheme,
+// which limits the overhead to 12% while only leaking the rough magnitude of the size
+func PaddedSize(size int64) int64 {
+
+	if size < 4 {
+		return size
+	}
+
+	e := bits.Len64(uint64(size)) - 1
+	s := bits.Len64(uint64(e))
+	mask := int64(1)<<uint(e-s) - 1
+
+	return (size + mask) &^ mask
+}
+
+// NewEnvelopeEncrypter returns an io.Reader that encrypts the envelope followed by
+// the envelope.Size bytes from the given io.Reader, and optionally padding, using the
+// key and salt in the chunked AEAD format. The salt is prepended to the returned
+// bytes, and the size of the returned bytes is also returned
+func NewEnvelopeEncrypter(key []byte, salt []byte, e *Envelope, reader io.Reader, pad bool) (io.Reader, int64, error) {
+
+	header, err := json.Marshal(e)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(header) > MAX_ENVELOPE_SIZE {
+		return nil, 0, errors.New("File meta data is too large")
+	}
+
+	prefix := make([]byte, envelopeLengthSize, envelopeLengthSize+len(header))
+	binary.BigEndian.PutUint32(prefix, uint32(len(header)))
+	prefix = append(prefix, header...)
+
+	size := int64(len(prefix)) + e.Size
+	padding := int64(0)
+	if pad == true {
+		padding = PaddedSize(size) - size
+	}
+
+	plain := io.MultiReader(bytes.NewReader(prefix), io.LimitReader(reader, e.Size), io.LimitReader(zeroReader{}, padding))
+
+	r, err := NewStreamEncrypter(key, salt, plain)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return io.MultiReader(bytes.NewReader(salt), r), int64(len(salt)) + StreamSize(size+padding), nil
+}
+
+// OpenEnvelope reads the salt from the given io.Reader, and decrypts the envelope using
+// the key. Returns the envelope, and an io.Reader that decrypts the file contents, and
+// returns an error if any of the file contents or padding fails authentication
+func OpenEnvelope(key []byte, reader io.Reader) (*Envelope, io.Reader, error) {
+
+	salt := make([]byte, STREAM_SALT_SIZE)
+	_, err := io.ReadFull(reader, salt)
+	if err != nil {
+		return nil, nil, ErrStreamTruncated
+	}
+
+	r, err := NewStreamDecrypter(key, salt, reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	prefix := make([]byte, envelopeLengthSize)
+	_, err = io.ReadFull(r, prefix)
+	if err != nil {
+		return nil, nil, envelopeError(err)
+	}
+
+	length := binary.BigEndian.Uint32(prefix)
+	if length > uint32(MAX_ENVELOPE_SIZE) {
+		return nil, nil, errors.New("File meta data is too large")
+	}
+
+	header := make([]byte, length)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return nil, nil, envelopeError(err)
+	}
+
+	e := &Envelope{}
+	err = json.Unmarshal(header, e)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid file meta data: %v", err)
+	}
+	e.Salt = salt
+	e.HeaderSize = int64(envelopeLengthSize) + int64(length)
+
+	return e, &contentReader{reader: r, remaining: e.Size}, nil
+}
+
+// ResumeEnvelope returns an io.Reader that decrypts the file contents from the offset in
+// the encrypted stream, using the envelope returned by OpenEnvelope e.g. to resume a download.
+// The offset must be the start of a chunk after the envelope, and the given io.Reader must
+// start at the chunk, which follows the salt at StreamSize(offset)
+func ResumeEnvelope(key []byte, e *Envelope, offset int64, reader io.Reader) (io.Reader, error) {
+
+	if offset%int64(STREAM_CHUNK_SIZE) != 0 || offset < e.HeaderSize || offset-e.HeaderSize > e.Size {
+		return nil, errors.New("Invalid envelope offset")
+	}
+
+	r, err := NewStreamDecrypterAt(key, e.Salt, reader, uint64(offset/int64(STREAM_CHUNK_SIZE)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &contentReader{reader: r, remaining: e.Size - (offset - e.HeaderSize)}, nil
+}
+
+// envelopeError converts an unexpected EOF into a truncation error
+func envelopeError(err error) error {
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrStreamTruncated
+	}
+
+	return err
+}
+
+// ##### Methods #############################################################
+
+// Read fills the buffer with zeros
+func (z zeroReader) Read(p []byte) (int, error) {
+
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
+
+// Read reads the file contents, once the contents have been read the padding is
+// discarded. An error is returned if the stream fails authentication, or if the
+// stream ends before the size in the envelope
+func (c *contentReader) Read(p []byte) (int, error) {
+
+	if c.remaining == 0 {
+		_, err := io.Copy(ioutil.Discard, c.reader)
+		if err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+
+	n, err := c.reader.Read(p)
+	c.remaining -= int64(n)
+	if err == io.EOF && c.remaining > 0 {
+		return n, ErrStreamTruncated
+	}
+	if err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
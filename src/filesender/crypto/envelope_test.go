@@ -0,0 +1,153 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+// ##### Functions ###########################################################
+
+// sealEnvelope encrypts the plaintext in the envelope format using a random key and salt
+func sealEnvelope(t *testing.T, plain []byte, pad bool) ([]byte, []byte) {
+
+	t.Helper()
+
+	key := make([]byte, KEY_SIZE)
+	salt := make([]byte, STREAM_SALT_SIZE)
+	rand.Read(key)
+	rand.Read(salt)
+
+	e := &Envelope{FileName: "data.bin", Size: int64(len(plain)), Mode: 0640}
+	reader, length, err := NewEnvelopeEncrypter(key, salt, e, bytes.NewReader(plain), pad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(ciphertext)) != length {
+		t.Fatalf("Ciphertext is %d bytes, expected %d", len(ciphertext), length)
+	}
+
+	return key, ciphertext
+}
+
+// TestEnvelopeRoundTrip checks the envelope meta data and file contents, with and without padding
+func TestEnvelopeRoundTrip(t *testing.T) {
+
+	for _, size := range []int{0, 1, STREAM_CHUNK_SIZE, 3*STREAM_CHUNK_SIZE + 5} {
+		for _, pad := range []bool{false, true} {
+			plain := make([]byte, size)
+			rand.Read(plain)
+
+			key, ciphertext := sealEnvelope(t, plain, pad)
+
+			e, contents, err := OpenEnvelope(key, bytes.NewReader(ciphertext))
+			if err != nil {
+				t.Fatalf("Size %d: %v", size, err)
+			}
+			if e.FileName != "data.bin" || e.Size != int64(size) || e.Mode != 0640 {
+				t.Fatalf("Size %d: unexpected envelope %+v", size, e)
+			}
+
+			decrypted, err := ioutil.ReadAll(contents)
+			if err != nil {
+				t.Fatalf("Size %d: %v", size, err)
+			}
+			if bytes.Equal(decrypted, plain) == false {
+				t.Fatalf("Size %d: decrypted data does not match", size)
+			}
+		}
+	}
+}
+
+// TestEnvelopePadding checks that the padding hides the exact size of the file
+func TestEnvelopePadding(t *testing.T) {
+
+	_, first := sealEnvelope(t, make([]byte, 1000000), true)
+	_, second := sealEnvelope(t, make([]byte, 1000100), true)
+	if len(first) != len(second) {
+		t.Fatalf("Padded sizes differ, %d and %d", len(first), len(second))
+	}
+
+	for _, size := range []int64{0, 3, 4, 1000, 1 << 20, 1<<20 + 1, 12345678} {
+		padded := PaddedSize(size)
+		if padded < size || float64(padded-size) > 0.12*float64(size) {
+			t.Fatalf("Padded size %d is out of range for %d", padded, size)
+		}
+	}
+}
+
+// TestEnvelopeTampering checks that the wrong key, truncation and padding removal are detected
+func TestEnvelopeTampering(t *testing.T) {
+
+	plain := make([]byte, 2*STREAM_CHUNK_SIZE)
+	rand.Read(plain)
+	key, ciphertext := sealEnvelope(t, plain, true)
+
+	otherKey := append([]byte{}, key...)
+	otherKey[0] ^= 1
+	_, _, err := OpenEnvelope(otherKey, bytes.NewReader(ciphertext))
+	if err != ErrStreamAuthentication {
+		t.Fatalf("Expected authentication failure for the wrong key, got %v", err)
+	}
+
+	_, _, err = OpenEnvelope(key, bytes.NewReader(ciphertext[:STREAM_SALT_SIZE-1]))
+	if err != ErrStreamTruncated {
+		t.Fatalf("Expected truncation for a partial salt, got %v", err)
+	}
+
+	// Removing the final chunk is detected once the contents are read
+	chunk := STREAM_CHUNK_SIZE + streamTagSize
+	_, contents, err := OpenEnvelope(key, bytes.NewReader(ciphertext[:STREAM_SALT_SIZE+2*chunk]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(contents)
+	if err != ErrStreamTruncated {
+		t.Fatalf("Expected truncation for a missing final chunk, got %v", err)
+	}
+}
+
+// TestResumeEnvelope checks that decryption can resume from each chunk after the envelope,
+// and that offsets which are not the start of a chunk after the envelope are rejected
+func TestResumeEnvelope(t *testing.T) {
+
+	plain := make([]byte, 3*STREAM_CHUNK_SIZE+100)
+	rand.Read(plain)
+	key, ciphertext := sealEnvelope(t, plain, false)
+
+	e, _, err := OpenEnvelope(key, bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for chunk := int64(1); chunk <= 3; chunk++ {
+		offset := chunk * int64(STREAM_CHUNK_SIZE)
+		reader := bytes.NewReader(ciphertext[int64(STREAM_SALT_SIZE)+StreamSize(offset):])
+
+		contents, err := ResumeEnvelope(key, e, offset, reader)
+		if err != nil {
+			t.Fatalf("Offset %d: %v", offset, err)
+		}
+
+		decrypted, err := ioutil.ReadAll(contents)
+		if err != nil {
+			t.Fatalf("Offset %d: %v", offset, err)
+		}
+		if bytes.Equal(decrypted, plain[offset-e.HeaderSize:]) == false {
+			t.Fatalf("Offset %d: decrypted data does not match", offset)
+		}
+	}
+
+	for _, offset := range []int64{0, int64(STREAM_CHUNK_SIZE) + 1, 5 * int64(STREAM_CHUNK_SIZE)} {
+		_, err = ResumeEnvelope(key, e, offset, bytes.NewReader(nil))
+		if err == nil {
+			t.Fatalf("Invalid offset %d accepted", offset)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// ##### Constants ###########################################################
+
+// BACKUP_PREFIX identifies the text of a crypto data backup
+const BACKUP_PREFIX string = "filesender-backup:"
+
+// exportAAD binds the exported crypto data to its purpose
+const exportAAD string = "filesender key export"
+
+// ##### Functions ###########################################################
+
+// SealExport encrypts the crypto data using the key exchanged with the importing
+// computer, the crypto data only holds keys that are wrapped by the passwords
+func SealExport(key []byte, data []byte) ([]byte, error) {
+
+	return sealBytes(key, data, exportAAD)
+}
+
+// OpenExport decrypts the crypto data encrypted by SealExport
+func OpenExport(key []byte, sealed []byte) ([]byte, error) {
+
+	data, err := openBytes(key, sealed, exportAAD)
+	if err != nil {
+		return nil, errors.New("Unable to decrypt the crypto data")
+	}
+
+	return data, nil
+}
+
+// EncodeBackup returns the crypto data as text that can be printed, or stored in a
+// QR code. The crypto data only holds keys that are wrapped by the passwords
+func EncodeBackup(data []byte) string {
+
+	return BACKUP_PREFIX + base64.StdEncoding.EncodeToString(data)
+}
+
+// DecodeBackup returns the crypto data from the backup text, any whitespace
+// e.g. from the text being split across lines is ignored
+func DecodeBackup(text string) ([]byte, error) {
+
+	text = strings.Join(strings.Fields(text), "")
+	if strings.HasPrefix(text, BACKUP_PREFIX) == false {
+		return nil, errors.New("Not a crypto data backup")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(text, BACKUP_PREFIX))
+	if err != nil {
+		return nil, errors.New("Invalid crypto data backup")
+	}
+
+	return data, nil
+}
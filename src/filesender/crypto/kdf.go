@@ -0,0 +1,138 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+
+	config "filesender/config"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ##### Constants ###########################################################
+
+// The supported key derivation functions
+const KDF_ARGON2ID string = "argon2id"
+const KDF_SCRYPT string = "scrypt"
+const KDF_PBKDF2 string = "pbkdf2"
+
+const DEFAULT_KDF string = KDF_ARGON2ID
+
+// DEFAULT_KDF_TIME is the unlock time targeted when calibrating the cost parameters
+const DEFAULT_KDF_TIME time.Duration = 1 * time.Second
+
+// LEGACY_PBKDF2_ITERATIONS is the PBKDF2 iteration count used by configs that have no KDF
+const LEGACY_PBKDF2_ITERATIONS int = 65536
+
+// DERIVED_KEY_SIZE is the size of the derived key, the first half is stored to validate
+// the password, and the second half is the key encryption key
+const DERIVED_KEY_SIZE int = 64
+
+const argon2Memory int = 64 * 1024
+const maxArgon2Threads int = 4
+const scryptR int = 8
+const scryptP int = 1
+const minScryptN int = 1 << 14
+
+// ##### Functions ###########################################################
+
+// LegacyKDF returns the KDF used by configs generated before the KDF was configurable
+func LegacyKDF() config.KDF {
+
+	return config.KDF{Algorithm: KDF_PBKDF2, Iterations: LEGACY_PBKDF2_ITERATIONS}
+}
+
+// DeriveKey derives the 64 byte key from the password and salt using the KDF
+func DeriveKey(password []byte, salt []byte, kdf config.KDF) ([]byte, error) {
+
+	switch kdf.Algorithm {
+	case "", KDF_PBKDF2:
+		iterations := kdf.Iterations
+		if iterations == 0 {
+			iterations = LEGACY_PBKDF2_ITERATIONS
+		}
+		return pbkdf2.Key(password, salt, iterations, DERIVED_KEY_SIZE, sha256.New), nil
+
+	case KDF_ARGON2ID:
+		if kdf.Iterations < 1 || kdf.Memory < 8 || kdf.Threads < 1 || kdf.Threads > 255 {
+			return nil, errors.New("Invalid argon2id parameters")
+		}
+		return argon2.IDKey(password, salt, uint32(kdf.Iterations), uint32(kdf.Memory), uint8(kdf.Threads), uint32(DERIVED_KEY_SIZE)), nil
+
+	case KDF_SCRYPT:
+		return scrypt.Key(password, salt, kdf.N, kdf.R, kdf.P, DERIVED_KEY_SIZE)
+
+	default:
+		return nil, fmt.Errorf("Unsupported key derivation function: %s", kdf.Algorithm)
+	}
+}
+
+// timeKDF returns how long it takes to derive a key using the KDF
+func timeKDF(kdf config.KDF) (time.Duration, error) {
+
+	start := time.Now()
+	_, err := DeriveKey([]byte("calibration"), make([]byte, 32), kdf)
+	return time.Since(start), err
+}
+
+// CalibrateKDF determines the cost parameters for the algorithm, so that deriving
+// a key takes roughly the target time on this computer. The cost is never
+// reduced below the recommended minimums, so a slow computer may exceed the target
+func CalibrateKDF(algorithm string, target time.Duration) (config.KDF, error) {
+
+	switch algorithm {
+	case KDF_ARGON2ID:
+		// The memory is fixed, and the number of passes is increased
+		threads := runtime.NumCPU()
+		if threads > maxArgon2Threads {
+			threads = maxArgon2Threads
+		}
+
+		kdf := config.KDF{Algorithm: KDF_ARGON2ID, Iterations: 1, Memory: argon2Memory, Threads: threads}
+		elapsed, err := timeKDF(kdf)
+		if err != nil {
+			return kdf, err
+		}
+
+		kdf.Iterations = int(target / elapsed)
+		if kdf.Iterations < 1 {
+			kdf.Iterations = 1
+		}
+		return kdf, nil
+
+	case KDF_SCRYPT:
+		// N must be a power of two, so it is doubled until the target is reached
+		kdf := config.KDF{Algorithm: KDF_SCRYPT, N: minScryptN, R: scryptR, P: scryptP}
+		for {
+			elapsed, err := timeKDF(kdf)
+			if err != nil {
+				return kdf, err
+			}
+			if elapsed*2 > target || kdf.N >= 1<<24 {
+				return kdf, nil
+			}
+			kdf.N *= 2
+		}
+
+	case KDF_PBKDF2:
+		kdf := LegacyKDF()
+		elapsed, err := timeKDF(kdf)
+		if err != nil {
+			return kdf, err
+		}
+
+		iterations := int(int64(kdf.Iterations) * int64(target) / int64(elapsed))
+		if iterations > kdf.Iterations {
+			kdf.Iterations = iterations
+		}
+		return kdf, nil
+
+	default:
+		return config.KDF{}, fmt.Errorf("Unsupported key derivation function: %s", algorithm)
+	}
+}
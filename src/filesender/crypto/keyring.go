@@ -0,0 +1,302 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	config "filesender/config"
+	helper "filesender/utils"
+)
+
+// ##### Constants ###########################################################
+
+// KEY_SIZE is the size of the encryption keys
+const KEY_SIZE int = 32
+
+// ##### Structs #############################################################
+
+// Keyring holds the unlocked current encryption key, plus the retired keys
+// that are kept to decrypt files encrypted before the key was rotated. The
+// encryption keys are encrypted using the unlock key, which is shared by all
+// of the key slots so that rotating the key does not require every password
+type Keyring struct {
+	Key       []byte
+	config    *config.Config
+	slot      int
+	unlockKey []byte
+	retired   map[string][]byte
+	legacy    []byte
+}
+
+// ##### Functions ###########################################################
+
+// KeyID returns the identifier of the encryption key, which is stored in the
+// file meta data so that the receiver knows which key was used
+func KeyID(key []byte) string {
+
+	h := sha256.Sum256(append([]byte("filesender key id:"), key...))
+	return hex.EncodeToString(h[:8])
+}
+
+// UnlockKeyring decrypts the current encryption key and the retired keys
+// using values from the config file and the user's passphrase
+func UnlockKeyring(password string) *Keyring {
+
+	c, slot, unlockKey := unlockConfig(password)
+
+	k := &Keyring{
+		Key:       unlockKey,
+		config:    c,
+		slot:      slot,
+		unlockKey: unlockKey,
+		retired:   make(map[string][]byte, 0),
+	}
+
+	if len(c.CurrentKey.KeyID) > 0 {
+		key, err := unwrapKey(unlockKey, c.CurrentKey)
+		if err != nil {
+			helper.OutputAndExit(fmt.Sprintf("Unable to decrypt current key %s: %v", c.CurrentKey.KeyID, err))
+		}
+		k.Key = key
+	}
+
+	for _, rk := range c.RetiredKeys {
+		retiredKey, err := unwrapKey(unlockKey, rk)
+		if err != nil {
+			helper.OutputAndExit(fmt.Sprintf("Unable to decrypt retired key %s: %v", rk.KeyID, err))
+		}
+
+		k.retired[rk.KeyID] = retiredKey
+		if rk.Legacy == true {
+			k.legacy = retiredKey
+		}
+	}
+
+	return k
+}
+
+// newGCM returns the AES-256-GCM cipher for the key
+func newGCM(key []byte) (cipher.AEAD, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// wrapKey encrypts the encryption key using the unlock key
+func wrapKey(unlockKey []byte, key []byte, legacy bool) (config.WrappedKey, error) {
+
+	aead, err := newGCM(unlockKey)
+	if err != nil {
+		return config.WrappedKey{}, err
+	}
+
+	nonce, err := randomBytes(aead.NonceSize())
+	if err != nil {
+		return config.WrappedKey{}, err
+	}
+
+	id := KeyID(key)
+	return config.WrappedKey{
+		KeyID:        id,
+		EncryptedKey: hex.EncodeToString(aead.Seal(nil, nonce, key, []byte(id))),
+		Nonce:        hex.EncodeToString(nonce),
+		Legacy:       legacy,
+	}, nil
+}
+
+// unwrapKey decrypts the encryption key using the unlock key
+func unwrapKey(unlockKey []byte, rk config.WrappedKey) ([]byte, error) {
+
+	aead, err := newGCM(unlockKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := hex.DecodeString(rk.Nonce)
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("Invalid nonce")
+	}
+
+	encryptedKey, err := hex.DecodeString(rk.EncryptedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, nonce, encryptedKey, []byte(rk.KeyID))
+}
+
+// ##### Methods #############################################################
+
+// ID returns the identifier of the current encryption key
+func (k *Keyring) ID() string {
+
+	return KeyID(k.Key)
+}
+
+// RetiredIDs returns the identifiers of the retired keys, oldest first
+func (k *Keyring) RetiredIDs() []string {
+
+	ids := make([]string, 0)
+	for _, rk := range k.config.RetiredKeys {
+		ids = append(ids, rk.KeyID)
+	}
+
+	return ids
+}
+
+// Find returns the encryption key with the identifier. Files encrypted before key
+// identifiers were stored have no identifier, and use the key that was current
+// when the key was first rotated
+func (k *Keyring) Find(id string) ([]byte, error) {
+
+	if len(id) == 0 {
+		if k.legacy != nil {
+			return k.legacy, nil
+		}
+		return k.Key, nil
+	}
+
+	if id == k.ID() {
+		return k.Key, nil
+	}
+
+	key, ok := k.retired[id]
+	if ok == false {
+		return nil, fmt.Errorf("File was encrypted with an unknown key [%s], it may have been pruned or be from a different crypto config", id)
+	}
+
+	return key, nil
+}
+
+// ChangePassword encrypts the unlock key using the new password, replacing the slot
+// that was unlocked. The encryption keys are unchanged so existing encrypted files
+// can still be decrypted
+func (k *Keyring) ChangePassword(password string, kdf config.KDF) error {
+
+	slots := k.config.GetSlots()
+
+	slot, err := SealSlot(slots[k.slot].Name, password, k.unlockKey, kdf)
+	if err != nil {
+		return err
+	}
+
+	slots[k.slot] = slot
+	k.config.SetSlots(slots)
+	return nil
+}
+
+// SlotName returns the name of the slot that was unlocked
+func (k *Keyring) SlotName() string {
+
+	return k.config.GetSlots()[k.slot].Name
+}
+
+// AddSlot adds a key slot, so that the crypto data can also be unlocked using the password
+func (k *Keyring) AddSlot(name string, password string, kdf config.KDF) error {
+
+	slots := k.config.GetSlots()
+	for _, slot := range slots {
+		if slot.Name == name {
+			return fmt.Errorf("Slot already exists: %s", name)
+		}
+	}
+
+	slot, err := SealSlot(name, password, k.unlockKey, kdf)
+	if err != nil {
+		return err
+	}
+
+	k.config.SetSlots(append(slots, slot))
+	return nil
+}
+
+// RemoveSlot removes the key slot, the last slot cannot be removed
+func (k *Keyring) RemoveSlot(name string) error {
+
+	slots := k.config.GetSlots()
+	if len(slots) == 1 {
+		return fmt.Errorf("Unable to remove the last slot")
+	}
+
+	for i, slot := range slots {
+		if slot.Name != name {
+			continue
+		}
+
+		k.config.SetSlots(append(slots[:i], slots[i+1:]...))
+		if i < k.slot {
+			k.slot--
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Slot does not exist: %s", name)
+}
+
+// Rotate replaces the current encryption key with a new random key. The
+// previous key is retired, and all of the keys remain encrypted using the
+// unlock key, so every key slot can still unlock them
+func (k *Keyring) Rotate() error {
+
+	key, err := randomBytes(KEY_SIZE)
+	if err != nil {
+		return err
+	}
+
+	// The first key to be retired is used for files without a key identifier
+	retired, err := wrapKey(k.unlockKey, k.Key, k.legacy == nil)
+	if err != nil {
+		return err
+	}
+
+	current, err := wrapKey(k.unlockKey, key, false)
+	if err != nil {
+		return err
+	}
+
+	if k.legacy == nil {
+		k.legacy = k.Key
+	}
+	k.retired[KeyID(k.Key)] = k.Key
+	k.config.RetiredKeys = append(k.config.RetiredKeys, retired)
+	k.config.CurrentKey = current
+	k.Key = key
+
+	return nil
+}
+
+// Prune removes the retired keys that are not in use. The legacy key is
+// kept if any files without a key identifier are in use
+func (k *Keyring) Prune(inUse map[string]bool, legacyInUse bool) []string {
+
+	removed := make([]string, 0)
+	retiredKeys := make([]config.WrappedKey, 0)
+	for _, rk := range k.config.RetiredKeys {
+		if inUse[rk.KeyID] == true || (rk.Legacy == true && legacyInUse == true) {
+			retiredKeys = append(retiredKeys, rk)
+			continue
+		}
+
+		removed = append(removed, rk.KeyID)
+		delete(k.retired, rk.KeyID)
+		if rk.Legacy == true {
+			k.legacy = nil
+		}
+	}
+
+	k.config.RetiredKeys = retiredKeys
+	return removed
+}
+
+// Save writes the keyring to the config file
+func (k *Keyring) Save() {
+
+	k.config.Save()
+}
@@ -0,0 +1,238 @@
+package crypto
+
+import (
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"math/big"
+)
+
+// ##### Constants ###########################################################
+
+// PAKE roles, the sender is party A and the receiver is party B
+const PAKE_SENDER int = 0
+const PAKE_RECEIVER int = 1
+
+// ##### Variables ###########################################################
+
+// The SPAKE2 points M and N are generated by hashing fixed seeds onto the
+// curve, so that nobody knows their discrete logarithms
+var pakeM = hashToPoint("filesender SPAKE2 M")
+var pakeN = hashToPoint("filesender SPAKE2 N")
+
+// ##### Structs #############################################################
+
+// point is a point on the P-256 curve
+type point struct {
+	x, y *big.Int
+}
+
+// Pake performs a SPAKE2 password authenticated key exchange over P-256,
+// using the mnemonicode as the password. Each party sends its message to the
+// other, and the derived session key is only shared if both used the same code
+type Pake struct {
+	role      int
+	w         *big.Int
+	secret    []byte
+	message   []byte
+	key       []byte
+	confirmA  []byte
+	confirmB  []byte
+	completed bool
+}
+
+// ##### Functions ###########################################################
+
+// hashToPoint deterministically maps the seed onto a point on the curve by
+// hashing it with an incrementing counter until the hash is a valid x coordinate
+func hashToPoint(seed string) point {
+
+	curve := elliptic.P256()
+	params := curve.Params()
+	three := big.NewInt(3)
+
+	for counter := uint32(0); ; counter++ {
+		ctr := make([]byte, 4)
+		binary.BigEndian.PutUint32(ctr, counter)
+		h := sha256.Sum256(append([]byte(seed), ctr...))
+
+		x := new(big.Int).SetBytes(h[:])
+		if x.Cmp(params.P) >= 0 {
+			continue
+		}
+
+		// y² = x³ - 3x + b
+		y2 := new(big.Int).Exp(x, three, params.P)
+		y2.Sub(y2, new(big.Int).Mul(x, three))
+		y2.Add(y2, params.B)
+		y2.Mod(y2, params.P)
+
+		y := new(big.Int).ModSqrt(y2, params.P)
+		if y == nil || curve.IsOnCurve(x, y) == false {
+			continue
+		}
+
+		return point{x, y}
+	}
+}
+
+// NewPake starts the key exchange for the role, using the code as the password
+func NewPake(code string, role int) (*Pake, error) {
+
+	curve := elliptic.P256()
+	n := curve.Params().N
+
+	h := sha256.Sum256([]byte("filesender SPAKE2 password:" + code))
+	w := new(big.Int).Mod(new(big.Int).SetBytes(h[:]), n)
+
+	secret, err := randomScalar(n)
+	if err != nil {
+		return nil, err
+	}
+
+	// A sends T = x*G + w*M, B sends S = y*G + w*N
+	blind := pakeM
+	if role == PAKE_RECEIVER {
+		blind = pakeN
+	}
+
+	gx, gy := curve.ScalarBaseMult(secret)
+	bx, by := curve.ScalarMult(blind.x, blind.y, w.Bytes())
+	mx, my := curve.Add(gx, gy, bx, by)
+
+	return &Pake{
+		role:    role,
+		w:       w,
+		secret:  secret,
+		message: elliptic.Marshal(curve, mx, my),
+	}, nil
+}
+
+// randomScalar returns a random non zero scalar less than n
+func randomScalar(n *big.Int) ([]byte, error) {
+
+	for {
+		k, err := rand.Int(rand.Reader, n)
+		if err != nil {
+			return nil, err
+		}
+		if k.Sign() > 0 {
+			return k.Bytes(), nil
+		}
+	}
+}
+
+// appendField appends the length prefixed field to the transcript
+func appendField(tt []byte, field []byte) []byte {
+
+	l := make([]byte, 8)
+	binary.LittleEndian.PutUint64(l, uint64(len(field)))
+	tt = append(tt, l...)
+	return append(tt, field...)
+}
+
+// mac returns the HMAC-SHA256 of the data using the key
+func mac(key []byte, data []byte) []byte {
+
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// ##### Methods #############################################################
+
+// Message returns the message that must be sent to the other party
+func (p *Pake) Message() []byte {
+
+	return p.message
+}
+
+// Finish processes the message received from the other party, deriving the
+// session key and the key confirmation values
+func (p *Pake) Finish(peerMessage []byte) error {
+
+	curve := elliptic.P256()
+
+	px, py := elliptic.Unmarshal(curve, peerMessage)
+	if px == nil {
+		return errors.New("Invalid PAKE message")
+	}
+
+	// Remove the blinding from the other party's message, and multiply by our secret
+	blind := pakeN
+	if p.role == PAKE_RECEIVER {
+		blind = pakeM
+	}
+	bx, by := curve.ScalarMult(blind.x, blind.y, p.w.Bytes())
+	by = new(big.Int).Sub(curve.Params().P, by)
+	ux, uy := curve.Add(px, py, bx, by)
+	if ux.Sign() == 0 && uy.Sign() == 0 {
+		return errors.New("Invalid PAKE message")
+	}
+	kx, ky := curve.ScalarMult(ux, uy, p.secret)
+
+	msgA, msgB := p.message, peerMessage
+	if p.role == PAKE_RECEIVER {
+		msgA, msgB = peerMessage, p.message
+	}
+
+	tt := make([]byte, 0)
+	tt = appendField(tt, []byte("filesender sender"))
+	tt = appendField(tt, []byte("filesender receiver"))
+	tt = appendField(tt, msgA)
+	tt = appendField(tt, msgB)
+	tt = appendField(tt, elliptic.Marshal(curve, kx, ky))
+	tt = appendField(tt, p.w.Bytes())
+
+	// The first half of the transcript hash is the session key, the
+	// second half is used to derive the key confirmation keys
+	h := sha512.Sum512(tt)
+	p.key = h[:32]
+	ka := h[32:]
+
+	p.confirmA = mac(mac(ka, []byte("ConfirmationKey A")), tt)
+	p.confirmB = mac(mac(ka, []byte("ConfirmationKey B")), tt)
+	p.completed = true
+
+	return nil
+}
+
+// SessionKey returns the 32 byte key shared by both parties
+func (p *Pake) SessionKey() []byte {
+
+	return p.key
+}
+
+// Confirmation returns the key confirmation value that must be sent to the
+// other party, to prove that this party derived the same session key
+func (p *Pake) Confirmation() []byte {
+
+	if p.role == PAKE_SENDER {
+		return p.confirmA
+	}
+
+	return p.confirmB
+}
+
+// Verify checks the key confirmation value received from the other party
+func (p *Pake) Verify(peerConfirmation []byte) error {
+
+	if p.completed == false {
+		return errors.New("PAKE exchange not completed")
+	}
+
+	expected := p.confirmB
+	if p.role == PAKE_RECEIVER {
+		expected = p.confirmA
+	}
+
+	if hmac.Equal(expected, peerConfirmation) == false {
+		return errors.New("PAKE key confirmation failed, the codes do not match")
+	}
+
+	return nil
+}
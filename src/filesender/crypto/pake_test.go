@@ -0,0 +1,125 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"testing"
+)
+
+// ##### Functions ###########################################################
+
+// exchange runs the key exchange between a sender and a receiver using the codes
+func exchange(t *testing.T, senderCode string, receiverCode string) (*Pake, *Pake) {
+
+	t.Helper()
+
+	sender, err := NewPake(senderCode, PAKE_SENDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := NewPake(receiverCode, PAKE_RECEIVER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = receiver.Finish(sender.Message())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sender.Finish(receiver.Message())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sender, receiver
+}
+
+// TestPakeSameCode checks that both parties derive the same key and accept each others confirmation
+func TestPakeSameCode(t *testing.T) {
+
+	sender, receiver := exchange(t, "alpha-bravo-charlie-delta", "alpha-bravo-charlie-delta")
+
+	if len(sender.SessionKey()) != 32 || bytes.Equal(sender.SessionKey(), receiver.SessionKey()) == false {
+		t.Fatalf("Session keys do not match")
+	}
+
+	err := sender.Verify(receiver.Confirmation())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = receiver.Verify(sender.Confirmation())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A party's own confirmation is not accepted, so it cannot be reflected back
+	if sender.Verify(sender.Confirmation()) == nil || receiver.Verify(receiver.Confirmation()) == nil {
+		t.Fatalf("Reflected confirmation was accepted")
+	}
+}
+
+// TestPakeWrongCode checks that the keys differ and the confirmations fail when the codes differ
+func TestPakeWrongCode(t *testing.T) {
+
+	sender, receiver := exchange(t, "alpha-bravo-charlie-delta", "alpha-bravo-charlie-echo")
+
+	if bytes.Equal(sender.SessionKey(), receiver.SessionKey()) == true {
+		t.Fatalf("Session keys match for different codes")
+	}
+
+	if sender.Verify(receiver.Confirmation()) == nil {
+		t.Fatalf("Sender accepted the confirmation for a different code")
+	}
+
+	if receiver.Verify(sender.Confirmation()) == nil {
+		t.Fatalf("Receiver accepted the confirmation for a different code")
+	}
+}
+
+// TestPakeFreshKeys checks that each exchange with the same code derives a different key
+func TestPakeFreshKeys(t *testing.T) {
+
+	first, _ := exchange(t, "alpha-bravo-charlie", "alpha-bravo-charlie")
+	second, _ := exchange(t, "alpha-bravo-charlie", "alpha-bravo-charlie")
+
+	if bytes.Equal(first.Message(), second.Message()) == true || bytes.Equal(first.SessionKey(), second.SessionKey()) == true {
+		t.Fatalf("Exchanges using the same code are not randomised")
+	}
+}
+
+// TestPakeInvalidMessage checks that messages that are not points on the curve are rejected
+func TestPakeInvalidMessage(t *testing.T) {
+
+	p, err := NewPake("alpha-bravo-charlie", PAKE_SENDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Verify(make([]byte, 32)) == nil {
+		t.Fatalf("Confirmation accepted before the exchange completed")
+	}
+
+	for _, msg := range [][]byte{nil, []byte("invalid"), make([]byte, 65)} {
+		if p.Finish(msg) == nil {
+			t.Fatalf("Invalid message %x accepted", msg)
+		}
+	}
+}
+
+// TestPakePoints checks that M and N are distinct points on the curve
+func TestPakePoints(t *testing.T) {
+
+	curve := elliptic.P256()
+	for _, pt := range []point{pakeM, pakeN} {
+		if curve.IsOnCurve(pt.x, pt.y) == false {
+			t.Fatalf("Point is not on the curve")
+		}
+	}
+
+	if pakeM.x.Cmp(pakeN.x) == 0 {
+		t.Fatalf("M and N are the same point")
+	}
+}
@@ -0,0 +1,171 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// ##### Constants ###########################################################
+
+// FORMAT_PGP is the format of files encrypted to OpenPGP public keys, which
+// are standard OpenPGP messages so they can also be decrypted using GnuPG
+const FORMAT_PGP string = "pgp"
+
+// PGP_SECRET_KEYRING is the default keyring holding the OpenPGP secret keys used to decrypt
+// files, and any public keys used to verify the sender's signature
+const PGP_SECRET_KEYRING string = "secring.asc"
+
+// ##### Variables ###########################################################
+
+var ErrPGPIncorrectPassphrase = errors.New("Incorrect OpenPGP passphrase")
+
+// pgpConfig prefers AES-256, the recipients' key preferences take precedence
+var pgpConfig = &packet.Config{DefaultCipher: packet.CipherAES256}
+
+// ##### Structs #############################################################
+
+// pgpReader returns an error at the end of the message if the signature is invalid, the
+// signature is only checked once the whole message has been read
+type pgpReader struct {
+	md *openpgp.MessageDetails
+}
+
+// ##### Functions ###########################################################
+
+// ReadKeyRing reads the OpenPGP keys from the keyring file, which is normally
+// ASCII armored e.g. "gpg --export --armor", but may also be binary
+func ReadKeyRing(path string) (openpgp.EntityList, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	el, err := openpgp.ReadArmoredKeyRing(f)
+	if err == nil {
+		return el, nil
+	}
+
+	_, serr := f.Seek(0, io.SeekStart)
+	if serr != nil {
+		return nil, serr
+	}
+
+	el, berr := openpgp.ReadKeyRing(f)
+	if berr != nil {
+		return nil, fmt.Errorf("Invalid keyring %s: %v", path, err)
+	}
+
+	return el, nil
+}
+
+// UnlockEntity decrypts the entity's private keys using the passphrase, if they are encrypted
+func UnlockEntity(e *openpgp.Entity, passphrase []byte) error {
+
+	if e.PrivateKey == nil {
+		return errors.New("Keyring does not contain a secret key")
+	}
+
+	keys := []*packet.PrivateKey{e.PrivateKey}
+	for _, subkey := range e.Subkeys {
+		if subkey.PrivateKey != nil {
+			keys = append(keys, subkey.PrivateKey)
+		}
+	}
+
+	for _, key := range keys {
+		if key.Encrypted == false {
+			continue
+		}
+
+		err := key.Decrypt(passphrase)
+		if err != nil {
+			return ErrPGPIncorrectPassphrase
+		}
+	}
+
+	return nil
+}
+
+// EncryptPGP encrypts the byte stream from the given io.Reader to the recipients' public
+// keys as an OpenPGP message, writing it to the given io.Writer. The message is also
+// signed if a signer, whose private key has been unlocked, is supplied
+func EncryptPGP(w io.Writer, recipients openpgp.EntityList, signer *openpgp.Entity, reader io.Reader, fileName string) error {
+
+	hints := &openpgp.FileHints{IsBinary: true, FileName: filepath.Base(fileName)}
+
+	pw, err := openpgp.Encrypt(w, recipients, signer, hints, pgpConfig)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(pw, reader)
+	if err != nil {
+		pw.Close()
+		return err
+	}
+
+	return pw.Close()
+}
+
+// NewPGPDecrypter returns an io.Reader that decrypts the OpenPGP message from the given
+// io.Reader using the keyring. The prompt is called to obtain the passphrase if the secret
+// key is encrypted. The returned message details are complete once the reader is exhausted
+func NewPGPDecrypter(keyring openpgp.EntityList, reader io.Reader, prompt func() ([]byte, error)) (io.Reader, *openpgp.MessageDetails, error) {
+
+	prompted := false
+	unlock := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+
+		// ReadMessage calls this again if no key was unlocked, so only prompt once
+		if prompted == true || symmetric == true {
+			return nil, ErrPGPIncorrectPassphrase
+		}
+		prompted = true
+
+		passphrase, err := prompt()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, k := range keys {
+			if k.PrivateKey.Encrypted == true {
+				k.PrivateKey.Decrypt(passphrase)
+			}
+		}
+
+		return nil, nil
+	}
+
+	md, err := openpgp.ReadMessage(reader, keyring, unlock, pgpConfig)
+	if err != nil {
+		if err == ErrPGPIncorrectPassphrase {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("File was not encrypted to a local secret key: %v", err)
+	}
+
+	if md.IsEncrypted == false {
+		return nil, nil, errors.New("File is not an encrypted OpenPGP message")
+	}
+
+	return io.MultiReader(md.UnverifiedBody, &pgpReader{md: md}), md, nil
+}
+
+// ##### Methods #############################################################
+
+// Read reports an invalid signature once the message body has been read
+func (p *pgpReader) Read(b []byte) (int, error) {
+
+	if p.md.IsSigned == true && p.md.SignedBy != nil && p.md.SignatureError != nil {
+		return 0, fmt.Errorf("OpenPGP signature is invalid: %v", p.md.SignatureError)
+	}
+
+	return 0, io.EOF
+}
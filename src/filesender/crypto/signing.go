@@ -0,0 +1,154 @@
+package crypto
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ##### Constants ###########################################################
+
+// SIGNING_KEY_FILE is the file holding the sender's Ed25519 signing key
+const SIGNING_KEY_FILE string = "signing.key"
+
+// ##### Variables ###########################################################
+
+var ErrManifestSignature = errors.New("Manifest signature is invalid")
+
+// ##### Structs #############################################################
+
+// Manifest describes a transfer, it is signed by the sender so that the receiver
+// can verify who sent the file, and that the file is the one that was sent. As in
+// the meta data, the SHA256 is of the encrypted bytes for the envelope format
+type Manifest struct {
+	TransferID string    `json:"transfer_id"`
+	Code       string    `json:"code"`
+	FileName   string    `json:"file_name"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	Created    time.Time `json:"created"`
+}
+
+// SignedManifest is the manifest record stored alongside the upload. The signature
+// covers the exact manifest bytes, so the manifest is not re-encoded before verifying
+type SignedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	PublicKey []byte          `json:"public_key"`
+	Signature []byte          `json:"signature"`
+}
+
+// ##### Functions ###########################################################
+
+// GenerateSigningKey creates a new Ed25519 signing key and writes it to the
+// file, which is only readable by the current user
+func GenerateSigningKey(path string) (ed25519.PrivateKey, error) {
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fmt.Fprintf(f, "# created: %s\n# fingerprint: %s\n%s\n", time.Now().Format(time.RFC3339), Fingerprint(publicKey), base64.StdEncoding.EncodeToString(privateKey.Seed()))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return privateKey, f.Close()
+}
+
+// LoadSigningKey reads the signing key from the file, lines starting with # are comments
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") == true {
+			continue
+		}
+
+		seed, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("Invalid signing key: %s", path)
+		}
+
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+
+	return nil, fmt.Errorf("Signing key file does not contain a key: %s", path)
+}
+
+// Fingerprint returns the SSH style fingerprint of the public key, which is displayed
+// so that the receiver can compare it with the fingerprint reported by the sender
+func Fingerprint(publicKey ed25519.PublicKey) string {
+
+	h := sha256.Sum256(publicKey)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(h[:])
+}
+
+// SignManifest signs the manifest, and returns the signed manifest record
+func SignManifest(privateKey ed25519.PrivateKey, m *Manifest) ([]byte, error) {
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(SignedManifest{
+		Manifest:  data,
+		PublicKey: privateKey.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(privateKey, data),
+	})
+}
+
+// VerifyManifest verifies the signature of the signed manifest record, and returns
+// the manifest and the public key that signed it. Whether the public key is
+// trusted is decided by the caller
+func VerifyManifest(data []byte) (*Manifest, ed25519.PublicKey, error) {
+
+	sm := &SignedManifest{}
+	err := json.Unmarshal(data, sm)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid manifest record: %v", err)
+	}
+
+	if len(sm.PublicKey) != ed25519.PublicKeySize {
+		return nil, nil, errors.New("Invalid manifest public key")
+	}
+
+	publicKey := ed25519.PublicKey(sm.PublicKey)
+	if ed25519.Verify(publicKey, sm.Manifest, sm.Signature) == false {
+		return nil, nil, ErrManifestSignature
+	}
+
+	m := &Manifest{}
+	err = json.Unmarshal(sm.Manifest, m)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid manifest: %v", err)
+	}
+
+	return m, publicKey, nil
+}
@@ -0,0 +1,265 @@
+package crypto
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+// ##### Constants ###########################################################
+
+// The encryption format versions, which are stored in the file meta data. Files
+// without a format version were encrypted using the legacy AES-256-CFB format
+const FORMAT_CFB string = "1"
+const FORMAT_STREAM string = "2"
+
+// STREAM_SALT_SIZE is the size of the random salt that precedes the encrypted
+// chunks, which is used to derive a unique key for each file
+const STREAM_SALT_SIZE int = 16
+
+// STREAM_CHUNK_SIZE is the size of the plaintext in each chunk, the final
+// chunk may be shorter (or empty if the file is empty)
+const STREAM_CHUNK_SIZE int = 64 * 1024
+
+const streamTagSize int = 16
+const streamNonceSize int = 12
+
+// ##### Variables ###########################################################
+
+var ErrStreamAuthentication = errors.New("File contents failed authentication, the file has been modified or corrupted")
+var ErrStreamTruncated = errors.New("File contents are truncated")
+
+// ##### Structs #############################################################
+
+// streamEncrypter encrypts the plaintext into fixed size AES-256-GCM chunks.
+// Each chunk nonce is an incrementing counter plus a final chunk flag, so that
+// chunks cannot be reordered, removed or appended without detection
+type streamEncrypter struct {
+	aead    cipher.AEAD
+	reader  io.Reader
+	counter uint64
+	buf     []byte
+	pending []byte
+	done    bool
+	err     error
+}
+
+// streamDecrypter decrypts and authenticates the chunks produced by streamEncrypter
+type streamDecrypter struct {
+	aead    cipher.AEAD
+	reader  *bufio.Reader
+	counter uint64
+	buf     []byte
+	pending []byte
+	done    bool
+	err     error
+}
+
+// ##### Functions ###########################################################
+
+// newStreamAEAD derives the file key from the key and salt, so that the
+// chunk counters never repeat for the same key across files
+func newStreamAEAD(key []byte, salt []byte) (cipher.AEAD, error) {
+
+	if key == nil {
+		return nil, errors.New("Uninitialized key")
+	}
+
+	if len(salt) != STREAM_SALT_SIZE {
+		return nil, errors.New("Invalid salt length")
+	}
+
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte("filesender stream v2"))
+	h.Write(salt)
+
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// streamNonce returns the nonce for the chunk: an 11 byte big endian
+// counter followed by a byte that is 1 for the final chunk
+func streamNonce(counter uint64, final bool) []byte {
+
+	nonce := make([]byte, streamNonceSize)
+	for i := 0; i < 8; i++ {
+		nonce[10-i] = byte(counter >> (8 * uint(i)))
+	}
+	if final == true {
+		nonce[11] = 1
+	}
+
+	return nonce
+}
+
+// StreamSize returns the encrypted size of a plaintext of the given size,
+// excluding the salt that precedes the chunks
+func StreamSize(size int64) int64 {
+
+	chunks := size / int64(STREAM_CHUNK_SIZE)
+	if size%int64(STREAM_CHUNK_SIZE) != 0 || size == 0 {
+		chunks++
+	}
+
+	return size + chunks*int64(streamTagSize)
+}
+
+// NewStreamEncrypter returns an io.Reader that encrypts the byte stream from
+// the given io.Reader using the key and salt, in the chunked AEAD format
+func NewStreamEncrypter(key []byte, salt []byte, reader io.Reader) (io.Reader, error) {
+
+	aead, err := newStreamAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamEncrypter{
+		aead:   aead,
+		reader: bufio.NewReaderSize(reader, STREAM_CHUNK_SIZE+1),
+		buf:    make([]byte, STREAM_CHUNK_SIZE),
+	}, nil
+}
+
+// NewStreamDecrypter returns an io.Reader that decrypts the byte stream from the
+// given io.Reader using the key and salt. Reads return an error if any chunk has
+// been modified, or if the stream ends before the final chunk
+func NewStreamDecrypter(key []byte, salt []byte, reader io.Reader) (io.Reader, error) {
+
+	return NewStreamDecrypterAt(key, salt, reader, 0)
+}
+
+// NewStreamDecrypterAt returns an io.Reader that decrypts the byte stream from the given
+// io.Reader starting at the chunk with the counter e.g. to resume a download. The given
+// io.Reader must start at the chunk, which is at StreamSize(counter * STREAM_CHUNK_SIZE)
+func NewStreamDecrypterAt(key []byte, salt []byte, reader io.Reader, counter uint64) (io.Reader, error) {
+
+	aead, err := newStreamAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamDecrypter{
+		aead:    aead,
+		reader:  bufio.NewReaderSize(reader, STREAM_CHUNK_SIZE+streamTagSize+1),
+		counter: counter,
+		buf:     make([]byte, STREAM_CHUNK_SIZE+streamTagSize),
+	}, nil
+}
+
+// isFinal reports whether the reader has no more data after the current chunk
+func isFinal(reader io.Reader) (bool, error) {
+
+	_, err := reader.(*bufio.Reader).Peek(1)
+	if err == io.EOF {
+		return true, nil
+	}
+
+	return false, err
+}
+
+// ##### Methods #############################################################
+
+// Read encrypts the next chunk when the previous chunk has been consumed
+func (s *streamEncrypter) Read(p []byte) (int, error) {
+
+	for len(s.pending) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.done == true {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(s.reader, s.buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			s.err = err
+			continue
+		}
+
+		final := n < len(s.buf)
+		if final == false {
+			final, err = isFinal(s.reader)
+			if err != nil {
+				s.err = err
+				continue
+			}
+		}
+
+		s.pending = s.aead.Seal(nil, streamNonce(s.counter, final), s.buf[:n], nil)
+		s.counter++
+		s.done = final
+	}
+
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// Read decrypts and authenticates the next chunk when the previous chunk has been consumed
+func (s *streamDecrypter) Read(p []byte) (int, error) {
+
+	for len(s.pending) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.done == true {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(s.reader, s.buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			s.err = err
+			continue
+		}
+
+		if n < streamTagSize {
+			s.err = ErrStreamTruncated
+			continue
+		}
+
+		final := n < len(s.buf)
+		if final == false {
+			final, err = isFinal(s.reader)
+			if err != nil {
+				s.err = err
+				continue
+			}
+		}
+
+		plain, err := s.aead.Open(nil, streamNonce(s.counter, final), s.buf[:n], nil)
+		if err != nil {
+			// A full chunk that was not flagged as final means the stream was truncated
+			if final == true && n == len(s.buf) {
+				_, ferr := s.aead.Open(nil, streamNonce(s.counter, false), s.buf[:n], nil)
+				if ferr == nil {
+					s.err = ErrStreamTruncated
+					continue
+				}
+			}
+			s.err = ErrStreamAuthentication
+			continue
+		}
+
+		// Only the last chunk may be empty
+		if len(plain) == 0 && s.counter > 0 {
+			s.err = ErrStreamAuthentication
+			continue
+		}
+
+		s.pending = plain
+		s.counter++
+		s.done = final
+	}
+
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,219 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+// ##### Functions ###########################################################
+
+// encryptStream encrypts the plaintext in the stream format using a random key and salt
+func encryptStream(t *testing.T, plain []byte) ([]byte, []byte, []byte) {
+
+	t.Helper()
+
+	key := make([]byte, KEY_SIZE)
+	salt := make([]byte, STREAM_SALT_SIZE)
+	rand.Read(key)
+	rand.Read(salt)
+
+	reader, err := NewStreamEncrypter(key, salt, bytes.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, salt, ciphertext
+}
+
+// decryptStream decrypts the ciphertext, returning the plaintext read before any error
+func decryptStream(t *testing.T, key []byte, salt []byte, ciphertext []byte) ([]byte, error) {
+
+	t.Helper()
+
+	reader, err := NewStreamDecrypter(key, salt, bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ioutil.ReadAll(reader)
+}
+
+// TestStreamRoundTrip checks the sizes around the chunk boundaries
+func TestStreamRoundTrip(t *testing.T) {
+
+	for _, size := range []int{0, 1, STREAM_CHUNK_SIZE - 1, STREAM_CHUNK_SIZE, STREAM_CHUNK_SIZE + 1, 3 * STREAM_CHUNK_SIZE} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		key, salt, ciphertext := encryptStream(t, plain)
+		if int64(len(ciphertext)) != StreamSize(int64(size)) {
+			t.Fatalf("Size %d: ciphertext is %d bytes, StreamSize is %d", size, len(ciphertext), StreamSize(int64(size)))
+		}
+
+		decrypted, err := decryptStream(t, key, salt, ciphertext)
+		if err != nil {
+			t.Fatalf("Size %d: %v", size, err)
+		}
+		if bytes.Equal(decrypted, plain) == false {
+			t.Fatalf("Size %d: decrypted data does not match", size)
+		}
+	}
+}
+
+// TestStreamTruncated checks that removing whole chunks, or part of a chunk, is detected
+func TestStreamTruncated(t *testing.T) {
+
+	chunk := STREAM_CHUNK_SIZE + streamTagSize
+
+	// A multiple of the chunk size, so that removing the final chunk leaves only full chunks
+	plain := make([]byte, 2*STREAM_CHUNK_SIZE)
+	rand.Read(plain)
+	key, salt, ciphertext := encryptStream(t, plain)
+
+	_, err := decryptStream(t, key, salt, ciphertext[:chunk])
+	if err != ErrStreamTruncated {
+		t.Fatalf("Expected truncation for a missing final chunk, got %v", err)
+	}
+
+	_, err = decryptStream(t, key, salt, ciphertext[:len(ciphertext)-1])
+	if err != ErrStreamAuthentication {
+		t.Fatalf("Expected authentication failure for a partial chunk, got %v", err)
+	}
+
+	_, err = decryptStream(t, key, salt, ciphertext[:streamTagSize-1])
+	if err != ErrStreamTruncated {
+		t.Fatalf("Expected truncation for a chunk shorter than the tag, got %v", err)
+	}
+
+	_, err = decryptStream(t, key, salt, nil)
+	if err != ErrStreamTruncated {
+		t.Fatalf("Expected truncation for an empty stream, got %v", err)
+	}
+}
+
+// TestStreamReordered checks that swapping or repeating chunks is detected
+func TestStreamReordered(t *testing.T) {
+
+	chunk := STREAM_CHUNK_SIZE + streamTagSize
+
+	plain := make([]byte, 3*STREAM_CHUNK_SIZE)
+	rand.Read(plain)
+	key, salt, ciphertext := encryptStream(t, plain)
+
+	swapped := make([]byte, 0, len(ciphertext))
+	swapped = append(swapped, ciphertext[chunk:2*chunk]...)
+	swapped = append(swapped, ciphertext[:chunk]...)
+	swapped = append(swapped, ciphertext[2*chunk:]...)
+
+	decrypted, err := decryptStream(t, key, salt, swapped)
+	if err != ErrStreamAuthentication {
+		t.Fatalf("Expected authentication failure for swapped chunks, got %v", err)
+	}
+	if len(decrypted) != 0 {
+		t.Fatalf("Plaintext returned from a swapped chunk")
+	}
+
+	repeated := make([]byte, 0, len(ciphertext))
+	repeated = append(repeated, ciphertext[:chunk]...)
+	repeated = append(repeated, ciphertext[:chunk]...)
+	repeated = append(repeated, ciphertext[2*chunk:]...)
+
+	decrypted, err = decryptStream(t, key, salt, repeated)
+	if err != ErrStreamAuthentication {
+		t.Fatalf("Expected authentication failure for a repeated chunk, got %v", err)
+	}
+	if bytes.Equal(decrypted, plain[:STREAM_CHUNK_SIZE]) == false {
+		t.Fatalf("Only the first chunk should be returned before the repeated chunk")
+	}
+}
+
+// TestStreamFinalFlag checks that data appended after the final chunk, or a final
+// chunk from another stream with the same key, is detected
+func TestStreamFinalFlag(t *testing.T) {
+
+	plain := make([]byte, STREAM_CHUNK_SIZE/2)
+	rand.Read(plain)
+	key, salt, ciphertext := encryptStream(t, plain)
+
+	// The original final chunk is no longer the last chunk, so its flag does not match
+	_, err := decryptStream(t, key, salt, append(append([]byte{}, ciphertext...), ciphertext...))
+	if err != ErrStreamAuthentication {
+		t.Fatalf("Expected authentication failure for data after the final chunk, got %v", err)
+	}
+
+	// A final chunk cannot be decrypted as a non final chunk, and vice versa
+	aead, err := newStreamAEAD(key, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = aead.Open(nil, streamNonce(0, false), ciphertext, nil)
+	if err == nil {
+		t.Fatalf("Final chunk opened without the final flag")
+	}
+	_, err = aead.Open(nil, streamNonce(0, true), ciphertext, nil)
+	if err != nil {
+		t.Fatalf("Final chunk did not open with the final flag: %v", err)
+	}
+}
+
+// TestStreamModified checks that a modified byte, the wrong key or the wrong salt are detected
+func TestStreamModified(t *testing.T) {
+
+	plain := []byte("the file contents")
+	key, salt, ciphertext := encryptStream(t, plain)
+
+	modified := append([]byte{}, ciphertext...)
+	modified[3] ^= 0x80
+	_, err := decryptStream(t, key, salt, modified)
+	if err != ErrStreamAuthentication {
+		t.Fatalf("Expected authentication failure for a modified byte, got %v", err)
+	}
+
+	otherSalt := append([]byte{}, salt...)
+	otherSalt[0] ^= 1
+	_, err = decryptStream(t, key, otherSalt, ciphertext)
+	if err != ErrStreamAuthentication {
+		t.Fatalf("Expected authentication failure for the wrong salt, got %v", err)
+	}
+
+	_, err = NewStreamDecrypter(key, salt[:8], bytes.NewReader(ciphertext))
+	if err == nil {
+		t.Fatalf("Short salt accepted")
+	}
+}
+
+// TestStreamDecrypterAt checks that decryption can start at a later chunk, as used to resume downloads
+func TestStreamDecrypterAt(t *testing.T) {
+
+	plain := make([]byte, 2*STREAM_CHUNK_SIZE+100)
+	rand.Read(plain)
+	key, salt, ciphertext := encryptStream(t, plain)
+
+	offset := StreamSize(int64(STREAM_CHUNK_SIZE))
+	reader, err := NewStreamDecrypterAt(key, salt, bytes.NewReader(ciphertext[offset:]), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(decrypted, plain[STREAM_CHUNK_SIZE:]) == false {
+		t.Fatalf("Decrypted data from the checkpoint does not match")
+	}
+
+	// Starting with the wrong counter fails
+	reader, _ = NewStreamDecrypterAt(key, salt, bytes.NewReader(ciphertext[offset:]), 0)
+	_, err = ioutil.ReadAll(reader)
+	if err != ErrStreamAuthentication {
+		t.Fatalf("Expected authentication failure for the wrong counter, got %v", err)
+	}
+}
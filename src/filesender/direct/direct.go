@@ -0,0 +1,469 @@
+package direct
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	crypto "filesender/crypto"
+	relay "filesender/relay"
+)
+
+// ##### Constants ###########################################################
+
+// DISCOVERY_PORT is the UDP port that senders broadcast their announcements to
+const DISCOVERY_PORT int = 9009
+
+const ANNOUNCE_PREFIX string = "filesender2"
+const ANNOUNCE_INTERVAL time.Duration = 1 * time.Second
+const ACK string = "OK"
+
+// HANDSHAKE_TIMEOUT limits the time a peer has to complete the key exchange
+const HANDSHAKE_TIMEOUT time.Duration = 10 * time.Second
+
+// MAX_HANDSHAKE_FAILURES is the number of receivers presenting the wrong code that
+// the sender accepts before giving up, as each attempt is a guess of the code
+const MAX_HANDSHAKE_FAILURES int = 3
+
+// ##### Variables ###########################################################
+
+var ErrCodeMismatch = errors.New("Direct connection failed, the codes do not match")
+
+// ##### Structs #############################################################
+
+// Conn is a direct connection between a sender and a receiver. Both peers
+// prove that they know the code using a PAKE exchange, and the session key
+// is used to encrypt and authenticate everything sent on the connection
+type Conn struct {
+	net.Conn
+	raw    *bufio.Reader
+	reader *bufio.Reader
+	writer *recordWriter
+}
+
+// ##### Functions ###########################################################
+
+// Listen opens a TCP listener on a random port on all interfaces
+func Listen() (net.Listener, int, error) {
+
+	l, err := net.Listen("tcp4", ":0")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return l, l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// broadcastAddresses returns the limited broadcast address plus the
+// directed broadcast address of each of the IPv4 interface networks
+func broadcastAddresses() []net.IP {
+
+	addrs := []net.IP{net.IPv4bcast}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return addrs
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+
+		ifAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, a := range ifAddrs {
+			ipNet, ok := a.(*net.IPNet)
+			if ok == false || ipNet.IP.To4() == nil {
+				continue
+			}
+
+			ip := ipNet.IP.To4()
+			mask := ipNet.Mask
+			if len(mask) == net.IPv6len {
+				mask = mask[12:]
+			}
+
+			bcast := make(net.IP, net.IPv4len)
+			for i := range ip {
+				bcast[i] = ip[i] | ^mask[i]
+			}
+			addrs = append(addrs, bcast)
+		}
+	}
+
+	return addrs
+}
+
+// Announce broadcasts the TCP port on the local network via UDP, until the stop
+// channel is closed. Nothing derived from the code is broadcast, as it would allow
+// the code to be guessed offline, the receiver proves it knows the code on connecting
+func Announce(port int, stop chan struct{}) error {
+
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return err
+	}
+
+	msg := []byte(fmt.Sprintf("%s %d", ANNOUNCE_PREFIX, port))
+	addrs := broadcastAddresses()
+
+	go func() {
+		defer conn.Close()
+
+		ticker := time.NewTicker(ANNOUNCE_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			for _, ip := range addrs {
+				conn.WriteTo(msg, &net.UDPAddr{IP: ip, Port: DISCOVERY_PORT})
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Discover listens for senders announcing on the local network, and connects to
+// each of them in turn until one proves that it knows the code. Senders that do not
+// know the code are skipped, so another host cannot take the place of the sender
+func Discover(code string, timeout time.Duration, dialTimeout time.Duration) (*Conn, error) {
+
+	conn, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", DISCOVERY_PORT))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	tried := make(map[string]bool, 0)
+	mismatch := false
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if mismatch == true {
+					return nil, ErrCodeMismatch
+				}
+				return nil, errors.New("Unable to locate the sender on the local network")
+			}
+			return nil, err
+		}
+
+		parts := strings.Fields(string(buf[:n]))
+		if len(parts) != 2 || parts[0] != ANNOUNCE_PREFIX {
+			continue
+		}
+
+		port, err := strconv.Atoi(parts[1])
+		if err != nil {
+			continue
+		}
+
+		senderAddr := net.JoinHostPort(addr.(*net.UDPAddr).IP.String(), strconv.Itoa(port))
+		if tried[senderAddr] == true {
+			continue
+		}
+		tried[senderAddr] = true
+
+		c, err := Dial(senderAddr, code, dialTimeout)
+		if err == nil {
+			return c, nil
+		}
+		if err == ErrCodeMismatch {
+			mismatch = true
+		}
+	}
+}
+
+// Accept waits for a receiver that proves it knows the code. Connections that fail
+// the key exchange are dropped, and after MAX_HANDSHAKE_FAILURES receivers presenting
+// the wrong code the sender gives up. A zero timeout waits forever
+func Accept(l net.Listener, code string, timeout time.Duration) (*Conn, error) {
+
+	if timeout > 0 {
+		l.(*net.TCPListener).SetDeadline(time.Now().Add(timeout))
+	}
+
+	failures := 0
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		conn := newConn(c)
+		err = conn.handshake(code, crypto.PAKE_SENDER)
+		if err == nil {
+			return conn, nil
+		}
+		c.Close()
+
+		if err == ErrCodeMismatch {
+			failures++
+			if failures >= MAX_HANDSHAKE_FAILURES {
+				return nil, fmt.Errorf("%d receivers presented the wrong code, the transfer has been cancelled", failures)
+			}
+		}
+	}
+}
+
+// Dial connects to the sender, and checks that the sender knows the code
+func Dial(addr string, code string, timeout time.Duration) (*Conn, error) {
+
+	c, err := net.DialTimeout("tcp4", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := newConn(c)
+	err = conn.handshake(code, crypto.PAKE_RECEIVER)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// newConn returns the connection before the key exchange has taken place
+func newConn(c net.Conn) *Conn {
+
+	return &Conn{Conn: c, raw: bufio.NewReader(c)}
+}
+
+// ##### Methods #############################################################
+
+// handshake performs the PAKE exchange using the code, the receiver sends its message
+// first, the sender replies with its message and key confirmation, and the receiver
+// completes the exchange with its key confirmation. The session key then encrypts
+// the connection, with a separate key for each direction
+func (c *Conn) handshake(code string, role int) error {
+
+	c.Conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer c.Conn.SetDeadline(time.Time{})
+
+	p, err := crypto.NewPake(code, role)
+	if err != nil {
+		return err
+	}
+
+	if role == crypto.PAKE_RECEIVER {
+		err = c.writeRawLine(hex.EncodeToString(p.Message()))
+		if err != nil {
+			return err
+		}
+
+		fields, err := c.readRawFields(2)
+		if err != nil {
+			return err
+		}
+
+		err = p.Finish(fields[0])
+		if err != nil {
+			return err
+		}
+
+		if p.Verify(fields[1]) != nil {
+			return ErrCodeMismatch
+		}
+
+		err = c.writeRawLine(hex.EncodeToString(p.Confirmation()))
+		if err != nil {
+			return err
+		}
+	} else {
+		fields, err := c.readRawFields(1)
+		if err != nil {
+			return err
+		}
+
+		err = p.Finish(fields[0])
+		if err != nil {
+			return err
+		}
+
+		err = c.writeRawLine(hex.EncodeToString(p.Message()) + " " + hex.EncodeToString(p.Confirmation()))
+		if err != nil {
+			return err
+		}
+
+		// The receiver can check a guess of the code against the confirmation, so from
+		// here on a receiver that does not complete the exchange counts as a wrong code
+		fields, err = c.readRawFields(1)
+		if err != nil || p.Verify(fields[0]) != nil {
+			return ErrCodeMismatch
+		}
+	}
+
+	readLabel, writeLabel := LABEL_SENDER, LABEL_RECEIVER
+	if role == crypto.PAKE_SENDER {
+		readLabel, writeLabel = LABEL_RECEIVER, LABEL_SENDER
+	}
+
+	rr, err := newRecordReader(p.SessionKey(), readLabel, c.raw)
+	if err != nil {
+		return err
+	}
+
+	c.writer, err = newRecordWriter(p.SessionKey(), writeLabel, c.Conn)
+	if err != nil {
+		return err
+	}
+	c.reader = bufio.NewReader(rr)
+
+	return nil
+}
+
+// readRawFields reads a line of the key exchange, which holds the hex encoded fields
+func (c *Conn) readRawFields(count int) ([][]byte, error) {
+
+	line, err := c.raw.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Fields(line)
+	if len(parts) != count {
+		return nil, errors.New("Invalid key exchange message")
+	}
+
+	fields := make([][]byte, 0, count)
+	for _, part := range parts {
+		field, err := hex.DecodeString(part)
+		if err != nil {
+			return nil, errors.New("Invalid key exchange message")
+		}
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+// writeRawLine sends a line of the key exchange, which is not encrypted
+func (c *Conn) writeRawLine(line string) error {
+
+	_, err := c.Conn.Write([]byte(line + "\n"))
+	return err
+}
+
+// Read reads the data sent by the peer
+func (c *Conn) Read(b []byte) (int, error) {
+
+	return c.reader.Read(b)
+}
+
+// Write encrypts the data and sends it to the peer
+func (c *Conn) Write(b []byte) (int, error) {
+
+	return c.writer.Write(b)
+}
+
+// readLine reads a newline terminated line sent by the peer
+func (c *Conn) readLine() (string, error) {
+
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(line), nil
+}
+
+// writeLine sends a newline terminated line to the peer
+func (c *Conn) writeLine(line string) error {
+
+	_, err := c.Write([]byte(line + "\n"))
+	return err
+}
+
+// WriteHeader sends the file meta data, which precedes the file contents
+func (c *Conn) WriteHeader(sc *relay.Sidecar) error {
+
+	data, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+
+	return c.writeLine(string(data))
+}
+
+// ReadHeader reads the file meta data, which precedes the file contents
+func (c *Conn) ReadHeader() (*relay.Sidecar, error) {
+
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	return relay.ParseSidecar([]byte(line))
+}
+
+// WriteChecksum sends the hex encoded SHA-256 of the file contents, which
+// follows the file contents as it is calculated while the file is sent
+func (c *Conn) WriteChecksum(sum string) error {
+
+	return c.writeLine(sum)
+}
+
+// ReadChecksum reads the hex encoded SHA-256 of the file contents
+func (c *Conn) ReadChecksum() (string, error) {
+
+	return c.readLine()
+}
+
+// WriteManifest sends the signed manifest of the file, which follows the checksum,
+// or an empty line if the file is not signed
+func (c *Conn) WriteManifest(data []byte) error {
+
+	return c.writeLine(string(data))
+}
+
+// ReadManifest reads the signed manifest of the file, which is empty if not signed
+func (c *Conn) ReadManifest() ([]byte, error) {
+
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(line), nil
+}
+
+// WriteAck confirms to the sender that the file has been received
+func (c *Conn) WriteAck() error {
+
+	return c.writeLine(ACK)
+}
+
+// ReadAck waits for the receiver to confirm that the file has been received
+func (c *Conn) ReadAck() error {
+
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+
+	if line != ACK {
+		return fmt.Errorf("Unexpected acknowledgement from receiver: %s", line)
+	}
+
+	return nil
+}
@@ -0,0 +1,201 @@
+package direct
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	relay "filesender/relay"
+)
+
+// ##### Functions ###########################################################
+
+// accept runs Accept in the background, returning channels for the result
+func accept(t *testing.T, code string) (net.Listener, string, chan *Conn, chan error) {
+
+	t.Helper()
+
+	l, port, err := Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := make(chan *Conn, 1)
+	errs := make(chan error, 1)
+	go func() {
+
+		conn, err := Accept(l, code, 30*time.Second)
+		if err != nil {
+			errs <- err
+			return
+		}
+		conns <- conn
+	}()
+
+	return l, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), conns, errs
+}
+
+// TestTransfer sends the meta data, contents, checksum and manifest over an authenticated connection
+func TestTransfer(t *testing.T) {
+
+	l, addr, conns, errs := accept(t, "alpha-bravo-charlie")
+	defer l.Close()
+
+	receiver, err := Dial(addr, "alpha-bravo-charlie", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	var sender *Conn
+	select {
+	case sender = <-conns:
+	case err := <-errs:
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	data := make([]byte, 3*RECORD_SIZE+17)
+	rand.Read(data)
+
+	go func() {
+
+		sender.WriteHeader(relay.NewSidecar(map[string]string{relay.KEY_FILE_NAME: "data.bin"}, int64(len(data))))
+		sender.Write(data)
+		sender.WriteChecksum("checksum")
+		sender.WriteManifest([]byte(`{"manifest":"signed"}`))
+		sender.WriteManifest(nil)
+	}()
+
+	sc, err := receiver.ReadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Size != int64(len(data)) || sc.Metadata[relay.KEY_FILE_NAME] != "data.bin" {
+		t.Fatalf("Unexpected header %v", sc)
+	}
+
+	received, err := ioutil.ReadAll(io.LimitReader(receiver, sc.Size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(received, data) == false {
+		t.Fatalf("Received data does not match the data sent")
+	}
+
+	sum, err := receiver.ReadChecksum()
+	if err != nil || sum != "checksum" {
+		t.Fatalf("Unexpected checksum %s: %v", sum, err)
+	}
+
+	manifest, err := receiver.ReadManifest()
+	if err != nil || string(manifest) != `{"manifest":"signed"}` {
+		t.Fatalf("Unexpected manifest %s: %v", manifest, err)
+	}
+
+	// An unsigned file has an empty manifest
+	manifest, err = receiver.ReadManifest()
+	if err != nil || len(manifest) != 0 {
+		t.Fatalf("Unexpected manifest %s: %v", manifest, err)
+	}
+
+	err = receiver.WriteAck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sender.ReadAck()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWrongCode checks that neither peer accepts a peer using a different code,
+// and that the sender gives up after MAX_HANDSHAKE_FAILURES attempts
+func TestWrongCode(t *testing.T) {
+
+	l, addr, conns, errs := accept(t, "alpha-bravo-charlie")
+	defer l.Close()
+
+	for i := 0; i < MAX_HANDSHAKE_FAILURES; i++ {
+		_, err := Dial(addr, "alpha-bravo-delta", 5*time.Second)
+		if err != ErrCodeMismatch {
+			t.Fatalf("Expected the code mismatch, got %v", err)
+		}
+	}
+
+	select {
+	case <-conns:
+		t.Fatalf("Sender accepted a receiver with the wrong code")
+	case err := <-errs:
+		if err == nil {
+			t.Fatalf("Expected the sender to give up")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Sender did not give up")
+	}
+}
+
+// TestRecordTampering checks that modified, reordered and truncated records are rejected
+func TestRecordTampering(t *testing.T) {
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	encrypt := func() []byte {
+
+		buf := new(bytes.Buffer)
+		w, err := newRecordWriter(key, LABEL_SENDER, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("first"))
+		w.Write([]byte("second"))
+		return buf.Bytes()
+	}
+
+	decrypt := func(data []byte, label string) ([]byte, error) {
+
+		r, err := newRecordReader(key, label, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ioutil.ReadAll(r)
+	}
+
+	plain, err := decrypt(encrypt(), LABEL_SENDER)
+	if err != nil || string(plain) != "firstsecond" {
+		t.Fatalf("Unexpected plaintext %q: %v", plain, err)
+	}
+
+	// The other direction uses a different key
+	_, err = decrypt(encrypt(), LABEL_RECEIVER)
+	if err != ErrRecordAuthentication {
+		t.Fatalf("Expected authentication failure for the wrong direction, got %v", err)
+	}
+
+	modified := encrypt()
+	modified[6] ^= 1
+	_, err = decrypt(modified, LABEL_SENDER)
+	if err != ErrRecordAuthentication {
+		t.Fatalf("Expected authentication failure for a modified record, got %v", err)
+	}
+
+	// Swap the records, the first record is 4 + 5 + 16 bytes
+	data := encrypt()
+	reordered := append(append([]byte{}, data[25:]...), data[:25]...)
+	_, err = decrypt(reordered, LABEL_SENDER)
+	if err != ErrRecordAuthentication {
+		t.Fatalf("Expected authentication failure for reordered records, got %v", err)
+	}
+
+	data = encrypt()
+	_, err = decrypt(data[:len(data)-1], LABEL_SENDER)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected unexpected EOF for a truncated record, got %v", err)
+	}
+}
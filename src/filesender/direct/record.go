@@ -0,0 +1,165 @@
+package direct
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ##### Constants ###########################################################
+
+// The labels used to derive the key for each direction of the connection
+const LABEL_SENDER string = "filesender direct sender"
+const LABEL_RECEIVER string = "filesender direct receiver"
+
+// RECORD_SIZE is the maximum size of the plaintext in each record
+const RECORD_SIZE int = 64 * 1024
+
+const recordTagSize int = 16
+
+// ##### Variables ###########################################################
+
+var ErrRecordAuthentication = errors.New("Direct connection failed authentication, the data has been modified")
+
+// ##### Structs #############################################################
+
+// recordWriter encrypts the data written into AES-256-GCM records, each preceded
+// by its length. The nonce is the record counter, so records cannot be reordered,
+// replayed or removed without the reader detecting it
+type recordWriter struct {
+	aead    cipher.AEAD
+	writer  io.Writer
+	counter uint64
+}
+
+// recordReader decrypts and authenticates the records produced by recordWriter
+type recordReader struct {
+	aead    cipher.AEAD
+	reader  io.Reader
+	counter uint64
+	pending []byte
+	err     error
+}
+
+// ##### Functions ###########################################################
+
+// newRecordAEAD derives the key for the direction from the session key
+func newRecordAEAD(key []byte, label string) (cipher.AEAD, error) {
+
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(label))
+
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// recordNonce returns the nonce for the record, which is the big endian counter
+func recordNonce(counter uint64) []byte {
+
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// newRecordWriter returns a writer that encrypts the records using the key for the direction
+func newRecordWriter(key []byte, label string, writer io.Writer) (*recordWriter, error) {
+
+	aead, err := newRecordAEAD(key, label)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recordWriter{aead: aead, writer: writer}, nil
+}
+
+// newRecordReader returns a reader that decrypts the records using the key for the direction
+func newRecordReader(key []byte, label string, reader io.Reader) (*recordReader, error) {
+
+	aead, err := newRecordAEAD(key, label)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recordReader{aead: aead, reader: reader}, nil
+}
+
+// ##### Methods #############################################################
+
+// Write encrypts the data as one or more records
+func (w *recordWriter) Write(p []byte) (int, error) {
+
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > RECORD_SIZE {
+			n = RECORD_SIZE
+		}
+
+		record := make([]byte, 4, 4+n+recordTagSize)
+		binary.BigEndian.PutUint32(record, uint32(n+recordTagSize))
+		record = w.aead.Seal(record, recordNonce(w.counter), p[:n], nil)
+		w.counter++
+
+		_, err := w.writer.Write(record)
+		if err != nil {
+			return written, err
+		}
+
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Read decrypts and authenticates the next record when the previous record has been consumed
+func (r *recordReader) Read(p []byte) (int, error) {
+
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		header := make([]byte, 4)
+		_, err := io.ReadFull(r.reader, header)
+		if err != nil {
+			r.err = err
+			continue
+		}
+
+		size := int(binary.BigEndian.Uint32(header))
+		if size < recordTagSize || size > RECORD_SIZE+recordTagSize {
+			r.err = ErrRecordAuthentication
+			continue
+		}
+
+		record := make([]byte, size)
+		_, err = io.ReadFull(r.reader, record)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			r.err = err
+			continue
+		}
+
+		r.pending, err = r.aead.Open(nil, recordNonce(r.counter), record, nil)
+		if err != nil {
+			r.err = ErrRecordAuthentication
+			continue
+		}
+		r.counter++
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,97 @@
+package direct
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ##### Structs #############################################################
+
+// Rendezvous is published via the relay by a sender that is waiting for a
+// direct connection, so that a receiver can attempt to connect to it
+type Rendezvous struct {
+	Candidates []string `json:"candidates"`
+	Nonce      string   `json:"nonce"`
+}
+
+// ##### Functions ###########################################################
+
+// NewRendezvous returns a rendezvous record containing each of the local
+// IPv4 addresses with the listener port, along with a random nonce
+func NewRendezvous(port int) (*Rendezvous, error) {
+
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]string, 0)
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if ok == false || ipNet.IP.To4() == nil || ipNet.IP.IsLoopback() == true {
+			continue
+		}
+
+		candidates = append(candidates, net.JoinHostPort(ipNet.IP.String(), strconv.Itoa(port)))
+	}
+
+	return &Rendezvous{Candidates: candidates, Nonce: hex.EncodeToString(nonce)}, nil
+}
+
+// ParseRendezvous decodes the JSON rendezvous record
+func ParseRendezvous(data []byte) (*Rendezvous, error) {
+
+	rv := new(Rendezvous)
+	err := json.Unmarshal(data, rv)
+	if err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+// ##### Methods #############################################################
+
+// Bytes returns the JSON encoded rendezvous record
+func (rv *Rendezvous) Bytes() []byte {
+
+	data, _ := json.Marshal(rv)
+	return data
+}
+
+// Secret returns the password used for the key exchange when connecting, so
+// that both peers prove that they know the code and the published nonce
+func (rv *Rendezvous) Secret(code string) string {
+
+	return code + ":" + rv.Nonce
+}
+
+// Dial tries each of the candidate addresses in turn, returning the first connection made
+func (rv *Rendezvous) Dial(code string, timeout time.Duration) (*Conn, error) {
+
+	var err error
+	for _, addr := range rv.Candidates {
+		var conn *Conn
+		conn, err = Dial(addr, rv.Secret(code), timeout)
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	if err == nil {
+		err = errors.New("No candidate addresses published by the sender")
+	}
+
+	return nil, err
+}
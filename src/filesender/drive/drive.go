@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"strings"
 
@@ -14,7 +15,7 @@ import (
 )
 
 //
-func InitialiseGoogleDrive() (*gdriver.FileInfo, *gdriver.GDriver) {
+func InitialiseGoogleDrive() (*http.Client, *gdriver.FileInfo, *gdriver.GDriver) {
 
 	// Setup OAuth
 	helper := oauthhelper.Auth{
@@ -74,5 +75,5 @@ func InitialiseGoogleDrive() (*gdriver.FileInfo, *gdriver.GDriver) {
 
 	}
 
-	return dir, gdrive
+	return client, dir, gdrive
 }
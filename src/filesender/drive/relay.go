@@ -0,0 +1,424 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	relay "filesender/relay"
+	helper "filesender/utils"
+
+	drive "google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// ##### Constants ###########################################################
+
+const FOLDER string = "filesender"
+
+// UPLOAD_URL starts a resumable upload, the upload session URI is returned in the Location header.
+// The fields are those of the file returned in the response that completes the upload
+const UPLOAD_URL string = "https://www.googleapis.com/upload/drive/v3/files?uploadType=resumable&fields=" + UPLOAD_FIELDS
+
+// UPLOAD_FIELDS selects the fields of the uploaded file required for the relay object
+const UPLOAD_FIELDS string = "id,name,size,createdTime,appProperties"
+
+// DOWNLOAD_URL downloads the contents of the file with the ID, and supports range requests
+const DOWNLOAD_URL string = "https://www.googleapis.com/drive/v3/files/%s?alt=media"
+
+// UPLOAD_CHUNK_SIZE is the size of each part of a resumable upload, which google
+// drive requires to be a multiple of 256 KiB
+const UPLOAD_CHUNK_SIZE int = 32 * 256 * 1024
+
+// UPLOAD_RETRIES is the number of times a part of the upload is retried before giving up
+const UPLOAD_RETRIES int = 3
+const UPLOAD_RETRY_WAIT time.Duration = 5 * time.Second
+
+// QUERY_FIELDS selects only the fields of the files required for the relay objects,
+// and the token of the next page of the results
+const QUERY_FIELDS string = "nextPageToken, files(id, name, size, createdTime, appProperties)"
+
+// QUERY_PAGE_SIZE is the number of files in each page of the results, the maximum google drive allows
+const QUERY_PAGE_SIZE int64 = 1000
+
+const FOLDER_MIME_TYPE string = "application/vnd.google-apps.folder"
+
+// statusResumeIncomplete is returned by google drive when part of the upload has been stored
+const statusResumeIncomplete int = 308
+
+// ##### Structs #############################################################
+
+// Relay implements the relay.Relay interface using a google drive folder
+type Relay struct {
+	srv      *drive.Service
+	client   *http.Client
+	folderID string
+}
+
+// ##### Functions ###########################################################
+
+// New authenticates against google drive and returns a relay using the filesender folder
+func New() *Relay {
+
+	client, dir, _ := InitialiseGoogleDrive()
+
+	// gdriver only finds files by path, so the files are accessed by ID using the
+	// drive service, which also supports operations such as updating AppProperties
+	srv, err := drive.New(client)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Unable to create google drive service: %v", err))
+	}
+
+	return &Relay{srv: srv, client: client, folderID: dir.DriveFile().Id}
+}
+
+// fileToObject converts the google drive file returned by a query or an upload into a
+// relay object, the ID is the google drive file ID so that later calls do not need to
+// resolve the path again
+func fileToObject(f *drive.File) *relay.Object {
+
+	created, _ := time.Parse(time.RFC3339, f.CreatedTime)
+
+	return &relay.Object{
+		ID:       f.Id,
+		Name:     f.Name,
+		Size:     f.Size,
+		Created:  created,
+		Metadata: f.AppProperties,
+	}
+}
+
+// escapeQuery escapes the value for use in a google drive query string
+func escapeQuery(value string) string {
+
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+}
+
+// parseRange returns the number of bytes stored from the Range header e.g. bytes=0-1048575,
+// the header is not present if no bytes have been stored
+func parseRange(header string) (int64, error) {
+
+	if len(header) == 0 {
+		return 0, nil
+	}
+
+	// The stored bytes always start at the beginning of the file
+	if strings.HasPrefix(header, "bytes=0-") == false {
+		return 0, fmt.Errorf("Invalid upload range: %s", header)
+	}
+
+	last, err := strconv.ParseInt(strings.TrimPrefix(header, "bytes=0-"), 10, 64)
+	if err != nil || last < 0 {
+		return 0, fmt.Errorf("Invalid upload range: %s", header)
+	}
+
+	return last + 1, nil
+}
+
+// responseError returns an error holding the status and body of the failed request
+func responseError(resp *http.Response) error {
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("Google drive request failed: %s %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// ##### Methods #############################################################
+
+// Put uploads the file into the filesender folder, storing the meta data as AppProperties
+func (r *Relay) Put(name string, metadata map[string]string, size int64, reader io.Reader) (*relay.Object, error) {
+
+	session, err := r.Begin(name, metadata, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.Resume(name, session, 0, size, reader, nil)
+}
+
+// Begin starts a resumable upload of the file into the filesender folder, storing the
+// meta data as AppProperties. Returns the upload session URI, which is valid for a week
+func (r *Relay) Begin(name string, metadata map[string]string, size int64) (string, error) {
+
+	body, err := json.Marshal(&drive.File{
+		Name:          name,
+		MimeType:      "application/octet-stream",
+		Parents:       []string{r.folderID},
+		AppProperties: metadata,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, UPLOAD_URL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", "application/octet-stream")
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp)
+	}
+
+	session := resp.Header.Get("Location")
+	if len(session) == 0 {
+		return "", fmt.Errorf("Google drive did not return an upload session")
+	}
+
+	return session, nil
+}
+
+// Offset returns the number of bytes of the upload session stored by google drive
+func (r *Relay) Offset(session string, size int64) (int64, error) {
+
+	offset, _, err := r.putRange(session, 0, nil, size)
+	return offset, err
+}
+
+// Resume uploads the contents of the reader from the offset in parts, each part is
+// retried from the last byte stored by google drive if the request fails
+func (r *Relay) Resume(name string, session string, offset int64, size int64, reader io.Reader, progress func(int64)) (*relay.Object, error) {
+
+	f, err := r.upload(session, offset, size, reader, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	return fileToObject(f), nil
+}
+
+// upload uploads the contents of the reader from the offset until google drive reports
+// that the upload is complete. Returns the uploaded file
+func (r *Relay) upload(session string, offset int64, size int64, reader io.Reader, progress func(int64)) (*drive.File, error) {
+
+	buf := make([]byte, UPLOAD_CHUNK_SIZE)
+	for {
+		n := int64(len(buf))
+		if size-offset < n {
+			n = size - offset
+		}
+
+		_, err := io.ReadFull(reader, buf[:n])
+		if err != nil && n > 0 {
+			return nil, err
+		}
+
+		f, err := r.uploadChunk(session, offset, buf[:n], size)
+		if err != nil {
+			return nil, err
+		}
+
+		offset += n
+		if progress != nil {
+			progress(offset)
+		}
+
+		if f != nil {
+			return f, nil
+		}
+
+		if offset >= size {
+			return nil, fmt.Errorf("Google drive did not complete the upload")
+		}
+	}
+}
+
+// uploadChunk uploads the part of the file starting at the offset. If the request fails
+// the part is retried from the last byte stored by google drive. Returns the uploaded file
+// once google drive reports that the upload is complete
+func (r *Relay) uploadChunk(session string, offset int64, chunk []byte, size int64) (*drive.File, error) {
+
+	end := offset + int64(len(chunk))
+	retries := 0
+	for {
+		stored, f, err := r.putRange(session, offset, chunk, size)
+		if err != nil {
+			if retries == UPLOAD_RETRIES {
+				return nil, err
+			}
+			retries++
+
+			time.Sleep(UPLOAD_RETRY_WAIT)
+			stored, f, err = r.putRange(session, 0, nil, size)
+			if err != nil {
+				continue
+			}
+		}
+
+		if f != nil || stored >= end {
+			return f, nil
+		}
+
+		// The bytes before the part have already been read, so cannot be sent again
+		if stored < offset {
+			return nil, fmt.Errorf("Google drive stored %d bytes, expected at least %d", stored, offset)
+		}
+
+		chunk = chunk[stored-offset:]
+		offset = stored
+	}
+}
+
+// putRange uploads the bytes starting at the offset to the upload session, or if there are
+// no bytes, requests the status of the upload session. Returns the number of bytes stored by
+// google drive, and the uploaded file once the upload is complete
+func (r *Relay) putRange(session string, offset int64, data []byte, size int64) (int64, *drive.File, error) {
+
+	req, err := http.NewRequest(http.MethodPut, session, bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(data) == 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	} else {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(len(data))-1, size))
+	}
+	req.ContentLength = int64(len(data))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		// The response holds the uploaded file, with the fields requested when the upload began
+		f := new(drive.File)
+		err = json.NewDecoder(resp.Body).Decode(f)
+		if err != nil {
+			return 0, nil, fmt.Errorf("Unable to read the uploaded google drive file: %v", err)
+		}
+		return size, f, nil
+	case statusResumeIncomplete:
+		stored, err := parseRange(resp.Header.Get("Range"))
+		return stored, nil, err
+	case http.StatusNotFound:
+		return 0, nil, fmt.Errorf("Upload session has expired")
+	default:
+		return 0, nil, responseError(resp)
+	}
+}
+
+// Find returns the files in the filesender folder that have the mnemonicode AppProperty,
+// using a google drive query rather than listing every file in the folder
+func (r *Relay) Find(code string) ([]*relay.Object, error) {
+
+	objs := make([]*relay.Object, 0)
+	q := fmt.Sprintf("appProperties has { key='%s' and value='%s' }", relay.KEY_CODE, escapeQuery(code))
+	err := r.query(q, func(obj *relay.Object) error {
+
+		objs = append(objs, obj)
+		return nil
+	})
+
+	return objs, err
+}
+
+// Open returns a ReadCloser that can consume the body of the google drive file
+func (r *Relay) Open(obj *relay.Object) (io.ReadCloser, error) {
+
+	resp, err := r.srv.Files.Get(obj.ID).Download()
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// OpenRange returns a ReadCloser that consumes the body of the google drive file from the
+// offset, using a range request against the media endpoint
+func (r *Relay) OpenRange(obj *relay.Object, offset int64) (io.ReadCloser, error) {
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(DOWNLOAD_URL, obj.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// The whole file is only expected if the range starts at the beginning
+	if resp.StatusCode != http.StatusPartialContent && (offset != 0 || resp.StatusCode != http.StatusOK) {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+
+	return resp.Body, nil
+}
+
+// Delete removes the file from google drive
+func (r *Relay) Delete(obj *relay.Object) error {
+
+	return r.srv.Files.Delete(obj.ID).Do()
+}
+
+// List calls fn for each of the files in the filesender folder
+func (r *Relay) List(fn func(*relay.Object) error) error {
+
+	return r.query(fmt.Sprintf("mimeType != '%s'", FOLDER_MIME_TYPE), fn)
+}
+
+// query calls fn for each of the files in the filesender folder that match the google
+// drive query, following each page of the results. Only the fields required for the
+// relay objects are returned
+func (r *Relay) query(q string, fn func(*relay.Object) error) error {
+
+	call := r.srv.Files.List().
+		Q(fmt.Sprintf("'%s' in parents and trashed = false and %s", r.folderID, q)).
+		Fields(googleapi.Field(QUERY_FIELDS)).
+		PageSize(QUERY_PAGE_SIZE)
+
+	return call.Pages(context.Background(), func(list *drive.FileList) error {
+
+		for _, f := range list.Files {
+			err := fn(fileToObject(f))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// SetMetadata adds the meta data to the file's AppProperties, existing AppProperties are retained
+func (r *Relay) SetMetadata(obj *relay.Object, metadata map[string]string) error {
+
+	_, err := r.srv.Files.Update(obj.ID, &drive.File{AppProperties: metadata}).Do()
+	if err != nil {
+		return err
+	}
+
+	obj.Merge(metadata)
+	return nil
+}
+
+// MD5 returns the MD5 checksum that google drive calculated for the file contents
+func (r *Relay) MD5(obj *relay.Object) (string, error) {
+
+	f, err := r.srv.Files.Get(obj.ID).Fields("md5Checksum").Do()
+	if err != nil {
+		return "", err
+	}
+
+	return f.Md5Checksum, nil
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// ##### Functions ###########################################################
+
+// TestParseRange checks the number of bytes stored is read from the Range header of the
+// resumable upload status, and that malformed headers are rejected
+func TestParseRange(t *testing.T) {
+
+	valid := map[string]int64{
+		"":                  0,
+		"bytes=0-0":         1,
+		"bytes=0-1048575":   1048576,
+		"bytes=0-268435455": 268435456,
+	}
+	for header, expected := range valid {
+		stored, err := parseRange(header)
+		if err != nil {
+			t.Fatalf("Range %q: %v", header, err)
+		}
+		if stored != expected {
+			t.Fatalf("Range %q: expected %d bytes stored, got %d", header, expected, stored)
+		}
+	}
+
+	for _, header := range []string{"bytes", "bytes=0-", "bytes=0-abc", "bytes=0--5", "bytes=5-10", "0-10", "items=0-10"} {
+		_, err := parseRange(header)
+		if err == nil {
+			t.Fatalf("Invalid range %q accepted", header)
+		}
+	}
+}
+
+// TestResumeObject checks that the relay object is built from the file returned in the
+// response that completes the upload, rather than by finding the file by name
+func TestResumeObject(t *testing.T) {
+
+	data := []byte("contents of the uploaded file")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+
+		body, _ := ioutil.ReadAll(req.Body)
+		if bytes.Equal(body, data) == false {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"id": "1AbC", "name": "data.bin", "size": "29", "createdTime": "2020-01-02T03:04:05.000Z", "appProperties": {"mnemonicode": "a-b-c"}}`))
+	}))
+	defer server.Close()
+
+	r := &Relay{client: server.Client()}
+	obj, err := r.Resume("data.bin", server.URL, 0, int64(len(data)), bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if obj.ID != "1AbC" || obj.Name != "data.bin" || obj.Size != int64(len(data)) || obj.Created.Year() != 2020 || obj.Metadata["mnemonicode"] != "a-b-c" {
+		t.Fatalf("Unexpected object %+v", obj)
+	}
+}
@@ -0,0 +1,230 @@
+package local
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	config "filesender/config"
+	relay "filesender/relay"
+	helper "filesender/utils"
+)
+
+// ##### Structs #############################################################
+
+// Relay implements the relay.Relay interface using a local directory e.g. a
+// shared NFS/SMB mount. The filesender meta data is stored in a JSON sidecar file
+type Relay struct {
+	directory string
+	mode      os.FileMode
+}
+
+// ##### Functions ###########################################################
+
+// New creates the directory if it does not already exist and returns a relay for it.
+// Files are created using the umask unless a mode is set e.g. "0640", in which case
+// the files have the mode, and a directory that is created has the matching 0750 mode
+func New(s config.LocalSettings) *Relay {
+
+	if len(s.Directory) == 0 {
+		helper.OutputAndExit("Local directory not defined in the settings file")
+	}
+
+	mode := os.FileMode(0)
+	if len(s.Mode) > 0 {
+		m, err := strconv.ParseUint(s.Mode, 8, 32)
+		if err != nil || m&^0777 != 0 {
+			helper.OutputAndExit(fmt.Sprintf("Invalid local file mode: %s", s.Mode))
+		}
+		mode = os.FileMode(m)
+	}
+
+	_, err := os.Stat(s.Directory)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(s.Directory, 0777)
+		if err == nil && mode != 0 {
+			err = os.Chmod(s.Directory, dirMode(mode))
+		}
+	}
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error creating local directory: %v", err))
+	}
+
+	return &Relay{directory: s.Directory, mode: mode}
+}
+
+// dirMode returns the directory mode for the file mode, which adds search
+// permission wherever there is read permission e.g. 0640 becomes 0750
+func dirMode(mode os.FileMode) os.FileMode {
+
+	return mode | (mode&0444)>>2
+}
+
+// ##### Methods #############################################################
+
+// write streams the contents of the reader into a temporary file in the same
+// directory, which is then renamed, so that partial files are never seen by a receiver
+func (r *Relay) write(name string, reader io.Reader) error {
+
+	f, err := r.createTemp(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, reader)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), filepath.Join(r.directory, name))
+}
+
+// createTemp creates a temporary file for the name. Unlike ioutil.TempFile, which
+// always uses 0600, the file is created using the umask or the configured mode, so
+// that it can be read by the receiving user on a shared mount
+func (r *Relay) createTemp(name string) (*os.File, error) {
+
+	suffix := make([]byte, 8)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpPath := filepath.Join(r.directory, "."+name+".tmp"+hex.EncodeToString(suffix))
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.mode != 0 {
+		err = f.Chmod(r.mode)
+		if err != nil {
+			f.Close()
+			os.Remove(tmpPath)
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// Put writes the file into the directory, followed by the meta data sidecar
+func (r *Relay) Put(name string, metadata map[string]string, size int64, reader io.Reader) (*relay.Object, error) {
+
+	err := r.write(name, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := relay.NewSidecar(metadata, size)
+	err = r.write(name+relay.SIDECAR_EXT, bytes.NewReader(sc.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+
+	return sc.Object(name, name), nil
+}
+
+// Find returns the files in the directory that have the mnemonicode meta data
+func (r *Relay) Find(code string) ([]*relay.Object, error) {
+
+	return relay.FindByCode(r, code)
+}
+
+// Open returns a ReadCloser that can consume the body of the file
+func (r *Relay) Open(obj *relay.Object) (io.ReadCloser, error) {
+
+	return os.Open(filepath.Join(r.directory, obj.ID))
+}
+
+// OpenRange returns a ReadCloser that consumes the body of the file from the offset
+func (r *Relay) OpenRange(obj *relay.Object, offset int64) (io.ReadCloser, error) {
+
+	f, err := os.Open(filepath.Join(r.directory, obj.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Delete removes the meta data sidecar and the file from the directory. The sidecar is
+// removed first, so that the file is no longer listed while it is being removed
+func (r *Relay) Delete(obj *relay.Object) error {
+
+	err := os.Remove(filepath.Join(r.directory, obj.ID+relay.SIDECAR_EXT))
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(filepath.Join(r.directory, obj.ID))
+}
+
+// SetMetadata adds the meta data to the object, and rewrites the meta data sidecar
+func (r *Relay) SetMetadata(obj *relay.Object, metadata map[string]string) error {
+
+	obj.Merge(metadata)
+	return r.write(obj.ID+relay.SIDECAR_EXT, bytes.NewReader(obj.Sidecar().Bytes()))
+}
+
+// List calls fn for each of the files in the directory that have a meta data sidecar,
+// skipping the sidecars removed while the directory is listed
+func (r *Relay) List(fn func(*relay.Object) error) error {
+
+	files, err := ioutil.ReadDir(r.directory)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range files {
+		if fi.IsDir() == true || strings.HasPrefix(fi.Name(), ".") || relay.IsSidecar(fi.Name()) == false {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(r.directory, fi.Name()))
+		// The file may have been removed by another receiver since the directory was read
+		if os.IsNotExist(err) == true {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		sc, err := relay.ParseSidecar(data)
+		if err != nil {
+			return fmt.Errorf("Invalid meta data sidecar %s: %v", fi.Name(), err)
+		}
+
+		name := strings.TrimSuffix(fi.Name(), relay.SIDECAR_EXT)
+		err = fn(sc.Object(name, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
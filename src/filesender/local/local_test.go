@@ -0,0 +1,147 @@
+package local
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	config "filesender/config"
+	relay "filesender/relay"
+)
+
+// ##### Functions ###########################################################
+
+// putFile uploads a file to a new relay in the directory, and returns the permissions of the file
+func putFile(t *testing.T, dir string, mode string) os.FileMode {
+
+	t.Helper()
+
+	r := New(config.LocalSettings{Directory: dir, Mode: mode})
+	_, err := r.Put("guid", map[string]string{relay.KEY_CODE: "alpha-bravo"}, 5, bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, "guid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fi.Mode().Perm()
+}
+
+// TestUmask checks that the files are created using the umask rather than 0600
+func TestUmask(t *testing.T) {
+
+	base, err := ioutil.TempDir("", "filesender")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	// The permissions of a file created without a mode, which apply the umask
+	f, err := os.OpenFile(filepath.Join(base, "umask"), os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	perm := putFile(t, filepath.Join(base, "relay"), "")
+	if perm != fi.Mode().Perm() {
+		t.Fatalf("File created with %v, expected the umask %v", perm, fi.Mode().Perm())
+	}
+}
+
+// TestMode checks that the files and the directory are created with the configured mode
+func TestMode(t *testing.T) {
+
+	base, err := ioutil.TempDir("", "filesender")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	dir := filepath.Join(base, "relay")
+	perm := putFile(t, dir, "0640")
+	if perm != 0640 {
+		t.Fatalf("File created with %v, expected 0640", perm)
+	}
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0750 {
+		t.Fatalf("Directory created with %v, expected 0750", fi.Mode().Perm())
+	}
+
+	// The sidecar has the mode too, and no temporary files remain
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Unexpected files in the directory %d", len(files))
+	}
+	for _, fi := range files {
+		if fi.Mode().Perm() != 0640 {
+			t.Fatalf("%s created with %v, expected 0640", fi.Name(), fi.Mode().Perm())
+		}
+	}
+}
+
+// TestDirMode checks the search permissions added to the directory mode
+func TestDirMode(t *testing.T) {
+
+	tests := map[os.FileMode]os.FileMode{0640: 0750, 0660: 0770, 0600: 0700, 0644: 0755}
+	for mode, expected := range tests {
+		if dirMode(mode) != expected {
+			t.Errorf("dirMode(%v) = %v, expected %v", mode, dirMode(mode), expected)
+		}
+	}
+}
+
+// TestListRemovedSidecar checks that a sidecar removed by another receiver while the
+// directory is listed is skipped, and that the remaining files are still found
+func TestListRemovedSidecar(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "filesender")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	putFile(t, dir, "")
+
+	// A dangling link is listed, but cannot be read, as for a sidecar removed after ReadDir
+	err = os.Symlink(filepath.Join(dir, "missing"), filepath.Join(dir, "removed"+relay.SIDECAR_EXT))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := New(config.LocalSettings{Directory: dir})
+	objs, err := r.Find("alpha-bravo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 || objs[0].ID != "guid" {
+		t.Fatalf("Unexpected files found %v", objs)
+	}
+
+	err = r.Delete(objs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"guid", "guid" + relay.SIDECAR_EXT} {
+		_, err = os.Stat(filepath.Join(dir, name))
+		if os.IsNotExist(err) == false {
+			t.Fatalf("%s was not removed", name)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package memory
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	relay "filesender/relay"
+)
+
+// ##### Structs #############################################################
+
+// Relay implements the relay.Relay interface holding the objects in memory. The
+// objects are only shared within the process, so it is used to test the commands
+type Relay struct {
+	mutex   sync.Mutex
+	names   []string
+	objects map[string]*object
+}
+
+// object holds the contents of an object along with its description
+type object struct {
+	obj  relay.Object
+	data []byte
+}
+
+// ##### Functions ###########################################################
+
+// New returns an empty relay
+func New() *Relay {
+
+	return &Relay{objects: make(map[string]*object, 0)}
+}
+
+// ##### Methods #############################################################
+
+// Put reads the contents of the reader into memory, replacing any existing object with the name
+func (r *Relay) Put(name string, metadata map[string]string, size int64, reader io.Reader) (*relay.Object, error) {
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("Object size %d does not match the size %d", len(data), size)
+	}
+
+	o := &object{
+		obj:  relay.Object{ID: name, Name: name, Size: size, Created: time.Now().UTC()},
+		data: data,
+	}
+	o.obj.Merge(metadata)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.objects[name]; ok == false {
+		r.names = append(r.names, name)
+	}
+	r.objects[name] = o
+
+	return o.copy(), nil
+}
+
+// Find returns the objects that have the mnemonicode meta data
+func (r *Relay) Find(code string) ([]*relay.Object, error) {
+
+	return relay.FindByCode(r, code)
+}
+
+// Open returns a ReadCloser that can consume the contents of the object
+func (r *Relay) Open(obj *relay.Object) (io.ReadCloser, error) {
+
+	return r.OpenRange(obj, 0)
+}
+
+// OpenRange returns a ReadCloser that consumes the contents of the object from the offset
+func (r *Relay) OpenRange(obj *relay.Object, offset int64) (io.ReadCloser, error) {
+
+	o, err := r.get(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > int64(len(o.data)) {
+		return nil, fmt.Errorf("Offset %d is beyond the end of the object", offset)
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(o.data[offset:])), nil
+}
+
+// MD5 returns the hex encoded MD5 checksum of the object contents
+func (r *Relay) MD5(obj *relay.Object) (string, error) {
+
+	o, err := r.get(obj)
+	if err != nil {
+		return "", err
+	}
+
+	sum := md5.Sum(o.data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Delete removes the object
+func (r *Relay) Delete(obj *relay.Object) error {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.objects[obj.ID]; ok == false {
+		return fmt.Errorf("Object not found: %s", obj.ID)
+	}
+
+	delete(r.objects, obj.ID)
+	for i, name := range r.names {
+		if name == obj.ID {
+			r.names = append(r.names[:i], r.names[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// SetMetadata adds the meta data to the object, replacing any existing values
+func (r *Relay) SetMetadata(obj *relay.Object, metadata map[string]string) error {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	o, ok := r.objects[obj.ID]
+	if ok == false {
+		return fmt.Errorf("Object not found: %s", obj.ID)
+	}
+
+	o.obj.Merge(metadata)
+	obj.Merge(metadata)
+
+	return nil
+}
+
+// List calls fn for each of the objects, in the order they were uploaded
+func (r *Relay) List(fn func(*relay.Object) error) error {
+
+	r.mutex.Lock()
+	objs := make([]*relay.Object, 0, len(r.names))
+	for _, name := range r.names {
+		objs = append(objs, r.objects[name].copy())
+	}
+	r.mutex.Unlock()
+
+	for _, obj := range objs {
+		err := fn(obj)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// get returns the stored object
+func (r *Relay) get(obj *relay.Object) (*object, error) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	o, ok := r.objects[obj.ID]
+	if ok == false {
+		return nil, fmt.Errorf("Object not found: %s", obj.ID)
+	}
+
+	return o, nil
+}
+
+// copy returns a copy of the object description, so that the caller cannot change the stored meta data
+func (o *object) copy() *relay.Object {
+
+	obj := o.obj
+	obj.Metadata = nil
+	obj.Merge(o.obj.Metadata)
+
+	return &obj
+}
@@ -0,0 +1,64 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ##### Structs #############################################################
+
+// ChunkManifest is the body of the object holding the meta data of a file that has been
+// uploaded as chunk objects, it lists the chunks in the order of the file contents
+type ChunkManifest struct {
+	Code   string  `json:"code"`
+	Size   int64   `json:"size"`
+	Chunks []Chunk `json:"chunks"`
+}
+
+// Chunk describes one of the chunk objects, the checksum is the SHA-256 of the chunk
+type Chunk struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ##### Functions ###########################################################
+
+// ChunkName returns the name of the chunk object with the index, which is
+// prefixed by the name of the object holding the manifest
+func ChunkName(name string, index int) string {
+
+	return fmt.Sprintf("%s.%d", name, index)
+}
+
+// ParseChunkManifest decodes the JSON chunk manifest, and checks that the
+// sizes of the chunks add up to the size of the file contents
+func ParseChunkManifest(data []byte) (*ChunkManifest, error) {
+
+	m := new(ChunkManifest)
+	err := json.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+
+	var size int64
+	for _, c := range m.Chunks {
+		size += c.Size
+	}
+
+	if size != m.Size {
+		return nil, errors.New("Chunk sizes do not add up to the file size")
+	}
+
+	return m, nil
+}
+
+// ##### Methods #############################################################
+
+// Bytes returns the JSON encoded chunk manifest
+func (m *ChunkManifest) Bytes() []byte {
+
+	data, _ := json.Marshal(m)
+	return data
+}
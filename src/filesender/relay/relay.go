@@ -0,0 +1,140 @@
+package relay
+
+import (
+	"io"
+	"time"
+)
+
+// ##### Constants ###########################################################
+
+// Meta data keys stored alongside each uploaded object
+const KEY_CODE string = "mnemonicode"
+const KEY_FILE_NAME string = "file_name"
+const KEY_IV string = "iv"
+const KEY_FORMAT string = "format"
+const KEY_KIND string = "kind"
+const KEY_PAKE string = "pake"
+const KEY_KEY_ID string = "key_id"
+const KEY_WRAPPED_KEY string = "wrapped_key"
+const KEY_PASSPHRASE_KEY string = "passphrase_key"
+const KEY_CHUNKS string = "chunks"
+const KEY_SEGMENTS string = "segments"
+const KEY_SIZE string = "size"
+
+// KEY_SHA256 is the checksum of the uploaded bytes. For the envelope format these are
+// the encrypted bytes, as the checksum of the file contents would identify the file,
+// the file contents are authenticated when decrypted instead
+const KEY_SHA256 string = "sha256"
+
+// Values of the kind meta data, objects without a kind hold the file contents
+const KIND_RENDEZVOUS string = "rendezvous"
+const KIND_PAKE_SENDER string = "pake_sender"
+const KIND_PAKE_RECEIVER string = "pake_receiver"
+const KIND_PAKE_ABORT string = "pake_abort"
+const KIND_MANIFEST string = "manifest"
+const KIND_KEY_EXPORT string = "key_export"
+const KIND_CHUNK string = "chunk"
+const KIND_SEGMENT string = "segment"
+
+// ##### Structs #############################################################
+
+// Object describes a file stored on a relay backend
+type Object struct {
+	ID       string
+	Name     string
+	Size     int64
+	Created  time.Time
+	Metadata map[string]string
+}
+
+// ##### Interfaces ##########################################################
+
+// Relay is implemented by each of the storage backends that can be used
+// to pass files from one computer to another
+type Relay interface {
+	// Put uploads the contents of the reader as a new object, with the meta data attached
+	Put(name string, metadata map[string]string, size int64, r io.Reader) (*Object, error)
+	// Find returns all of the objects that have been tagged with the mnemonicode
+	Find(code string) ([]*Object, error)
+	// Open returns a ReadCloser that can consume the body of the object
+	Open(obj *Object) (io.ReadCloser, error)
+	// Delete removes the object from the backend
+	Delete(obj *Object) error
+	// List calls fn for each object stored on the backend
+	List(fn func(*Object) error) error
+	// SetMetadata adds the meta data to the existing object, replacing any existing values
+	SetMetadata(obj *Object, metadata map[string]string) error
+}
+
+// Checksummer is implemented by backends that report the MD5 checksum of
+// stored objects, so that the upload can be verified against the bytes sent
+type Checksummer interface {
+	// MD5 returns the hex encoded MD5 checksum of the object contents
+	MD5(obj *Object) (string, error)
+}
+
+// Resumer is implemented by backends that support resumable uploads, so that an
+// interrupted upload can continue from the last byte stored by the backend
+type Resumer interface {
+	// Begin starts a resumable upload of the object, and returns the upload session
+	Begin(name string, metadata map[string]string, size int64) (string, error)
+	// Offset returns the number of bytes of the upload session stored by the backend
+	Offset(session string, size int64) (int64, error)
+	// Resume uploads the contents of the reader from the offset, calling progress with
+	// the number of bytes stored by the backend as each part of the upload is stored
+	Resume(name string, session string, offset int64, size int64, r io.Reader, progress func(int64)) (*Object, error)
+}
+
+// Ranger is implemented by backends that can read the object from an offset,
+// so that an interrupted download can continue from where it stopped
+type Ranger interface {
+	// OpenRange returns a ReadCloser that consumes the body of the object from the offset
+	OpenRange(obj *Object, offset int64) (io.ReadCloser, error)
+}
+
+// ##### Methods #############################################################
+
+// Code returns the mnemonicode meta data value of the object
+func (o *Object) Code() string {
+
+	return o.Metadata[KEY_CODE]
+}
+
+// Kind returns the kind meta data value of the object
+func (o *Object) Kind() string {
+
+	return o.Metadata[KEY_KIND]
+}
+
+// Merge adds the meta data to the object's meta data, replacing any existing values
+func (o *Object) Merge(metadata map[string]string) {
+
+	merged := make(map[string]string, len(o.Metadata)+len(metadata))
+	for k, v := range o.Metadata {
+		merged[k] = v
+	}
+	for k, v := range metadata {
+		merged[k] = v
+	}
+
+	o.Metadata = merged
+}
+
+// ##### Functions ###########################################################
+
+// FindByCode is a helper for backends that have no server side search, it
+// walks every object using List and returns the objects tagged with the code
+func FindByCode(r Relay, code string) ([]*Object, error) {
+
+	objs := make([]*Object, 0)
+	err := r.List(func(obj *Object) error {
+
+		if obj.Code() == code {
+			objs = append(objs, obj)
+		}
+
+		return nil
+	})
+
+	return objs, err
+}
@@ -0,0 +1,88 @@
+package relay
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// ##### Constants ###########################################################
+
+// SIDECAR_EXT is appended to the object name for backends that store the meta data
+// in a separate file alongside the object. It is specific to filesender, so that
+// other JSON files in a shared directory are not mistaken for sidecars
+const SIDECAR_EXT string = ".filesender.json"
+
+// ##### Structs #############################################################
+
+// Sidecar holds the meta data for backends that have no native meta data storage
+type Sidecar struct {
+	Size     int64             `json:"size"`
+	Created  time.Time         `json:"created"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// ##### Functions ###########################################################
+
+// NewSidecar returns the sidecar for a newly uploaded object
+func NewSidecar(metadata map[string]string, size int64) *Sidecar {
+
+	return &Sidecar{
+		Size:     size,
+		Created:  time.Now().UTC(),
+		Metadata: metadata,
+	}
+}
+
+// ParseSidecar decodes the JSON sidecar data
+func ParseSidecar(data []byte) (*Sidecar, error) {
+
+	s := new(Sidecar)
+	err := json.Unmarshal(data, s)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Metadata == nil {
+		s.Metadata = make(map[string]string, 0)
+	}
+
+	return s, nil
+}
+
+// IsSidecar determines if the name is that of a sidecar file
+func IsSidecar(name string) bool {
+
+	return strings.HasSuffix(name, SIDECAR_EXT)
+}
+
+// ##### Methods #############################################################
+
+// Bytes returns the JSON encoded sidecar
+func (s *Sidecar) Bytes() []byte {
+
+	data, _ := json.MarshalIndent(s, "", "  ")
+	return data
+}
+
+// Object returns the relay object described by the sidecar
+func (s *Sidecar) Object(id string, name string) *Object {
+
+	return &Object{
+		ID:       id,
+		Name:     name,
+		Size:     s.Size,
+		Created:  s.Created,
+		Metadata: s.Metadata,
+	}
+}
+
+// Sidecar returns the sidecar describing the object
+func (o *Object) Sidecar() *Sidecar {
+
+	return &Sidecar{
+		Size:     o.Size,
+		Created:  o.Created,
+		Metadata: o.Metadata,
+	}
+}
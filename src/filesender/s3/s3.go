@@ -0,0 +1,588 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	config "filesender/config"
+	relay "filesender/relay"
+	helper "filesender/utils"
+)
+
+// ##### Constants ###########################################################
+
+const META_PREFIX string = "X-Amz-Meta-"
+
+// MAX_PUT_SIZE is the largest object that can be uploaded or copied in a single
+// request, larger objects are uploaded and copied as the parts of a multipart upload
+const MAX_PUT_SIZE int64 = 5 * 1024 * 1024 * 1024
+
+// PART_SIZE is the minimum size of the parts, the size is increased for large
+// objects so that there are no more than MAX_PARTS
+const PART_SIZE int64 = 64 * 1024 * 1024
+const MAX_PARTS int64 = 10000
+
+// ##### Structs #############################################################
+
+// Relay implements the relay.Relay interface using an S3 compatible bucket
+// e.g. AWS S3 or MinIO. The filesender meta data is stored as object user meta data
+type Relay struct {
+	settings config.S3Settings
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// listBucketResult is the response of a ListObjectsV2 request
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// initiateMultipartUploadResult is the response of a CreateMultipartUpload request
+type initiateMultipartUploadResult struct {
+	UploadId string
+}
+
+// copyPartResult is the response of an UploadPartCopy request
+type copyPartResult struct {
+	ETag string
+}
+
+// completedPart is a part listed in the CompleteMultipartUpload request
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// completeMultipartUpload is the body of a CompleteMultipartUpload request
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// errorResponse is the body returned by S3 when a request fails
+type errorResponse struct {
+	Code    string
+	Message string
+}
+
+// ##### Functions ###########################################################
+
+// New validates the S3 settings and returns a relay for the bucket
+func New(s config.S3Settings) *Relay {
+
+	if len(s.Bucket) == 0 {
+		helper.OutputAndExit("S3 bucket not defined in the settings file")
+	}
+
+	if len(s.AccessKey) == 0 {
+		s.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if len(s.SecretKey) == 0 {
+		s.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if len(s.AccessKey) == 0 || len(s.SecretKey) == 0 {
+		helper.OutputAndExit("S3 credentials not defined in the settings file or environment")
+	}
+
+	endpoint := s.Endpoint
+	if len(endpoint) == 0 {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.Region)
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || len(u.Host) == 0 {
+		helper.OutputAndExit(fmt.Sprintf("Invalid S3 endpoint: %s", endpoint))
+	}
+
+	return &Relay{settings: s, endpoint: u, client: http.DefaultClient}
+}
+
+// partSize returns the size of the parts used to upload or copy an object of the size
+func partSize(size int64) int64 {
+
+	part := (size + MAX_PARTS - 1) / MAX_PARTS
+	if part < PART_SIZE {
+		part = PART_SIZE
+	}
+
+	return part
+}
+
+// checkResponse converts a non 2xx response into an error
+func checkResponse(resp *http.Response) error {
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	er := errorResponse{}
+	if xml.Unmarshal(data, &er) == nil && len(er.Code) > 0 {
+		return fmt.Errorf("S3 request failed: %s: %s", er.Code, er.Message)
+	}
+
+	return fmt.Errorf("S3 request failed: %s", resp.Status)
+}
+
+// ##### Methods #############################################################
+
+// objectURL returns the URL for the object key, or the bucket when the key is empty
+func (r *Relay) objectURL(key string) *url.URL {
+
+	u := *r.endpoint
+	if r.settings.PathStyle == true {
+		u.Path = "/" + r.settings.Bucket + "/" + key
+	} else {
+		u.Host = r.settings.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+
+	return &u
+}
+
+// do signs and performs the request
+func (r *Relay) do(req *http.Request, payloadHash string) (*http.Response, error) {
+
+	sign(req, r.settings.Region, r.settings.AccessKey, r.settings.SecretKey, payloadHash)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// Put uploads the file into the bucket, storing the meta data as user meta data. The
+// object key includes the code, so that Find only needs to list the objects with the code
+func (r *Relay) Put(name string, metadata map[string]string, size int64, reader io.Reader) (*relay.Object, error) {
+
+	key := r.objectKey(name, metadata[relay.KEY_CODE])
+
+	if size > MAX_PUT_SIZE {
+		err := r.putMultipart(key, metadata, size, reader)
+		if err != nil {
+			return nil, err
+		}
+
+		return &relay.Object{ID: key, Name: name, Size: size, Created: time.Now(), Metadata: metadata}, nil
+	}
+
+	req, err := http.NewRequest(http.MethodPut, r.objectURL(key).String(), ioutil.NopCloser(reader))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	for k, v := range metadata {
+		req.Header.Set(META_PREFIX+k, url.QueryEscape(v))
+	}
+
+	resp, err := r.do(req, UNSIGNED_PAYLOAD)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &relay.Object{
+		ID:       key,
+		Name:     name,
+		Size:     size,
+		Created:  time.Now(),
+		Metadata: metadata,
+	}, nil
+}
+
+// Find returns the objects that have the mnemonicode meta data. Only the objects
+// stored under the key prefix for the code are listed, and retrieved using HEAD requests
+func (r *Relay) Find(code string) ([]*relay.Object, error) {
+
+	objs := make([]*relay.Object, 0)
+	err := r.list(r.settings.Prefix+code+"/", func(obj *relay.Object) error {
+
+		if obj.Code() == code {
+			objs = append(objs, obj)
+		}
+
+		return nil
+	})
+
+	return objs, err
+}
+
+// Open returns a ReadCloser that can consume the body of the object
+func (r *Relay) Open(obj *relay.Object) (io.ReadCloser, error) {
+
+	req, err := http.NewRequest(http.MethodGet, r.objectURL(obj.ID).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.do(req, EMPTY_PAYLOAD)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// Delete removes the object from the bucket
+func (r *Relay) Delete(obj *relay.Object) error {
+
+	req, err := http.NewRequest(http.MethodDelete, r.objectURL(obj.ID).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.do(req, EMPTY_PAYLOAD)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// List calls fn for each of the objects in the bucket prefix. The listing does
+// not include user meta data, so each object is retrieved using a HEAD request
+func (r *Relay) List(fn func(*relay.Object) error) error {
+
+	return r.list(r.settings.Prefix, fn)
+}
+
+// list calls fn for each of the objects with keys that start with the prefix
+func (r *Relay) list(prefix string, fn func(*relay.Object) error) error {
+
+	token := ""
+	for {
+		u := r.objectURL("")
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if len(token) > 0 {
+			q.Set("continuation-token", token)
+		}
+		u.RawQuery = q.Encode()
+
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := r.do(req, EMPTY_PAYLOAD)
+		if err != nil {
+			return err
+		}
+
+		result := listBucketResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("Unable to parse S3 bucket listing: %v", err)
+		}
+
+		for _, c := range result.Contents {
+			metadata, err := r.head(c.Key)
+			if err != nil {
+				return err
+			}
+
+			err = fn(&relay.Object{
+				ID:       c.Key,
+				Name:     path.Base(c.Key),
+				Size:     c.Size,
+				Created:  c.LastModified,
+				Metadata: metadata,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if result.IsTruncated == false || len(result.NextContinuationToken) == 0 {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// SetMetadata adds the meta data to the object. S3 meta data cannot be modified
+// in place, so the object is copied onto itself with the replacement meta data
+func (r *Relay) SetMetadata(obj *relay.Object, metadata map[string]string) error {
+
+	obj.Merge(metadata)
+
+	if obj.Size > MAX_PUT_SIZE {
+		return r.copyMultipart(obj)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, r.objectURL(obj.ID).String(), http.NoBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Amz-Copy-Source", uriEncode("/"+r.settings.Bucket+"/"+obj.ID, false))
+	req.Header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	for k, v := range obj.Metadata {
+		req.Header.Set(META_PREFIX+k, url.QueryEscape(v))
+	}
+
+	resp, err := r.do(req, EMPTY_PAYLOAD)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// objectKey returns the key for the object name, objects that have a code are
+// stored under a prefix for the code e.g. prefix/code/name
+func (r *Relay) objectKey(name string, code string) string {
+
+	if len(code) == 0 {
+		return r.settings.Prefix + name
+	}
+
+	return r.settings.Prefix + code + "/" + name
+}
+
+// putMultipart uploads the contents of the reader as the parts of a multipart upload
+func (r *Relay) putMultipart(key string, metadata map[string]string, size int64, reader io.Reader) error {
+
+	uploadID, err := r.createMultipart(key, metadata)
+	if err != nil {
+		return err
+	}
+
+	part := partSize(size)
+	parts := make([]completedPart, 0)
+	for offset := int64(0); offset < size; offset += part {
+		length := size - offset
+		if length > part {
+			length = part
+		}
+
+		u := r.objectURL(key)
+		q := url.Values{}
+		q.Set("partNumber", strconv.Itoa(len(parts)+1))
+		q.Set("uploadId", uploadID)
+		u.RawQuery = q.Encode()
+
+		req, err := http.NewRequest(http.MethodPut, u.String(), ioutil.NopCloser(io.LimitReader(reader, length)))
+		if err != nil {
+			r.abortMultipart(key, uploadID)
+			return err
+		}
+		req.ContentLength = length
+
+		resp, err := r.do(req, UNSIGNED_PAYLOAD)
+		if err != nil {
+			r.abortMultipart(key, uploadID)
+			return err
+		}
+		resp.Body.Close()
+
+		parts = append(parts, completedPart{PartNumber: len(parts) + 1, ETag: resp.Header.Get("ETag")})
+	}
+
+	return r.completeMultipart(key, uploadID, parts)
+}
+
+// copyMultipart copies the object onto itself with the replacement meta data,
+// as the parts of a multipart upload
+func (r *Relay) copyMultipart(obj *relay.Object) error {
+
+	uploadID, err := r.createMultipart(obj.ID, obj.Metadata)
+	if err != nil {
+		return err
+	}
+
+	part := partSize(obj.Size)
+	parts := make([]completedPart, 0)
+	for offset := int64(0); offset < obj.Size; offset += part {
+		end := offset + part - 1
+		if end >= obj.Size {
+			end = obj.Size - 1
+		}
+
+		u := r.objectURL(obj.ID)
+		q := url.Values{}
+		q.Set("partNumber", strconv.Itoa(len(parts)+1))
+		q.Set("uploadId", uploadID)
+		u.RawQuery = q.Encode()
+
+		req, err := http.NewRequest(http.MethodPut, u.String(), http.NoBody)
+		if err != nil {
+			r.abortMultipart(obj.ID, uploadID)
+			return err
+		}
+		req.Header.Set("X-Amz-Copy-Source", uriEncode("/"+r.settings.Bucket+"/"+obj.ID, false))
+		req.Header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", offset, end))
+
+		resp, err := r.do(req, EMPTY_PAYLOAD)
+		if err != nil {
+			r.abortMultipart(obj.ID, uploadID)
+			return err
+		}
+
+		result := copyPartResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			r.abortMultipart(obj.ID, uploadID)
+			return fmt.Errorf("Unable to parse S3 copy part result: %v", err)
+		}
+
+		parts = append(parts, completedPart{PartNumber: len(parts) + 1, ETag: result.ETag})
+	}
+
+	return r.completeMultipart(obj.ID, uploadID, parts)
+}
+
+// createMultipart starts a multipart upload to the key with the meta data and returns the upload ID
+func (r *Relay) createMultipart(key string, metadata map[string]string) (string, error) {
+
+	u := r.objectURL(key)
+	u.RawQuery = "uploads="
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), http.NoBody)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	for k, v := range metadata {
+		req.Header.Set(META_PREFIX+k, url.QueryEscape(v))
+	}
+
+	resp, err := r.do(req, EMPTY_PAYLOAD)
+	if err != nil {
+		return "", err
+	}
+
+	result := initiateMultipartUploadResult{}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if err != nil || len(result.UploadId) == 0 {
+		return "", fmt.Errorf("Unable to parse S3 multipart upload result: %v", err)
+	}
+
+	return result.UploadId, nil
+}
+
+// completeMultipart combines the uploaded parts into the object
+func (r *Relay) completeMultipart(key string, uploadID string, parts []completedPart) error {
+
+	data, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		r.abortMultipart(key, uploadID)
+		return err
+	}
+
+	u := r.objectURL(key)
+	q := url.Values{}
+	q.Set("uploadId", uploadID)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(data))
+	if err != nil {
+		r.abortMultipart(key, uploadID)
+		return err
+	}
+
+	resp, err := r.do(req, hashHex(data))
+	if err != nil {
+		r.abortMultipart(key, uploadID)
+		return err
+	}
+
+	// The request can fail after the 200 status has been sent, in which case the error is in the body
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	er := errorResponse{}
+	if xml.Unmarshal(body, &er) == nil && len(er.Code) > 0 {
+		r.abortMultipart(key, uploadID)
+		return fmt.Errorf("S3 request failed: %s: %s", er.Code, er.Message)
+	}
+
+	return nil
+}
+
+// abortMultipart removes the parts of a failed multipart upload
+func (r *Relay) abortMultipart(key string, uploadID string) {
+
+	u := r.objectURL(key)
+	q := url.Values{}
+	q.Set("uploadId", uploadID)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := r.do(req, EMPTY_PAYLOAD)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// head retrieves the user meta data for the object key
+func (r *Relay) head(key string) (map[string]string, error) {
+
+	req, err := http.NewRequest(http.MethodHead, r.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.do(req, EMPTY_PAYLOAD)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	metadata := make(map[string]string, 0)
+	for k := range resp.Header {
+		if strings.HasPrefix(k, META_PREFIX) == false {
+			continue
+		}
+
+		v, err := url.QueryUnescape(resp.Header.Get(k))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid meta data value for %s: %v", k, err)
+		}
+		metadata[strings.ToLower(strings.TrimPrefix(k, META_PREFIX))] = v
+	}
+
+	return metadata, nil
+}
@@ -0,0 +1,34 @@
+package s3
+
+import (
+	"testing"
+
+	config "filesender/config"
+)
+
+// TestPartSize checks that the parts are at least PART_SIZE, and that there are no more than MAX_PARTS
+func TestPartSize(t *testing.T) {
+
+	for _, size := range []int64{MAX_PUT_SIZE + 1, 100 * MAX_PUT_SIZE, 1000 * MAX_PUT_SIZE} {
+		part := partSize(size)
+		if part < PART_SIZE {
+			t.Errorf("Part size %d for %d is less than the minimum", part, size)
+		}
+		if (size+part-1)/part > MAX_PARTS {
+			t.Errorf("Part size %d for %d needs more than %d parts", part, size, MAX_PARTS)
+		}
+	}
+}
+
+// TestObjectKey checks that objects with a code are stored under the prefix for the code
+func TestObjectKey(t *testing.T) {
+
+	r := &Relay{settings: config.S3Settings{Prefix: "filesender/"}}
+
+	if key := r.objectKey("guid", "alpha-bravo"); key != "filesender/alpha-bravo/guid" {
+		t.Fatalf("Unexpected key %s", key)
+	}
+	if key := r.objectKey("guid", ""); key != "filesender/guid" {
+		t.Fatalf("Unexpected key %s", key)
+	}
+}
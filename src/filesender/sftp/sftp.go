@@ -0,0 +1,264 @@
+package sftp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	config "filesender/config"
+	relay "filesender/relay"
+	helper "filesender/utils"
+
+	"github.com/howeyc/gopass"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ##### Variables ###########################################################
+
+// The private keys that are tried when no key file is defined in the settings
+var defaultKeyFiles = []string{"~/.ssh/id_ed25519", "~/.ssh/id_ecdsa", "~/.ssh/id_rsa"}
+
+// ##### Structs #############################################################
+
+// Relay implements the relay.Relay interface using a directory on an SFTP
+// server. The filesender meta data is stored in a JSON sidecar file
+type Relay struct {
+	directory string
+	client    *sftp.Client
+}
+
+// ##### Functions ###########################################################
+
+// New connects to the SFTP server using key based authentication, verifying the
+// host key against the known_hosts file, and returns a relay for the directory
+func New(s config.SFTPSettings) *Relay {
+
+	if len(s.Host) == 0 {
+		helper.OutputAndExit("SFTP host not defined in the settings file")
+	}
+
+	if len(s.User) == 0 {
+		u, err := user.Current()
+		if err != nil {
+			helper.OutputAndExit(fmt.Sprintf("Unable to determine SFTP user: %v", err))
+		}
+		s.User = u.Username
+	}
+
+	keyFiles := defaultKeyFiles
+	if len(s.KeyFile) > 0 {
+		keyFiles = []string{s.KeyFile}
+	}
+
+	signers, err := loadSigners(keyFiles)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error loading SSH private key: %v", err))
+	}
+	if len(signers) == 0 {
+		helper.OutputAndExit("No SSH private keys found")
+	}
+
+	hostKeyCallback, err := knownhosts.New(expandHome(s.KnownHosts))
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error loading SSH known hosts: %v", err))
+	}
+
+	conn, err := ssh.Dial("tcp", net.JoinHostPort(s.Host, strconv.Itoa(s.Port)), &ssh.ClientConfig{
+		User:            s.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error connecting to SFTP server: %v", err))
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error starting SFTP session: %v", err))
+	}
+
+	err = client.MkdirAll(s.Directory)
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error creating SFTP directory: %v", err))
+	}
+
+	return &Relay{directory: s.Directory, client: client}
+}
+
+// loadSigners parses the private key files that exist, prompting
+// for the passphrase if a key is passphrase protected
+func loadSigners(keyFiles []string) ([]ssh.Signer, error) {
+
+	signers := make([]ssh.Signer, 0)
+	for _, keyFile := range keyFiles {
+		data, err := ioutil.ReadFile(expandHome(keyFile))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		signer, err := ssh.ParsePrivateKey(data)
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			fmt.Printf("Enter passphrase for %s: ", keyFile)
+			passphrase, perr := gopass.GetPasswd()
+			if perr != nil {
+				return nil, fmt.Errorf("Error reading passphrase")
+			}
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(data, passphrase)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", keyFile, err)
+		}
+
+		signers = append(signers, signer)
+	}
+
+	return signers, nil
+}
+
+// expandHome replaces a leading ~ with the users home directory
+func expandHome(p string) string {
+
+	if strings.HasPrefix(p, "~/") == false {
+		return p
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+
+	return filepath.Join(home, p[2:])
+}
+
+// ##### Methods #############################################################
+
+// write streams the contents of the reader into a temporary file, which
+// is then renamed, so that partial files are never seen by a receiver
+func (r *Relay) write(name string, reader io.Reader) error {
+
+	tmpPath := path.Join(r.directory, name+".tmp")
+	f, err := r.client.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, reader)
+	if err != nil {
+		f.Close()
+		r.client.Remove(tmpPath)
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return r.client.PosixRename(tmpPath, path.Join(r.directory, name))
+}
+
+// Put uploads the file into the directory, followed by the meta data sidecar
+func (r *Relay) Put(name string, metadata map[string]string, size int64, reader io.Reader) (*relay.Object, error) {
+
+	err := r.write(name, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := relay.NewSidecar(metadata, size)
+	err = r.write(name+relay.SIDECAR_EXT, bytes.NewReader(sc.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+
+	return sc.Object(name, name), nil
+}
+
+// Find returns the files in the directory that have the mnemonicode meta data
+func (r *Relay) Find(code string) ([]*relay.Object, error) {
+
+	return relay.FindByCode(r, code)
+}
+
+// Open returns a ReadCloser that can consume the body of the file
+func (r *Relay) Open(obj *relay.Object) (io.ReadCloser, error) {
+
+	return r.client.Open(path.Join(r.directory, obj.ID))
+}
+
+// Delete removes the meta data sidecar and the file from the directory. The sidecar is
+// removed first, so that the file is no longer listed while it is being removed
+func (r *Relay) Delete(obj *relay.Object) error {
+
+	err := r.client.Remove(path.Join(r.directory, obj.ID+relay.SIDECAR_EXT))
+	if err != nil {
+		return err
+	}
+
+	return r.client.Remove(path.Join(r.directory, obj.ID))
+}
+
+// SetMetadata adds the meta data to the object, and rewrites the meta data sidecar
+func (r *Relay) SetMetadata(obj *relay.Object, metadata map[string]string) error {
+
+	obj.Merge(metadata)
+	return r.write(obj.ID+relay.SIDECAR_EXT, bytes.NewReader(obj.Sidecar().Bytes()))
+}
+
+// List calls fn for each of the files in the directory that have a meta data sidecar,
+// skipping the sidecars removed while the directory is listed
+func (r *Relay) List(fn func(*relay.Object) error) error {
+
+	files, err := r.client.ReadDir(r.directory)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range files {
+		if fi.IsDir() == true || relay.IsSidecar(fi.Name()) == false {
+			continue
+		}
+
+		f, err := r.client.Open(path.Join(r.directory, fi.Name()))
+		// The file may have been removed by another receiver since the directory was read
+		if os.IsNotExist(err) == true {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		sc, err := relay.ParseSidecar(data)
+		if err != nil {
+			return fmt.Errorf("Invalid meta data sidecar %s: %v", fi.Name(), err)
+		}
+
+		name := strings.TrimSuffix(fi.Name(), relay.SIDECAR_EXT)
+		err = fn(sc.Object(name, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,216 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	config "filesender/config"
+	relay "filesender/relay"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ##### Functions ###########################################################
+
+// newSigner generates an ed25519 key, and writes the private key to the file if a name is given
+func newSigner(t *testing.T, name string) ssh.Signer {
+
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(name) > 0 {
+		block, err := ssh.MarshalPrivateKey(key, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(name, pem.EncodeToMemory(block), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return signer
+}
+
+// serve accepts SSH connections authenticated using the client key, and serves
+// the sftp subsystem from the local file system
+func serve(listener net.Listener, hostKey ssh.Signer, clientKey ssh.PublicKey) {
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+
+			if bytes.Equal(key.Marshal(), clientKey.Marshal()) == false {
+				return nil, ssh.ErrNoAuth
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+
+			_, channels, requests, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go ssh.DiscardRequests(requests)
+
+			for nc := range channels {
+				if nc.ChannelType() != "session" {
+					nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+					continue
+				}
+
+				channel, requests, err := nc.Accept()
+				if err != nil {
+					continue
+				}
+
+				go func() {
+
+					for req := range requests {
+						ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+						req.Reply(ok, nil)
+						if ok == true {
+							server, err := sftp.NewServer(channel)
+							if err == nil {
+								server.Serve()
+								server.Close()
+							}
+						}
+					}
+				}()
+			}
+		}()
+	}
+}
+
+// newRelay starts an SSH server with the sftp subsystem, and connects to it using New
+func newRelay(t *testing.T, dir string) (*Relay, func()) {
+
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostKey := newSigner(t, "")
+	keyFile := filepath.Join(dir, "id_ed25519")
+	clientKey := newSigner(t, keyFile)
+	go serve(listener, hostKey, clientKey.PublicKey())
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, hostKey.PublicKey())
+	err = ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, _ := strconv.Atoi(port)
+	r := New(config.SFTPSettings{
+		Host:       host,
+		Port:       p,
+		User:       "filesender",
+		Directory:  filepath.Join(dir, "relay"),
+		KeyFile:    keyFile,
+		KnownHosts: knownHosts,
+	})
+
+	return r, func() {
+
+		r.client.Close()
+		listener.Close()
+	}
+}
+
+// TestRelay uploads a file, updates its meta data, finds it by code and downloads it
+func TestRelay(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "filesender")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, closeRelay := newRelay(t, dir)
+	defer closeRelay()
+
+	data := []byte("hello over sftp")
+	obj, err := r.Put("guid", map[string]string{relay.KEY_CODE: "alpha-bravo"}, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.SetMetadata(obj, map[string]string{relay.KEY_SHA256: "checksum"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files that are not sidecars, and the temporary files, are not listed
+	err = ioutil.WriteFile(filepath.Join(dir, "relay", "other.json"), []byte("{}"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objs, err := r.Find("alpha-bravo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 || objs[0].ID != "guid" || objs[0].Size != int64(len(data)) || objs[0].Metadata[relay.KEY_SHA256] != "checksum" {
+		t.Fatalf("Unexpected objects %v", objs)
+	}
+
+	reader, err := r.Open(objs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(received, data) == false {
+		t.Fatalf("Unexpected contents %q", received)
+	}
+
+	err = r.Delete(objs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objs, err = r.Find("alpha-bravo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 0 {
+		t.Fatalf("Objects remain after delete %v", objs)
+	}
+}
@@ -0,0 +1,386 @@
+package webdav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	config "filesender/config"
+	relay "filesender/relay"
+	helper "filesender/utils"
+)
+
+// ##### Constants ###########################################################
+
+const PROPFIND_BODY string = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getetag/></d:prop></d:propfind>`
+
+// ##### Structs #############################################################
+
+// Relay implements the relay.Relay interface using a WebDAV collection e.g.
+// Nextcloud/ownCloud. The filesender meta data is stored in a JSON sidecar file
+type Relay struct {
+	settings   config.WebDAVSettings
+	collection *url.URL
+	client     *http.Client
+
+	// The sidecars downloaded by List, keyed by name, so that a sidecar is only
+	// downloaded again when its ETag changes e.g. while the receiver polls
+	mutex    sync.Mutex
+	sidecars map[string]cachedSidecar
+}
+
+// cachedSidecar is the contents of a sidecar along with its ETag
+type cachedSidecar struct {
+	etag string
+	data []byte
+}
+
+// multistatus is the response of a PROPFIND request
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ETag string `xml:"getetag"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// statusError is returned when a request receives a non 2xx response
+type statusError struct {
+	method     string
+	path       string
+	status     string
+	statusCode int
+}
+
+// ##### Functions ###########################################################
+
+// New validates the WebDAV settings, creates the collection if it
+// does not already exist and returns a relay for the collection
+func New(s config.WebDAVSettings) *Relay {
+
+	if len(s.URL) == 0 {
+		helper.OutputAndExit("WebDAV URL not defined in the settings file")
+	}
+
+	if len(s.Password) == 0 {
+		s.Password = os.Getenv("FILESENDER_WEBDAV_PASSWORD")
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(s.URL, "/") + "/")
+	if err != nil || len(u.Host) == 0 {
+		helper.OutputAndExit(fmt.Sprintf("Invalid WebDAV URL: %s", s.URL))
+	}
+
+	r := &Relay{settings: s, collection: u, client: http.DefaultClient}
+
+	err = r.makeCollection()
+	if err != nil {
+		helper.OutputAndExit(fmt.Sprintf("Error creating WebDAV collection: %v", err))
+	}
+
+	return r
+}
+
+// checkResponse converts a non 2xx response into a statusError
+func checkResponse(resp *http.Response) error {
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	resp.Body.Close()
+	return &statusError{
+		method:     resp.Request.Method,
+		path:       resp.Request.URL.Path,
+		status:     resp.Status,
+		statusCode: resp.StatusCode,
+	}
+}
+
+// isNotFound determines if the error is a 404 response
+func isNotFound(err error) bool {
+
+	se, ok := err.(*statusError)
+	return ok == true && se.statusCode == http.StatusNotFound
+}
+
+// ##### Methods #############################################################
+
+// Error returns the description of the failed request
+func (e *statusError) Error() string {
+
+	return fmt.Sprintf("WebDAV request failed: %s %s: %s", e.method, e.path, e.status)
+}
+
+// fileURL returns the URL of the file within the collection
+func (r *Relay) fileURL(name string) string {
+
+	return r.collection.ResolveReference(&url.URL{Path: name}).String()
+}
+
+// do adds the credentials to the request and performs it
+func (r *Relay) do(method string, u string, body io.Reader, size int64, headers map[string]string) (*http.Response, error) {
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	if len(r.settings.Username) > 0 {
+		req.SetBasicAuth(r.settings.Username, r.settings.Password)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// makeCollection creates the collection if it does not already exist. Any other
+// error e.g. invalid credentials is returned rather than attempting to create it
+func (r *Relay) makeCollection() error {
+
+	_, err := r.propfind(r.collection.String(), "0")
+	if err == nil {
+		return nil
+	}
+	if isNotFound(err) == false {
+		return err
+	}
+
+	resp, err := r.do("MKCOL", r.collection.String(), nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// propfind retrieves the resource types and ETags of the URL, and its children if depth is 1
+func (r *Relay) propfind(u string, depth string) (*multistatus, error) {
+
+	body := []byte(PROPFIND_BODY)
+	resp, err := r.do("PROPFIND", u, bytes.NewReader(body), int64(len(body)), map[string]string{
+		"Depth":        depth,
+		"Content-Type": "application/xml; charset=utf-8",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	ms := new(multistatus)
+	err = xml.NewDecoder(resp.Body).Decode(ms)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse WebDAV response: %v", err)
+	}
+
+	return ms, nil
+}
+
+// put uploads the contents of the reader to the file within the collection
+func (r *Relay) put(name string, size int64, reader io.Reader) error {
+
+	resp, err := r.do(http.MethodPut, r.fileURL(name), ioutil.NopCloser(reader), size, map[string]string{
+		"Content-Type": "application/octet-stream",
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// get downloads the file from within the collection
+func (r *Relay) get(name string) (io.ReadCloser, error) {
+
+	resp, err := r.do(http.MethodGet, r.fileURL(name), nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// Put uploads the file into the collection, followed by the meta data sidecar
+func (r *Relay) Put(name string, metadata map[string]string, size int64, reader io.Reader) (*relay.Object, error) {
+
+	err := r.put(name, size, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := relay.NewSidecar(metadata, size)
+	data := sc.Bytes()
+	err = r.put(name+relay.SIDECAR_EXT, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return sc.Object(name, name), nil
+}
+
+// Find returns the files in the collection that have the mnemonicode meta data
+func (r *Relay) Find(code string) ([]*relay.Object, error) {
+
+	return relay.FindByCode(r, code)
+}
+
+// Open returns a ReadCloser that can consume the body of the file
+func (r *Relay) Open(obj *relay.Object) (io.ReadCloser, error) {
+
+	return r.get(obj.ID)
+}
+
+// Delete removes the file and its meta data sidecar from the collection
+func (r *Relay) Delete(obj *relay.Object) error {
+
+	for _, name := range []string{obj.ID, obj.ID + relay.SIDECAR_EXT} {
+		resp, err := r.do(http.MethodDelete, r.fileURL(name), nil, 0, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+
+	return nil
+}
+
+// SetMetadata adds the meta data to the object, and uploads the meta data sidecar again
+func (r *Relay) SetMetadata(obj *relay.Object, metadata map[string]string) error {
+
+	obj.Merge(metadata)
+	data := obj.Sidecar().Bytes()
+	return r.put(obj.ID+relay.SIDECAR_EXT, int64(len(data)), bytes.NewReader(data))
+}
+
+// sidecar returns the contents of the sidecar, which is only downloaded if it is not
+// cached with the ETag. Sidecars without an ETag are always downloaded
+func (r *Relay) sidecar(name string, etag string, cache map[string]cachedSidecar) ([]byte, error) {
+
+	r.mutex.Lock()
+	cached, ok := r.sidecars[name]
+	r.mutex.Unlock()
+
+	if ok == true && len(etag) > 0 && cached.etag == etag {
+		cache[name] = cached
+		return cached.data, nil
+	}
+
+	reader, err := r.get(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(etag) > 0 {
+		cache[name] = cachedSidecar{etag: etag, data: data}
+	}
+
+	return data, nil
+}
+
+// List calls fn for each of the files in the collection that have a valid meta data sidecar.
+// The sidecars are cached by ETag, so each call only downloads the new or changed sidecars
+func (r *Relay) List(fn func(*relay.Object) error) error {
+
+	ms, err := r.propfind(r.collection.String(), "1")
+	if err != nil {
+		return err
+	}
+
+	// Only the sidecars still in the collection are kept in the cache
+	cache := make(map[string]cachedSidecar, 0)
+	defer func() {
+
+		r.mutex.Lock()
+		r.sidecars = cache
+		r.mutex.Unlock()
+	}()
+
+	for _, resp := range ms.Responses {
+
+		isCollection := false
+		etag := ""
+		for _, ps := range resp.Propstat {
+			if ps.Prop.ResourceType.Collection != nil {
+				isCollection = true
+			}
+			if len(ps.Prop.ETag) > 0 {
+				etag = ps.Prop.ETag
+			}
+		}
+		if isCollection == true {
+			continue
+		}
+
+		href, err := url.Parse(resp.Href)
+		if err != nil {
+			return fmt.Errorf("Invalid WebDAV href: %s", resp.Href)
+		}
+
+		name := path.Base(href.Path)
+		if relay.IsSidecar(name) == false {
+			continue
+		}
+
+		// The file may have been removed by another receiver since the collection was listed
+		data, err := r.sidecar(name, etag, cache)
+		if isNotFound(err) == true {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		// Files in the collection that are not filesender sidecars are skipped
+		sc, err := relay.ParseSidecar(data)
+		if err != nil {
+			continue
+		}
+
+		name = strings.TrimSuffix(name, relay.SIDECAR_EXT)
+		err = fn(sc.Object(name, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package webdav
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	config "filesender/config"
+	relay "filesender/relay"
+)
+
+// ##### Functions ###########################################################
+
+// newServer returns a server that responds to a PROPFIND of the collection with the status,
+// listing the files with an ETag of their contents, and records the methods of the requests received
+func newServer(status int, files map[string]string) (*httptest.Server, *[]string) {
+
+	methods := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+
+		methods = append(methods, req.Method)
+
+		switch req.Method {
+		case "PROPFIND":
+			if status != http.StatusMultiStatus {
+				w.WriteHeader(status)
+				return
+			}
+
+			w.WriteHeader(http.StatusMultiStatus)
+			fmt.Fprint(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">`)
+			fmt.Fprint(w, `<d:response><d:href>/dav/</d:href><d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop></d:propstat></d:response>`)
+			for name, data := range files {
+				fmt.Fprintf(w, `<d:response><d:href>/dav/%s</d:href><d:propstat><d:prop><d:resourcetype/><d:getetag>"%x"</d:getetag></d:prop></d:propstat></d:response>`, name, md5.Sum([]byte(data)))
+			}
+			fmt.Fprint(w, `</d:multistatus>`)
+		case http.MethodGet:
+			data, ok := files[strings.TrimPrefix(req.URL.Path, "/dav/")]
+			if ok == false {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, data)
+		case "MKCOL":
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+
+	return server, &methods
+}
+
+// newRelay returns a relay for the collection on the server, without creating the collection
+func newRelay(server *httptest.Server) *Relay {
+
+	u, _ := url.Parse(server.URL + "/dav/")
+	return &Relay{settings: config.WebDAVSettings{URL: u.String()}, collection: u, client: http.DefaultClient}
+}
+
+// TestMakeCollection checks that the collection is only created when it is not found
+func TestMakeCollection(t *testing.T) {
+
+	tests := []struct {
+		status int
+		mkcol  bool
+		err    bool
+	}{
+		{http.StatusMultiStatus, false, false},
+		{http.StatusNotFound, true, false},
+		{http.StatusUnauthorized, false, true},
+		{http.StatusForbidden, false, true},
+	}
+
+	for _, test := range tests {
+		server, methods := newServer(test.status, nil)
+
+		err := newRelay(server).makeCollection()
+		server.Close()
+
+		if (err != nil) != test.err {
+			t.Errorf("Status %d: unexpected error %v", test.status, err)
+		}
+
+		mkcol := len(*methods) > 1 && (*methods)[1] == "MKCOL"
+		if mkcol != test.mkcol {
+			t.Errorf("Status %d: unexpected requests %v", test.status, *methods)
+		}
+	}
+}
+
+// TestListSidecars checks that only files with a valid filesender sidecar are listed
+func TestListSidecars(t *testing.T) {
+
+	sc := relay.NewSidecar(map[string]string{relay.KEY_CODE: "alpha-bravo"}, 5)
+	server, _ := newServer(http.StatusMultiStatus, map[string]string{
+		"guid":                       "hello",
+		"guid" + relay.SIDECAR_EXT:   string(sc.Bytes()),
+		"package.json":               `{"name": "other"}`,
+		"broken" + relay.SIDECAR_EXT: "not json",
+	})
+	defer server.Close()
+
+	objs, err := newRelay(server).Find("alpha-bravo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(objs) != 1 || objs[0].ID != "guid" || objs[0].Size != 5 {
+		t.Fatalf("Unexpected objects %v", objs)
+	}
+}
+
+// TestFindCachedSidecars checks that polling only downloads the sidecars that are new or
+// have changed since the last listing
+func TestFindCachedSidecars(t *testing.T) {
+
+	files := map[string]string{
+		"guid":                     "hello",
+		"guid" + relay.SIDECAR_EXT: string(relay.NewSidecar(map[string]string{relay.KEY_CODE: "alpha-bravo"}, 5).Bytes()),
+	}
+	server, methods := newServer(http.StatusMultiStatus, files)
+	defer server.Close()
+
+	// gets returns the number of GET requests received since the last call
+	count := 0
+	gets := func() int {
+
+		n := 0
+		for _, method := range (*methods)[count:] {
+			if method == http.MethodGet {
+				n++
+			}
+		}
+		count = len(*methods)
+		return n
+	}
+
+	r := newRelay(server)
+	for i, expected := range []int{1, 0} {
+		objs, err := r.Find("alpha-bravo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(objs) != 1 || gets() != expected {
+			t.Fatalf("Poll %d: unexpected objects %v or downloads", i, objs)
+		}
+	}
+
+	// A changed sidecar is downloaded again
+	files["guid"+relay.SIDECAR_EXT] = string(relay.NewSidecar(map[string]string{relay.KEY_CODE: "alpha-bravo", relay.KEY_SHA256: "00"}, 5).Bytes())
+	objs, err := r.Find("alpha-bravo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 || objs[0].Metadata[relay.KEY_SHA256] != "00" || gets() != 1 {
+		t.Fatalf("Changed sidecar was not downloaded %v", objs)
+	}
+}